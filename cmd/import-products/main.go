@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/yeboahd24/subscription-stripe/config"
+	"github.com/yeboahd24/subscription-stripe/database"
+	"github.com/yeboahd24/subscription-stripe/handlers"
+	"github.com/yeboahd24/subscription-stripe/stripeclient"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing to the database")
+	flag.Parse()
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Initialize database
+	db, err := database.Init(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	stripeclient.Install(stripeclient.FromEnv())
+
+	report, err := handlers.ImportStripeCatalog(context.Background(), db, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to import products from Stripe: %v", err)
+	}
+
+	if report.DryRun {
+		fmt.Println("Dry run: no changes were written")
+	}
+	for _, item := range report.Created {
+		fmt.Printf("created  %s  %s\n", item.StripeProductID, item.Name)
+	}
+	for _, item := range report.Updated {
+		fmt.Printf("updated  %s  %s\n", item.StripeProductID, item.Name)
+	}
+	for _, item := range report.Skipped {
+		fmt.Printf("skipped  %s  %s (%s)\n", item.StripeProductID, item.Name, item.Reason)
+	}
+	fmt.Printf("%d created, %d updated, %d skipped\n", len(report.Created), len(report.Updated), len(report.Skipped))
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"strconv"
 
 	"github.com/yeboahd24/subscription-stripe/config"
 	"github.com/yeboahd24/subscription-stripe/database"
+	"github.com/yeboahd24/subscription-stripe/handlers"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/notify"
 	"github.com/yeboahd24/subscription-stripe/routes"
+	"github.com/yeboahd24/subscription-stripe/stripeclient"
 
 	"github.com/gin-gonic/gin"
 )
@@ -23,6 +30,33 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Send Stripe API requests with timeouts, retries and a circuit breaker
+	stripeclient.Install(stripeclient.FromEnv())
+
+	// Start background jobs and queue workers; set JOBS_ENABLED=false on
+	// replicas that should only serve requests
+	if os.Getenv("JOBS_ENABLED") != "false" {
+		runner := jobs.NewRunner(db)
+		for _, job := range handlers.BackgroundJobs(db) {
+			if err := runner.Register(job); err != nil {
+				log.Fatalf("Failed to register job: %v", err)
+			}
+		}
+		go runner.Start(context.Background())
+
+		concurrency, err := strconv.Atoi(os.Getenv("QUEUE_CONCURRENCY"))
+		if err != nil {
+			concurrency = 4
+		}
+		notifier, err := notify.FromEnv()
+		if err != nil {
+			log.Fatalf("Failed to configure notifications: %v", err)
+		}
+		queue := jobs.NewQueue(db, concurrency)
+		handlers.RegisterTasks(queue, db, notifier)
+		go queue.Start(context.Background())
+	}
+
 	// Set up Gin router
 	r := gin.Default()
 
@@ -1,7 +1,10 @@
 package database
 
 import (
+	"encoding/json"
+
 	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -14,10 +17,159 @@ func Init(databaseURL string) (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the models
-	err = db.AutoMigrate(&models.CustomUser{}, &models.Product{}, &models.Subscription{})
+	err = db.AutoMigrate(
+		&models.CustomUser{},
+		&models.Product{},
+		&models.Subscription{},
+		&models.IdempotencyKey{},
+		&models.SubscriptionItem{},
+		&models.AddonCompatibility{},
+		&models.Purchase{},
+		&models.Gift{},
+		&models.GiftAuditEntry{},
+		&models.Referral{},
+		&models.Wallet{},
+		&models.WalletEntry{},
+		&models.WalletTopUp{},
+		&models.Feature{},
+		&models.Entitlement{},
+		&models.QuotaUsage{},
+		&models.Organization{},
+		&models.OrganizationMember{},
+		&models.OrganizationInvitation{},
+		&models.SubscriptionEvent{},
+		&models.JobRun{},
+		&models.QueuedJob{},
+		&models.WebhookEndpoint{},
+		&models.WebhookEvent{},
+		&models.WebhookDelivery{},
+		&models.BillingOperation{},
+		&models.RevenueSnapshot{},
+		&models.Export{},
+		&models.ExportChunk{},
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	// Wallet references are unique per entry type since the index replacing this one
+	if db.Migrator().HasIndex(&models.WalletEntry{}, "idx_wallet_entry_reference") {
+		if err := db.Migrator().DropIndex(&models.WalletEntry{}, "idx_wallet_entry_reference"); err != nil {
+			return nil, err
+		}
+	}
+	if err := migrateSubscriptionStatuses(db); err != nil {
+		return nil, err
+	}
+	if err := createLiveSubscriptionIndexes(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
+
+// migrateSubscriptionStatuses converts the statuses written before the
+// lifecycle was typed, and folds the old is_in_trial column into them:
+// running trials become "trialing", ended trials that were never paid become
+// "paused", and "cancelled" is spelled "canceled" like Stripe does.
+func migrateSubscriptionStatuses(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if tx.Migrator().HasColumn(&models.Subscription{}, "is_in_trial") {
+			if err := tx.Exec("UPDATE subscriptions SET status = ? WHERE status = ? AND is_in_trial", models.SubscriptionStatusTrialing, "active").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("UPDATE subscriptions SET status = ? WHERE status = ? AND plan = ? AND NOT is_in_trial", models.SubscriptionStatusPaused, "active", "trial").Error; err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&models.Subscription{}, "is_in_trial"); err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec("UPDATE subscriptions SET status = ? WHERE status IN ?", models.SubscriptionStatusCanceled, []string{"cancelled", "completed"}).Error
+	})
+}
+
+// createLiveSubscriptionIndexes creates the partial unique indexes that allow
+// one subscription per product that is not canceled, for each user and each
+// organization. They must be created after migrateSubscriptionStatuses: legacy
+// "cancelled" rows would otherwise count as live and fail the index. Live
+// duplicates that were created before the indexes existed are cancelled
+// first.
+func createLiveSubscriptionIndexes(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasIndex(&models.Subscription{}, models.LiveUserSubscriptionIndex) ||
+		!migrator.HasIndex(&models.Subscription{}, models.LiveOrganizationSubscriptionIndex) {
+		if err := cancelDuplicateLiveSubscriptions(db); err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		"CREATE UNIQUE INDEX IF NOT EXISTS " + models.LiveUserSubscriptionIndex +
+			" ON subscriptions (user_id, product_id) WHERE status <> 'canceled' AND organization_id IS NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS " + models.LiveOrganizationSubscriptionIndex +
+			" ON subscriptions (organization_id, product_id) WHERE status <> 'canceled' AND organization_id IS NOT NULL",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelDuplicateLiveSubscriptions keeps the newest subscription that is not
+// canceled for each user or organization and product, and cancels the others
+// with a cancelled event. Cancelled duplicates billed in Stripe are logged:
+// Stripe keeps billing them until they are cancelled there.
+func cancelDuplicateLiveSubscriptions(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var duplicates []models.Subscription
+		if err := tx.Raw(`SELECT * FROM subscriptions WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (
+					PARTITION BY organization_id IS NULL, COALESCE(organization_id, user_id), product_id
+					ORDER BY created_at DESC, id DESC
+				) AS position
+				FROM subscriptions WHERE status <> ?
+			) ranked WHERE position > 1
+		)`, models.SubscriptionStatusCanceled).Scan(&duplicates).Error; err != nil {
+			return err
+		}
+
+		for _, subscription := range duplicates {
+			before, err := json.Marshal(subscription.Snapshot())
+			if err != nil {
+				return err
+			}
+			// Set directly: legacy rows may be in statuses the lifecycle
+			// cannot cancel from
+			subscription.Status = models.SubscriptionStatusCanceled
+			if err := tx.Model(&subscription).Update("status", subscription.Status).Error; err != nil {
+				return err
+			}
+			after, err := json.Marshal(subscription.Snapshot())
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&models.SubscriptionEvent{
+				SubscriptionID: subscription.ID,
+				Type:           models.SubscriptionEventCancelled,
+				Source:         models.EventSourceJob,
+				Before:         before,
+				After:          after,
+				Reason:         "Duplicate of a newer subscription to the same product",
+			}).Error; err != nil {
+				return err
+			}
+
+			if subscription.StripeID != "" {
+				utils.Log("Cancelled duplicate subscription", subscription.ID, "is still billed by Stripe subscription", subscription.StripeID)
+			} else {
+				utils.Log("Cancelled duplicate subscription", subscription.ID)
+			}
+		}
+		return nil
+	})
+}
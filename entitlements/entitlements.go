@@ -0,0 +1,144 @@
+// File: entitlements/entitlements.go
+package entitlements
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// Grant is a feature the user is entitled to, with the most generous limit of
+// all the products granting it.
+type Grant struct {
+	Feature    string      `json:"feature"`
+	Name       string      `json:"name"`
+	Limit      *int64      `json:"limit"` // nil means unlimited
+	ProductIDs []uuid.UUID `json:"product_ids"`
+}
+
+// Allows reports whether using n units stays within the grant's limit.
+func (g Grant) Allows(n int64) bool {
+	return g.Limit == nil || n <= *g.Limit
+}
+
+// gracePeriod is how long a cancelled subscription keeps its entitlements after
+// its end date, configured in days through ENTITLEMENT_GRACE_DAYS.
+func gracePeriod() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ENTITLEMENT_GRACE_DAYS"))
+	if err != nil || days < 0 {
+		days = 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// GrantingSubscriptions returns the subscriptions that currently grant the
+// user access to their products: active ones (including trials that have not
+// ended), past due ones still being retried, and cancelled ones that were
+// billed or created, within their paid period plus the grace period. Besides the user's personal
+// subscriptions, these include those of organizations that gave the user a
+// seat.
+func GrantingSubscriptions(db *gorm.DB, userID uuid.UUID) ([]models.Subscription, error) {
+	now := time.Now()
+
+	seatedOrganizations := db.Model(&models.OrganizationMember{}).
+		Select("organization_id").
+		Where("user_id = ? AND has_seat = ?", userID, true)
+
+	// Only subscriptions that were created grant a grace period once
+	// cancelled; reservations whose billing failed never granted anything
+	wasCreated := db.Model(&models.SubscriptionEvent{}).Select("1").
+		Where("subscription_events.subscription_id = subscriptions.id AND subscription_events.type = ?", models.SubscriptionEventCreated)
+
+	var subscriptions []models.Subscription
+	err := db.Preload("Items").
+		Where(
+			db.Where("user_id = ? AND organization_id IS NULL", userID).
+				Or("organization_id IN (?)", seatedOrganizations),
+		).
+		Where(
+			db.Where(
+				db.Where("status IN ?", models.GrantingSubscriptionStatuses).
+					Where("NOT (plan = ? AND trial_end_date < ?)", "trial", now).
+					Where("NOT (plan IN ? AND end_date < ?)", []string{"gift", "comp"}, now),
+			).
+				Or(
+					db.Where("status = ? AND end_date > ?", models.SubscriptionStatusCanceled, now.Add(-gracePeriod())).
+						Where(db.Where("stripe_id <> ''").Or("EXISTS (?)", wasCreated)),
+				),
+		).
+		Find(&subscriptions).Error
+
+	return subscriptions, err
+}
+
+// ProductIDs returns every product the user has access to through a granting
+// subscription, its add-ons, or a lifetime purchase.
+func ProductIDs(db *gorm.DB, userID uuid.UUID) ([]uuid.UUID, error) {
+	subscriptions, err := GrantingSubscriptions(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[uuid.UUID]bool{}
+	var productIDs []uuid.UUID
+	add := func(id uuid.UUID) {
+		if !seen[id] {
+			seen[id] = true
+			productIDs = append(productIDs, id)
+		}
+	}
+
+	for _, subscription := range subscriptions {
+		add(subscription.ProductID)
+		for _, item := range subscription.Items {
+			add(item.ProductID)
+		}
+	}
+
+	var lifetimeProductIDs []uuid.UUID
+	if err := db.Model(&models.Purchase{}).
+		Where("user_id = ? AND lifetime = ? AND status = ?", userID, true, models.PurchaseStatusPaid).
+		Pluck("product_id", &lifetimeProductIDs).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range lifetimeProductIDs {
+		add(id)
+	}
+
+	return productIDs, nil
+}
+
+// ForUser resolves the features the user is entitled to, keyed by feature key.
+func ForUser(db *gorm.DB, userID uuid.UUID) (map[string]Grant, error) {
+	productIDs, err := ProductIDs(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := map[string]Grant{}
+	if len(productIDs) == 0 {
+		return grants, nil
+	}
+
+	var rows []models.Entitlement
+	if err := db.Preload("Feature").Where("product_id IN ?", productIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		grant, exists := grants[row.Feature.Key]
+		if !exists {
+			grant = Grant{Feature: row.Feature.Key, Name: row.Feature.Name, Limit: row.Limit}
+		} else if grant.Limit != nil && (row.Limit == nil || *row.Limit > *grant.Limit) {
+			grant.Limit = row.Limit
+		}
+		grant.ProductIDs = append(grant.ProductIDs, row.ProductID)
+		grants[row.Feature.Key] = grant
+	}
+
+	return grants, nil
+}
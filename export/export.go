@@ -0,0 +1,230 @@
+// File: export/export.go
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// Formats an export can be written in
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson" // One JSON object per line
+)
+
+// Resources that can be exported
+const (
+	ResourceSubscriptions = "subscriptions"
+	ResourceUsers         = "users"
+)
+
+var (
+	ErrUnknownFormat   = errors.New("format must be csv or ndjson")
+	ErrUnknownResource = errors.New("resource must be subscriptions or users")
+)
+
+// Scope adds filters to the query an export reads from.
+type Scope func(*gorm.DB) *gorm.DB
+
+// ContentType returns the media type of a format.
+func ContentType(format string) string {
+	if format == FormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+// ValidFormat reports whether format is one of the export formats.
+func ValidFormat(format string) bool {
+	return format == FormatCSV || format == FormatNDJSON
+}
+
+// ValidResource reports whether resource can be exported.
+func ValidResource(resource string) bool {
+	return resource == ResourceSubscriptions || resource == ResourceUsers
+}
+
+// row is one exported record, with its CSV columns in the order of its
+// resource's header.
+type row interface {
+	record() []string
+}
+
+// SubscriptionRow is an exported subscription with its user's email and its
+// product. Price is what one seat is billed per billing interval: the Stripe
+// price of its base item, as revenue metrics use, or for subscriptions
+// recorded before prices were kept, the product's price on its plan.
+type SubscriptionRow struct {
+	ID             uuid.UUID                 `json:"id"`
+	UserID         uuid.UUID                 `json:"user_id"`
+	Email          string                    `json:"email"`
+	OrganizationID *uuid.UUID                `json:"organization_id"`
+	ProductID      uuid.UUID                 `json:"product_id"`
+	ProductName    string                    `json:"product_name"`
+	Plan           string                    `json:"plan"`
+	Price          float64                   `json:"price"`
+	Seats          int64                     `json:"seats"`
+	Status         models.SubscriptionStatus `json:"status"`
+	StartDate      time.Time                 `json:"start_date"`
+	EndDate        time.Time                 `json:"end_date"`
+	TrialEndDate   time.Time                 `json:"trial_end_date"`
+	StripeID       string                    `json:"stripe_id"`
+	CreatedAt      time.Time                 `json:"created_at"`
+}
+
+var subscriptionHeader = []string{
+	"id", "user_id", "email", "organization_id", "product_id", "product_name", "plan", "price", "seats",
+	"status", "start_date", "end_date", "trial_end_date", "stripe_id", "created_at",
+}
+
+func (r SubscriptionRow) record() []string {
+	organizationID := ""
+	if r.OrganizationID != nil {
+		organizationID = r.OrganizationID.String()
+	}
+	return []string{
+		r.ID.String(), r.UserID.String(), r.Email, organizationID, r.ProductID.String(), r.ProductName, r.Plan,
+		strconv.FormatFloat(r.Price, 'f', 2, 64), strconv.FormatInt(r.Seats, 10), string(r.Status),
+		formatTime(r.StartDate), formatTime(r.EndDate), formatTime(r.TrialEndDate), r.StripeID, formatTime(r.CreatedAt),
+	}
+}
+
+// UserRow is an exported user with the number of subscriptions they have
+// that are not canceled. Password hashes are never exported.
+type UserRow struct {
+	ID                uuid.UUID `json:"id"`
+	Email             string    `json:"email"`
+	IsAdmin           bool      `json:"is_admin"`
+	StripeCustomerID  string    `json:"stripe_customer_id"`
+	ReferralCode      *string   `json:"referral_code"`
+	LiveSubscriptions int64     `json:"live_subscriptions"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+var userHeader = []string{"id", "email", "is_admin", "stripe_customer_id", "referral_code", "live_subscriptions", "created_at"}
+
+func (r UserRow) record() []string {
+	referralCode := ""
+	if r.ReferralCode != nil {
+		referralCode = *r.ReferralCode
+	}
+	return []string{
+		r.ID.String(), r.Email, strconv.FormatBool(r.IsAdmin), r.StripeCustomerID, referralCode,
+		strconv.FormatInt(r.LiveSubscriptions, 10), formatTime(r.CreatedAt),
+	}
+}
+
+// formatTime formats a time for CSV, leaving unset times empty.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// csvSafe defuses cells that spreadsheets would run as formulas, such as an
+// email or product name starting with "=", by prefixing them with a quote.
+func csvSafe(record []string) []string {
+	for i, cell := range record {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			record[i] = "'" + cell
+		}
+	}
+	return record
+}
+
+// Write streams a resource to w in format, oldest first, reading one row at a
+// time so that exports of any size use little memory. It returns the number
+// of rows written.
+func Write(db *gorm.DB, resource string, format string, scope Scope, w io.Writer) (int64, error) {
+	if !ValidFormat(format) {
+		return 0, ErrUnknownFormat
+	}
+
+	switch resource {
+	case ResourceSubscriptions:
+		query := db.Table("subscriptions").
+			Select(`subscriptions.id, subscriptions.user_id, COALESCE(custom_users.email, '') AS email,
+				subscriptions.organization_id, subscriptions.product_id, COALESCE(products.name, '') AS product_name,
+				subscriptions.plan,
+				COALESCE(
+					(SELECT subscription_items.unit_amount / 100.0 FROM subscription_items
+						WHERE subscription_items.subscription_id = subscriptions.id AND subscription_items.kind = ? AND subscription_items."interval" <> ''
+						ORDER BY subscription_items.created_at LIMIT 1),
+					CASE subscriptions.plan WHEN 'monthly' THEN products.monthly_price WHEN 'yearly' THEN products.yearly_price END,
+					0
+				) AS price,
+				COALESCE(subscriptions.seats, 0) AS seats, subscriptions.status, subscriptions.start_date,
+				subscriptions.end_date, subscriptions.trial_end_date, COALESCE(subscriptions.stripe_id, '') AS stripe_id,
+				subscriptions.created_at`, models.ProductKindBase).
+			Joins("LEFT JOIN custom_users ON custom_users.id = subscriptions.user_id").
+			Joins("LEFT JOIN products ON products.id = subscriptions.product_id").
+			Scopes(scope).
+			Order("subscriptions.created_at, subscriptions.id")
+		return write[SubscriptionRow](db, query, subscriptionHeader, format, w)
+	case ResourceUsers:
+		query := db.Table("custom_users").
+			Select(`custom_users.id, custom_users.email, custom_users.is_admin,
+				COALESCE(custom_users.stripe_customer_id, '') AS stripe_customer_id, custom_users.referral_code,
+				(SELECT COUNT(*) FROM subscriptions WHERE subscriptions.user_id = custom_users.id AND subscriptions.status <> ?) AS live_subscriptions,
+				custom_users.created_at`, models.SubscriptionStatusCanceled).
+			Scopes(scope).
+			Order("custom_users.created_at, custom_users.id")
+		return write[UserRow](db, query, userHeader, format, w)
+	}
+	return 0, ErrUnknownResource
+}
+
+func write[R row](db *gorm.DB, query *gorm.DB, header []string, format string, w io.Writer) (int64, error) {
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var csvWriter *csv.Writer
+	var encoder *json.Encoder
+	if format == FormatCSV {
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(header); err != nil {
+			return 0, err
+		}
+	} else {
+		encoder = json.NewEncoder(w)
+	}
+
+	var count int64
+	for rows.Next() {
+		var r R
+		if err := db.ScanRows(rows, &r); err != nil {
+			return count, err
+		}
+		if csvWriter != nil {
+			err = csvWriter.Write(csvSafe(r.record()))
+		} else {
+			err = encoder.Encode(r)
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		return count, csvWriter.Error()
+	}
+	return count, nil
+}
@@ -0,0 +1,221 @@
+// File: export/run.go
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+	"gorm.io/gorm"
+)
+
+// chunkSize is the most bytes stored in one export chunk.
+const chunkSize = 1 << 20
+
+// ErrExpired is returned for the file of an export past its retention.
+var ErrExpired = errors.New("export file has expired")
+
+// Task is a queued export to be written to a file.
+type Task struct {
+	ExportID uuid.UUID `json:"export_id"`
+}
+
+func (Task) Kind() string { return "export" }
+
+// Retention returns how long export files are kept once written:
+// EXPORT_RETENTION_DAYS, or 7 days by default. They contain personal data, so
+// they are not kept for good.
+func Retention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("EXPORT_RETENTION_DAYS"))
+	if err != nil || days < 1 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Filename returns the name an export is downloaded as.
+func Filename(export models.Export) string {
+	return fmt.Sprintf("%s-%s.%s", export.Resource, export.CreatedAt.UTC().Format("20060102-150405"), export.Format)
+}
+
+// Runner writes queued exports to files. Filters turns an export's stored
+// filters back into a scope, the same way the admin lists do.
+type Runner struct {
+	db      *gorm.DB
+	filters func(resource string, filters url.Values) (Scope, error)
+}
+
+func NewRunner(db *gorm.DB, filters func(resource string, filters url.Values) (Scope, error)) *Runner {
+	return &Runner{db: db, filters: filters}
+}
+
+// Run writes the export of task to its file in the database. The chunks are
+// written in one transaction with the export's completion, so a download
+// never sees a partial file.
+func (r *Runner) Run(ctx context.Context, task Task) error {
+	db := r.db.WithContext(ctx)
+
+	var export models.Export
+	if err := db.First(&export, "id = ?", task.ExportID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return jobs.Permanent(err)
+		}
+		return err
+	}
+	if export.Status == models.ExportStatusCompleted || export.Status == models.ExportStatusExpired {
+		return nil
+	}
+
+	if err := db.Model(&export).Updates(map[string]interface{}{"status": models.ExportStatusRunning, "error": ""}).Error; err != nil {
+		return err
+	}
+
+	if err := r.write(db, export); err != nil {
+		utils.Log("Error writing export", export.ID, ":", err)
+		if updateErr := db.Model(&export).Updates(map[string]interface{}{"status": models.ExportStatusFailed, "error": err.Error()}).Error; updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Runner) write(db *gorm.DB, export models.Export) error {
+	values, err := url.ParseQuery(export.Filters)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	scope, err := r.filters(export.Resource, values)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Rows are read on db while the chunks are written on tx, which
+		// holds a connection of its own
+		if err := tx.Where("export_id = ?", export.ID).Delete(&models.ExportChunk{}).Error; err != nil {
+			return err
+		}
+		chunks := &chunkWriter{tx: tx, exportID: export.ID}
+		rows, err := Write(db, export.Resource, export.Format, scope, chunks)
+		if err != nil {
+			return err
+		}
+		if err := chunks.Close(); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		expiresAt := now.Add(Retention())
+		return tx.Model(&export).Updates(map[string]interface{}{
+			"status":       models.ExportStatusCompleted,
+			"rows":         rows,
+			"size":         chunks.size,
+			"completed_at": &now,
+			"expires_at":   &expiresAt,
+		}).Error
+	})
+}
+
+// chunkWriter stores what is written to it as export chunks of chunkSize
+// bytes. Close stores the last, partial chunk.
+type chunkWriter struct {
+	tx       *gorm.DB
+	exportID uuid.UUID
+	seq      int
+	size     int64
+	buf      []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := chunkSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *chunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	chunk := models.ExportChunk{ExportID: w.exportID, Seq: w.seq, Data: w.buf}
+	if err := w.tx.Create(&chunk).Error; err != nil {
+		return err
+	}
+	w.seq++
+	w.size += int64(len(w.buf))
+	w.buf = make([]byte, 0, chunkSize)
+	return nil
+}
+
+func (w *chunkWriter) Close() error {
+	return w.flush()
+}
+
+// Copy writes the file of a completed export to w, one chunk at a time. It
+// returns ErrExpired once the file has been deleted.
+func Copy(db *gorm.DB, export models.Export, w io.Writer) error {
+	// Exports written before files were kept in the database have no
+	// expiry, and no chunks
+	if export.Status == models.ExportStatusExpired || export.ExpiresAt == nil || export.ExpiresAt.Before(time.Now()) {
+		return ErrExpired
+	}
+	for seq := 0; int64(seq)*chunkSize < export.Size; seq++ {
+		var chunk models.ExportChunk
+		if err := db.Where("export_id = ? AND seq = ?", export.ID, seq).First(&chunk).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrExpired
+			}
+			return err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune deletes the files of exports past their retention and marks the
+// exports expired. It runs as the prune-exports background job.
+func Prune(db *gorm.DB) error {
+	var expired []uuid.UUID
+	if err := db.Model(&models.Export{}).
+		Where("status = ? AND (expires_at < ? OR expires_at IS NULL)", models.ExportStatusCompleted, time.Now()).
+		Pluck("id", &expired).Error; err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("export_id = ?", id).Delete(&models.ExportChunk{}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&models.Export{}).Where("id = ?", id).Update("status", models.ExportStatusExpired).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
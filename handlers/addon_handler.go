@@ -0,0 +1,254 @@
+// handlers/addon_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/saga"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+	"gorm.io/gorm"
+)
+
+// Add-on changes are prorated against the current billing period.
+const addonProrationBehavior = "create_prorations"
+
+var (
+	errAddonPresent        = errors.New("add-on is already part of the subscription")
+	errAddonPending        = errors.New("add-on is already being added")
+	errAddonRemovalPending = errors.New("add-on is already being removed")
+)
+
+func AddSubscriptionAddon(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		var addonRequest struct {
+			ProductID uuid.UUID `json:"product_id" binding:"required"`
+			Quantity  int64     `json:"quantity" binding:"omitempty,min=1"`
+		}
+
+		if err := c.ShouldBindJSON(&addonRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if addonRequest.Quantity == 0 {
+			addonRequest.Quantity = 1
+		}
+
+		subscription, ok := findOwnedSubscription(c, db)
+		if !ok {
+			return
+		}
+
+		if subscription.StripeID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Add-ons require a paid subscription"})
+			return
+		}
+
+		var addon models.Product
+		if err := db.First(&addon, addonRequest.ProductID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if !addon.IsAddon() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product is not an add-on"})
+			return
+		}
+
+		compatible, err := isAddonCompatible(db, addon.ID, subscription.ProductID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check add-on compatibility"})
+			return
+		}
+		if !compatible {
+			c.JSON(http.StatusConflict, gin.H{"error": "Add-on is not compatible with the subscribed product"})
+			return
+		}
+
+		// Add-ons are billed on the same interval as the subscription
+		stripePriceID, err := getStripePriceID(db, addon, subscription.Plan)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Stripe Price ID"})
+			return
+		}
+
+		// The Stripe item is added by a worker, which removes it again if
+		// the add-on cannot be recorded. The checks run under the account's
+		// lock so that parallel requests cannot both start an operation
+		operation := models.BillingOperation{
+			Kind:           billingOperationAddAddon,
+			UserID:         *contextActorID(c),
+			OrganizationID: subscription.OrganizationID,
+			SubscriptionID: &subscription.ID,
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := lockSubscriptions(tx, subscription.UserID, subscription.OrganizationID); err != nil {
+				return err
+			}
+
+			var existing int64
+			if err := tx.Model(&models.SubscriptionItem{}).Where("subscription_id = ? AND product_id = ?", subscription.ID, addon.ID).Count(&existing).Error; err != nil {
+				return err
+			}
+			if existing > 0 {
+				return errAddonPresent
+			}
+
+			var pending int64
+			if err := tx.Model(&models.BillingOperation{}).
+				Where("subscription_id = ? AND kind = ? AND status IN ?", subscription.ID, billingOperationAddAddon,
+					[]string{models.BillingOperationStatusPending, models.BillingOperationStatusRunning}).
+				Where("input->>'product_id' = ?", addon.ID.String()).
+				Count(&pending).Error; err != nil {
+				return err
+			}
+			if pending > 0 {
+				return errAddonPending
+			}
+
+			return saga.Start(tx, &operation, addAddonInput{
+				ProductID: addon.ID,
+				Quantity:  addonRequest.Quantity,
+				PriceID:   stripePriceID,
+			})
+		})
+		switch {
+		case errors.Is(err, errAddonPresent):
+			c.JSON(http.StatusConflict, gin.H{"error": "Add-on is already part of this subscription"})
+			return
+		case errors.Is(err, errAddonPending):
+			c.JSON(http.StatusConflict, gin.H{"error": "Add-on is already being added to this subscription"})
+			return
+		case err != nil:
+			utils.Log("Error starting add-on billing operation:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add add-on"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":   "Add-on is being added",
+			"operation": operation,
+		})
+	}
+}
+
+func RemoveSubscriptionAddon(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subscription, ok := findOwnedSubscription(c, db)
+		if !ok {
+			return
+		}
+
+		var item models.SubscriptionItem
+		if err := db.Where("id = ? AND subscription_id = ?", c.Param("item_id"), subscription.ID).First(&item).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription item not found"})
+			return
+		}
+		if item.Kind != models.ProductKindAddon {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only add-ons can be removed from a subscription"})
+			return
+		}
+
+		// The Stripe item is removed by a worker, which then deletes the
+		// subscription item, or adds the Stripe item back if it cannot
+		operation := models.BillingOperation{
+			Kind:           billingOperationRemoveAddon,
+			UserID:         *contextActorID(c),
+			OrganizationID: subscription.OrganizationID,
+			SubscriptionID: &subscription.ID,
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := lockSubscriptions(tx, subscription.UserID, subscription.OrganizationID); err != nil {
+				return err
+			}
+
+			var pending int64
+			if err := tx.Model(&models.BillingOperation{}).
+				Where("subscription_id = ? AND kind = ? AND status IN ?", subscription.ID, billingOperationRemoveAddon,
+					[]string{models.BillingOperationStatusPending, models.BillingOperationStatusRunning}).
+				Where("input->>'item_id' = ?", item.ID.String()).
+				Count(&pending).Error; err != nil {
+				return err
+			}
+			if pending > 0 {
+				return errAddonRemovalPending
+			}
+
+			return saga.Start(tx, &operation, removeAddonInput{
+				ItemID:        item.ID,
+				ProductID:     item.ProductID,
+				Quantity:      item.Quantity,
+				StripeItemID:  item.StripeItemID,
+				StripePriceID: item.StripePriceID,
+			})
+		})
+		switch {
+		case errors.Is(err, errAddonRemovalPending):
+			c.JSON(http.StatusConflict, gin.H{"error": "Add-on is already being removed from this subscription"})
+			return
+		case err != nil:
+			utils.Log("Error starting add-on removal billing operation:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove add-on"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":   "Add-on is being removed",
+			"operation": operation,
+		})
+	}
+}
+
+// findOwnedSubscription loads the non-cancelled subscription named by the :id
+// route parameter if it belongs to the account the request acts for and the
+// caller may manage it. It writes the error response itself and reports
+// whether the caller should continue.
+func findOwnedSubscription(c *gin.Context, db *gorm.DB) (*models.Subscription, bool) {
+	if !canManageSubscriptions(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+
+	subscriptionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+		return nil, false
+	}
+
+	var subscription models.Subscription
+	if err := subscriptionScope(c, db).Preload("Items").Where("id = ? AND status != ?", subscriptionID, models.SubscriptionStatusCanceled).First(&subscription).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Active subscription not found"})
+		return nil, false
+	}
+
+	return &subscription, true
+}
+
+// isAddonCompatible reports whether the add-on may be attached to a
+// subscription to the base product.
+func isAddonCompatible(db *gorm.DB, addonID uuid.UUID, baseID uuid.UUID) (bool, error) {
+	var rules []models.AddonCompatibility
+	if err := db.Where("addon_product_id = ?", addonID).Find(&rules).Error; err != nil {
+		return false, err
+	}
+
+	// No rules means the add-on fits every base product
+	if len(rules) == 0 {
+		return true, nil
+	}
+
+	for _, rule := range rules {
+		if rule.BaseProductID == baseID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,644 @@
+// handlers/admin_handler.go
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Page sizes of the admin lists
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// adminUserView is a user as shown to admins. It never includes the password
+// hash.
+type adminUserView struct {
+	ID               uuid.UUID  `json:"id"`
+	Email            string     `json:"email"`
+	IsAdmin          bool       `json:"is_admin"`
+	StripeCustomerID string     `json:"stripe_customer_id,omitempty"`
+	ReferralCode     *string    `json:"referral_code,omitempty"`
+	ReferredByID     *uuid.UUID `json:"referred_by_id,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+func newAdminUserView(user models.CustomUser) adminUserView {
+	return adminUserView{
+		ID:               user.ID,
+		Email:            user.Email,
+		IsAdmin:          user.IsAdmin,
+		StripeCustomerID: user.StripeCustomerID,
+		ReferralCode:     user.ReferralCode,
+		ReferredByID:     user.ReferredByID,
+		CreatedAt:        user.CreatedAt,
+		UpdatedAt:        user.UpdatedAt,
+	}
+}
+
+// adminProductView is the product of a subscription as shown to admins.
+type adminProductView struct {
+	ID           uuid.UUID `json:"id"`
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"`
+	MonthlyPrice float64   `json:"monthly_price"`
+	YearlyPrice  float64   `json:"yearly_price"`
+}
+
+func newAdminProductView(product models.Product) adminProductView {
+	return adminProductView{
+		ID:           product.ID,
+		Name:         product.Name,
+		Kind:         product.Kind,
+		MonthlyPrice: product.MonthlyPrice,
+		YearlyPrice:  product.YearlyPrice,
+	}
+}
+
+// adminSubscriptionView is a subscription as shown to admins, with its owner
+// and product. Items are only included in the detail view.
+type adminSubscriptionView struct {
+	ID                   uuid.UUID                 `json:"id"`
+	User                 *adminUserView            `json:"user,omitempty"`
+	Product              adminProductView          `json:"product"`
+	OrganizationID       *uuid.UUID                `json:"organization_id,omitempty"`
+	Status               models.SubscriptionStatus `json:"status"`
+	Plan                 string                    `json:"plan"`
+	Seats                int64                     `json:"seats,omitempty"`
+	StartDate            time.Time                 `json:"start_date"`
+	EndDate              time.Time                 `json:"end_date"`
+	TrialEndDate         time.Time                 `json:"trial_end_date"`
+	BillingDeferredUntil *time.Time                `json:"billing_deferred_until,omitempty"`
+	StripeID             string                    `json:"stripe_id,omitempty"`
+	StripeScheduleID     string                    `json:"stripe_schedule_id,omitempty"`
+	CreatedAt            time.Time                 `json:"created_at"`
+	UpdatedAt            time.Time                 `json:"updated_at"`
+	Items                []models.SubscriptionItem `json:"items,omitempty"`
+}
+
+func newAdminSubscriptionView(subscription models.Subscription, user *models.CustomUser, product models.Product) adminSubscriptionView {
+	view := adminSubscriptionView{
+		ID:                   subscription.ID,
+		Product:              newAdminProductView(product),
+		OrganizationID:       subscription.OrganizationID,
+		Status:               subscription.Status,
+		Plan:                 subscription.Plan,
+		Seats:                subscription.Seats,
+		StartDate:            subscription.StartDate,
+		EndDate:              subscription.EndDate,
+		TrialEndDate:         subscription.TrialEndDate,
+		BillingDeferredUntil: subscription.BillingDeferredUntil,
+		StripeID:             subscription.StripeID,
+		StripeScheduleID:     subscription.StripeScheduleID,
+		CreatedAt:            subscription.CreatedAt,
+		UpdatedAt:            subscription.UpdatedAt,
+		Items:                subscription.Items,
+	}
+	if user != nil {
+		userView := newAdminUserView(*user)
+		view.User = &userView
+	}
+	return view
+}
+
+// productsByID loads the products with the given IDs.
+func productsByID(db *gorm.DB, ids []uuid.UUID) (map[uuid.UUID]models.Product, error) {
+	products := map[uuid.UUID]models.Product{}
+	if len(ids) == 0 {
+		return products, nil
+	}
+	var found []models.Product
+	if err := db.Where("id IN ?", ids).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	for _, product := range found {
+		products[product.ID] = product
+	}
+	return products, nil
+}
+
+// likePattern returns a case-insensitive pattern matching values that
+// contain s.
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(s))
+	return "%" + s + "%"
+}
+
+// parseAdminTime parses a bound of a created range, as a date (YYYY-MM-DD)
+// or an RFC 3339 time. A date as the upper bound covers the whole day.
+func parseAdminTime(name string, value string, upper bool) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be a date (YYYY-MM-DD) or an RFC 3339 time")
+	}
+	if upper {
+		parsed = parsed.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return parsed, nil
+}
+
+// subscriptionMatch holds the subscription filters shared by the admin user
+// and subscription lists: status, plan and product_id.
+type subscriptionMatch struct {
+	statuses  []string
+	plan      string
+	productID *uuid.UUID
+}
+
+func parseSubscriptionMatch(values url.Values) (subscriptionMatch, error) {
+	var match subscriptionMatch
+	if status := values.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			if !models.SubscriptionStatus(s).IsValid() {
+				return match, errors.New("Invalid status: " + s)
+			}
+			match.statuses = append(match.statuses, s)
+		}
+	}
+	match.plan = values.Get("plan")
+	if productID := values.Get("product_id"); productID != "" {
+		parsed, err := uuid.Parse(productID)
+		if err != nil {
+			return match, errors.New("Invalid product ID")
+		}
+		match.productID = &parsed
+	}
+	return match, nil
+}
+
+func (match subscriptionMatch) empty() bool {
+	return len(match.statuses) == 0 && match.plan == "" && match.productID == nil
+}
+
+// apply restricts a query on the subscriptions table to matching rows.
+func (match subscriptionMatch) apply(query *gorm.DB) *gorm.DB {
+	if len(match.statuses) > 0 {
+		query = query.Where("subscriptions.status IN ?", match.statuses)
+	}
+	if match.plan != "" {
+		query = query.Where("subscriptions.plan = ?", match.plan)
+	}
+	if match.productID != nil {
+		query = query.Where("subscriptions.product_id = ?", *match.productID)
+	}
+	return query
+}
+
+// adminUserFilters returns the scope of the admin user list: q searches
+// emails, created_from and created_to bound the signup time, is_admin limits
+// to admins or not, and status, plan and product_id limit to users with a
+// matching subscription.
+func adminUserFilters(values url.Values) (func(*gorm.DB) *gorm.DB, error) {
+	match, err := parseSubscriptionMatch(values)
+	if err != nil {
+		return nil, err
+	}
+	var createdFrom, createdTo *time.Time
+	if value := values.Get("created_from"); value != "" {
+		parsed, err := parseAdminTime("created_from", value, false)
+		if err != nil {
+			return nil, err
+		}
+		createdFrom = &parsed
+	}
+	if value := values.Get("created_to"); value != "" {
+		parsed, err := parseAdminTime("created_to", value, true)
+		if err != nil {
+			return nil, err
+		}
+		createdTo = &parsed
+	}
+	var isAdmin *bool
+	if value := values.Get("is_admin"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("is_admin must be true or false")
+		}
+		isAdmin = &parsed
+	}
+	search := values.Get("q")
+
+	return func(query *gorm.DB) *gorm.DB {
+		if search != "" {
+			query = query.Where("LOWER(custom_users.email) LIKE ?", likePattern(search))
+		}
+		if createdFrom != nil {
+			query = query.Where("custom_users.created_at >= ?", *createdFrom)
+		}
+		if createdTo != nil {
+			query = query.Where("custom_users.created_at <= ?", *createdTo)
+		}
+		if isAdmin != nil {
+			query = query.Where("custom_users.is_admin = ?", *isAdmin)
+		}
+		if !match.empty() {
+			subscriptions := match.apply(query.Session(&gorm.Session{NewDB: true}).
+				Table("subscriptions").Select("subscriptions.user_id"))
+			query = query.Where("custom_users.id IN (?)", subscriptions)
+		}
+		return query
+	}, nil
+}
+
+// adminSubscriptionFilters returns the scope of the admin subscription list:
+// status (comma separated), plan and product_id match the subscription,
+// created_from and created_to bound its creation, user_id and
+// organization_id its owner, and q searches its user's email.
+func adminSubscriptionFilters(values url.Values) (func(*gorm.DB) *gorm.DB, error) {
+	match, err := parseSubscriptionMatch(values)
+	if err != nil {
+		return nil, err
+	}
+	var createdFrom, createdTo *time.Time
+	if value := values.Get("created_from"); value != "" {
+		parsed, err := parseAdminTime("created_from", value, false)
+		if err != nil {
+			return nil, err
+		}
+		createdFrom = &parsed
+	}
+	if value := values.Get("created_to"); value != "" {
+		parsed, err := parseAdminTime("created_to", value, true)
+		if err != nil {
+			return nil, err
+		}
+		createdTo = &parsed
+	}
+	var userID, organizationID *uuid.UUID
+	if value := values.Get("user_id"); value != "" {
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			return nil, errors.New("Invalid user ID")
+		}
+		userID = &parsed
+	}
+	if value := values.Get("organization_id"); value != "" {
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			return nil, errors.New("Invalid organization ID")
+		}
+		organizationID = &parsed
+	}
+	search := values.Get("q")
+
+	return func(query *gorm.DB) *gorm.DB {
+		query = match.apply(query)
+		if createdFrom != nil {
+			query = query.Where("subscriptions.created_at >= ?", *createdFrom)
+		}
+		if createdTo != nil {
+			query = query.Where("subscriptions.created_at <= ?", *createdTo)
+		}
+		if userID != nil {
+			query = query.Where("subscriptions.user_id = ?", *userID)
+		}
+		if organizationID != nil {
+			query = query.Where("subscriptions.organization_id = ?", *organizationID)
+		}
+		if search != "" {
+			users := query.Session(&gorm.Session{NewDB: true}).Table("custom_users").Select("custom_users.id").
+				Where("LOWER(custom_users.email) LIKE ?", likePattern(search))
+			query = query.Where("subscriptions.user_id IN (?)", users)
+		}
+		return query
+	}, nil
+}
+
+// adminSort orders an admin list by one column, with the ID breaking ties so
+// that cursors are stable.
+type adminSort struct {
+	table      string
+	column     string
+	isTime     bool
+	descending bool
+}
+
+// parseAdminSort reads sort, one of columns (name to whether it holds
+// times), and order (asc or desc). The default is newest first.
+func parseAdminSort(c *gin.Context, table string, columns map[string]bool) (adminSort, error) {
+	s := adminSort{table: table, column: c.DefaultQuery("sort", "created_at")}
+	isTime, ok := columns[s.column]
+	if !ok {
+		names := make([]string, 0, len(columns))
+		for name := range columns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return s, errors.New("sort must be one of " + strings.Join(names, ", "))
+	}
+	s.isTime = isTime
+	switch c.DefaultQuery("order", "desc") {
+	case "desc":
+		s.descending = true
+	case "asc":
+	default:
+		return s, errors.New("order must be asc or desc")
+	}
+	return s, nil
+}
+
+// adminCursor is the position after the last row of a page: its sort value
+// and ID. It is passed around base64 encoded.
+type adminCursor struct {
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+// cursor encodes the position of a row with the given sort value, a
+// time.Time or a string.
+func (s adminSort) cursor(value interface{}, id uuid.UUID) string {
+	cursor := adminCursor{ID: id}
+	switch v := value.(type) {
+	case time.Time:
+		cursor.Value = v.UTC().Format(time.RFC3339Nano)
+	case string:
+		cursor.Value = v
+	}
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// page orders query and limits it to the rows after cursor, if set. One more
+// row than the page size is fetched to tell whether there is a next page.
+func (s adminSort) page(query *gorm.DB, cursor string, size int) (*gorm.DB, error) {
+	column := s.table + "." + s.column
+	id := s.table + ".id"
+	direction, comparison := "ASC", ">"
+	if s.descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		var position adminCursor
+		if err := json.Unmarshal(decoded, &position); err != nil {
+			return nil, errInvalidCursor
+		}
+		var value interface{} = position.Value
+		if s.isTime {
+			parsed, err := time.Parse(time.RFC3339Nano, position.Value)
+			if err != nil {
+				return nil, errInvalidCursor
+			}
+			value = parsed
+		}
+		query = query.Where("("+column+", "+id+") "+comparison+" (?, ?)", value, position.ID)
+	}
+
+	return query.Order(column + " " + direction).Order(id + " " + direction).Limit(size + 1), nil
+}
+
+// adminPageSize reads limit, the size of a page.
+func adminPageSize(c *gin.Context) (int, error) {
+	value := c.Query("limit")
+	if value == "" {
+		return defaultAdminPageSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 || size > maxAdminPageSize {
+		return 0, errors.New("limit must be between 1 and 200")
+	}
+	return size, nil
+}
+
+var adminUserSorts = map[string]bool{"created_at": true, "email": false}
+
+// GetAdminUsers lists users, newest first by default, with filters, sorting
+// by created_at or email and cursor pagination. Pass next_cursor from a
+// response as cursor to get the next page. Admin only.
+func GetAdminUsers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		filters, err := adminUserFilters(c.Request.URL.Query())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ordering, err := parseAdminSort(c, "custom_users", adminUserSorts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		size, err := adminPageSize(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query, err := ordering.page(db.Model(&models.CustomUser{}).Scopes(filters), c.Query("cursor"), size)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var users []models.CustomUser
+		if err := query.Find(&users).Error; err != nil {
+			utils.Log("Error listing users:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
+
+		var nextCursor string
+		if len(users) > size {
+			users = users[:size]
+			last := users[size-1]
+			if ordering.column == "email" {
+				nextCursor = ordering.cursor(last.Email, last.ID)
+			} else {
+				nextCursor = ordering.cursor(last.CreatedAt, last.ID)
+			}
+		}
+
+		views := make([]adminUserView, 0, len(users))
+		for _, user := range users {
+			views = append(views, newAdminUserView(user))
+		}
+		c.JSON(http.StatusOK, gin.H{"users": views, "next_cursor": nextCursor})
+	}
+}
+
+// GetAdminUser returns a user with all their subscriptions and products.
+// Admin only.
+func GetAdminUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		var user models.CustomUser
+		err = db.Preload("Subscriptions", func(tx *gorm.DB) *gorm.DB { return tx.Order("created_at DESC") }).
+			Preload("Subscriptions.Items").First(&user, "id = ?", id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
+
+		productIDs := make([]uuid.UUID, 0, len(user.Subscriptions))
+		for _, subscription := range user.Subscriptions {
+			productIDs = append(productIDs, subscription.ProductID)
+		}
+		products, err := productsByID(db, productIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+			return
+		}
+
+		subscriptions := make([]adminSubscriptionView, 0, len(user.Subscriptions))
+		for _, subscription := range user.Subscriptions {
+			subscriptions = append(subscriptions, newAdminSubscriptionView(subscription, nil, products[subscription.ProductID]))
+		}
+		c.JSON(http.StatusOK, gin.H{"user": newAdminUserView(user), "subscriptions": subscriptions})
+	}
+}
+
+var adminSubscriptionSorts = map[string]bool{"created_at": true, "start_date": true, "end_date": true}
+
+// GetAdminSubscriptions lists subscriptions with their users and products,
+// newest first by default, with filters, sorting by created_at, start_date or
+// end_date and cursor pagination. Admin only.
+func GetAdminSubscriptions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		filters, err := adminSubscriptionFilters(c.Request.URL.Query())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ordering, err := parseAdminSort(c, "subscriptions", adminSubscriptionSorts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		size, err := adminPageSize(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query, err := ordering.page(db.Model(&models.Subscription{}).Scopes(filters), c.Query("cursor"), size)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var subscriptions []models.Subscription
+		if err := query.Preload("User").Find(&subscriptions).Error; err != nil {
+			utils.Log("Error listing subscriptions:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscriptions"})
+			return
+		}
+
+		var nextCursor string
+		if len(subscriptions) > size {
+			subscriptions = subscriptions[:size]
+			last := subscriptions[size-1]
+			switch ordering.column {
+			case "start_date":
+				nextCursor = ordering.cursor(last.StartDate, last.ID)
+			case "end_date":
+				nextCursor = ordering.cursor(last.EndDate, last.ID)
+			default:
+				nextCursor = ordering.cursor(last.CreatedAt, last.ID)
+			}
+		}
+
+		productIDs := make([]uuid.UUID, 0, len(subscriptions))
+		for _, subscription := range subscriptions {
+			productIDs = append(productIDs, subscription.ProductID)
+		}
+		products, err := productsByID(db, productIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+			return
+		}
+
+		views := make([]adminSubscriptionView, 0, len(subscriptions))
+		for _, subscription := range subscriptions {
+			user := subscription.User
+			views = append(views, newAdminSubscriptionView(subscription, &user, products[subscription.ProductID]))
+		}
+		c.JSON(http.StatusOK, gin.H{"subscriptions": views, "next_cursor": nextCursor})
+	}
+}
+
+// GetAdminSubscription returns a subscription with its user, product and
+// items. Admin only.
+func GetAdminSubscription(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+			return
+		}
+
+		var subscription models.Subscription
+		err = db.Preload("User").Preload("Items").First(&subscription, "id = ?", id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription"})
+			return
+		}
+
+		var product models.Product
+		if err := db.First(&product, "id = ?", subscription.ProductID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch product"})
+			return
+		}
+
+		user := subscription.User
+		c.JSON(http.StatusOK, newAdminSubscriptionView(subscription, &user, product))
+	}
+}
@@ -2,12 +2,16 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/notify"
 	"github.com/yeboahd24/subscription-stripe/utils"
+	"github.com/yeboahd24/subscription-stripe/webhooks"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
@@ -29,12 +33,21 @@ func NewAuthHandler(db *gorm.DB, jwtSecret string) *AuthHandler {
 
 func Register(h *AuthHandler) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var user models.CustomUser
-		if err := c.ShouldBindJSON(&user); err != nil {
+		var registerRequest struct {
+			Email        string `json:"email"`
+			Password     string `json:"password"`
+			ReferralCode string `json:"referral_code"` // Optional code of the user who referred them
+		}
+		if err := c.ShouldBindJSON(&registerRequest); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
+		user := models.CustomUser{
+			Email:    registerRequest.Email,
+			Password: registerRequest.Password,
+		}
+
 		if user.Email == "" || user.Password == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Email and password are required"})
 			return
@@ -62,11 +75,43 @@ func Register(h *AuthHandler) gin.HandlerFunc {
 		}
 		user.Password = string(hashedPassword) // Ensure this is the correct password hash
 
-		if err := h.DB.Create(&user).Error; err != nil {
+		referralCode, err := utils.GenerateCode("REF", 2)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate referral code"})
+			return
+		}
+		user.ReferralCode = &referralCode
+
+		err = h.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if registerRequest.ReferralCode != "" {
+				return recordReferral(tx, &user, strings.ToUpper(strings.TrimSpace(registerRequest.ReferralCode)))
+			}
+			return nil
+		})
+		if errors.Is(err, errInvalidReferralCode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid referral code"})
+			return
+		}
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 			return
 		}
 
+		if err := notify.Enqueue(h.DB, user.Email, notify.TemplateWelcome, map[string]interface{}{"Email": user.Email}, ""); err != nil {
+			utils.Log("Error queueing welcome email:", err)
+		}
+		if err := webhooks.Emit(h.DB, webhooks.EventUserCreated, gin.H{
+			"user_id":        user.ID,
+			"email":          user.Email,
+			"referred_by_id": user.ReferredByID,
+			"created_at":     user.CreatedAt,
+		}); err != nil {
+			utils.Log("Error emitting user webhook:", err)
+		}
+
 		c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
 	}
 }
@@ -0,0 +1,851 @@
+// handlers/billing_operation_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/saga"
+	"github.com/yeboahd24/subscription-stripe/stripeclient"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/customer"
+	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/subitem"
+	"github.com/stripe/stripe-go/v72/subschedule"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Billing operation kinds
+const (
+	billingOperationSubscribe    = "subscribe"
+	billingOperationAddAddon     = "add_addon"
+	billingOperationCancel       = "cancel"
+	billingOperationRemoveAddon  = "remove_addon"
+	billingOperationExtendTrial  = "extend_trial"
+	billingOperationShiftEndDate = "shift_end_date"
+)
+
+// operationMetadataKey tags Stripe objects with the operation that created
+// them, so that compensations find them even if the step creating them was
+// interrupted before saving their ID.
+const operationMetadataKey = "billing_operation_id"
+
+// BillingSagas are the sagas run by the job queue.
+func BillingSagas(db *gorm.DB) []saga.Saga {
+	return []saga.Saga{
+		subscribeSaga(db), addAddonSaga(db), cancelSaga(db), removeAddonSaga(db),
+		billingOverrideSaga(db, billingOperationExtendTrial), billingOverrideSaga(db, billingOperationShiftEndDate),
+	}
+}
+
+// stripeStepError aborts the operation for Stripe errors that retrying cannot
+// fix, such as a declined card or an invalid request, and leaves the others,
+// such as rate limits and outages, to be retried.
+func stripeStepError(err error) error {
+	if !stripeclient.IsTemporary(err) {
+		return saga.Abort(err)
+	}
+	return err
+}
+
+// isStripeResourceMissing reports whether the Stripe object no longer exists.
+func isStripeResourceMissing(err error) bool {
+	var stripeErr *stripe.Error
+	return errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
+
+// subscribeInput is the input of a subscribe operation.
+type subscribeInput struct {
+	ProductID uuid.UUID       `json:"product_id"`
+	Plan      string          `json:"plan"`
+	PriceID   string          `json:"price_id"`
+	StartAt   *time.Time      `json:"start_at,omitempty"`
+	Phases    []SchedulePhase `json:"phases,omitempty"`
+	Seats     int64           `json:"seats,omitempty"`
+}
+
+func (input subscribeInput) scheduled() bool {
+	return input.StartAt != nil || len(input.Phases) > 0
+}
+
+// subscribeSaga creates the Stripe customer if needed, then the Stripe
+// subscription or subscription schedule, and finally fills in the
+// subscription Subscribe reserved. If it fails, the Stripe objects it created
+// are cancelled or deleted and the reserved subscription is cancelled.
+func subscribeSaga(db *gorm.DB) saga.Saga {
+	return saga.Saga{
+		Kind: billingOperationSubscribe,
+		Steps: []saga.Step{
+			{Name: "customer", Run: ensureOperationCustomer(db), Compensate: deleteOperationCustomer(db)},
+			{Name: "subscription", Run: createOperationSubscription(db), Compensate: cancelOperationSubscription},
+			{Name: "record", Run: recordOperationSubscription(db)},
+		},
+		Compensated: cancelReservedSubscription(db),
+	}
+}
+
+// operationCustomerID returns the Stripe customer currently stored for the
+// account the operation bills.
+func operationCustomerID(db *gorm.DB, op *saga.Operation) (string, error) {
+	var customerID string
+	var err error
+	if op.OrganizationID != nil {
+		err = db.Model(&models.Organization{}).Where("id = ?", *op.OrganizationID).Select("stripe_customer_id").Scan(&customerID).Error
+	} else {
+		err = db.Model(&models.CustomUser{}).Where("id = ?", op.UserID).Select("stripe_customer_id").Scan(&customerID).Error
+	}
+	return customerID, err
+}
+
+func ensureOperationCustomer(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		if op.Get("stripe_customer_id") != "" {
+			return nil
+		}
+
+		existing, err := operationCustomerID(db, op)
+		if err != nil {
+			return err
+		}
+		if existing == "" {
+			// Remember that this operation creates the customer before
+			// calling Stripe, so that it is deleted on failure even if this
+			// step is interrupted
+			op.Set("customer_created", "true")
+			if err := op.Save(); err != nil {
+				return err
+			}
+		}
+
+		var user models.CustomUser
+		if err := db.First(&user, op.UserID).Error; err != nil {
+			return err
+		}
+
+		var customerID string
+		if op.OrganizationID != nil {
+			customerID, err = ensureOrganizationStripeCustomer(ctx, db, *op.OrganizationID, user.Email, op.IdempotencyKey())
+		} else {
+			customerID, err = ensureStripeCustomer(ctx, db, &user, op.IdempotencyKey())
+		}
+		if err != nil {
+			return stripeStepError(err)
+		}
+
+		op.Set("stripe_customer_id", customerID)
+		return nil
+	}
+}
+
+func deleteOperationCustomer(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		if op.Get("customer_created") != "true" {
+			return nil
+		}
+
+		customerID := op.Get("stripe_customer_id")
+		if customerID == "" {
+			var err error
+			if customerID, err = operationCustomerID(db, op); err != nil {
+				return err
+			}
+		}
+		if customerID == "" {
+			return nil
+		}
+
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+		if _, err := customer.Del(customerID, &stripe.CustomerParams{Params: stripe.Params{Context: ctx}}); err != nil && !isStripeResourceMissing(err) {
+			return err
+		}
+
+		if op.OrganizationID != nil {
+			if err := db.Model(&models.Organization{}).Where("id = ? AND stripe_customer_id = ?", *op.OrganizationID, customerID).Update("stripe_customer_id", "").Error; err != nil {
+				return err
+			}
+		} else if err := db.Model(&models.CustomUser{}).Where("id = ? AND stripe_customer_id = ?", op.UserID, customerID).Update("stripe_customer_id", "").Error; err != nil {
+			return err
+		}
+
+		op.Set("customer_created", "deleted")
+		return nil
+	}
+}
+
+func createOperationSubscription(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		if op.Get("stripe_subscription_id") != "" || op.Get("stripe_schedule_id") != "" {
+			return nil
+		}
+
+		var input subscribeInput
+		if err := op.DecodeInput(&input); err != nil {
+			return saga.Abort(err)
+		}
+
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+		customerID := op.Get("stripe_customer_id")
+
+		// Future-dated and multi-phase subscriptions are created through a
+		// Stripe subscription schedule instead
+		if input.scheduled() {
+			var product models.Product
+			if err := db.First(&product, input.ProductID).Error; err != nil {
+				return err
+			}
+			params, _, err := subscriptionScheduleParams(db, product, customerID, input.Plan, input.Seats, input.StartAt, input.Phases)
+			if err != nil {
+				return saga.Abort(err)
+			}
+			params.Context = ctx
+			params.AddMetadata(operationMetadataKey, op.ID.String())
+			params.SetIdempotencyKey(op.IdempotencyKey())
+
+			schedule, err := subschedule.New(params)
+			if err != nil {
+				return stripeStepError(err)
+			}
+			op.Set("stripe_schedule_id", schedule.ID)
+			return nil
+		}
+
+		params := &stripe.SubscriptionParams{
+			Params:   stripe.Params{Context: ctx},
+			Customer: stripe.String(customerID),
+			Items: []*stripe.SubscriptionItemsParams{
+				{
+					Price: stripe.String(input.PriceID),
+				},
+			},
+			TrialPeriodDays: stripe.Int64(30),
+		}
+		if input.Seats > 0 {
+			params.Items[0].Quantity = stripe.Int64(input.Seats)
+		}
+		params.AddMetadata(operationMetadataKey, op.ID.String())
+		params.SetIdempotencyKey(op.IdempotencyKey())
+
+		stripeSub, err := sub.New(params)
+		if err != nil {
+			return stripeStepError(err)
+		}
+		op.Set("stripe_subscription_id", stripeSub.ID)
+		return nil
+	}
+}
+
+// cancelOperationSubscription cancels the Stripe subscription or schedule the
+// operation created. Cancelling a schedule also cancels the subscription it
+// started.
+func cancelOperationSubscription(ctx context.Context, op *saga.Operation) error {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	scheduleID := op.Get("stripe_schedule_id")
+	subscriptionID := op.Get("stripe_subscription_id")
+	if scheduleID == "" && subscriptionID == "" {
+		scheduleID, subscriptionID = findOperationSubscription(ctx, op)
+	}
+
+	if scheduleID != "" {
+		schedule, err := subschedule.Get(scheduleID, &stripe.SubscriptionScheduleParams{Params: stripe.Params{Context: ctx}})
+		if err != nil {
+			if isStripeResourceMissing(err) {
+				return nil
+			}
+			return err
+		}
+		if schedule.Status == stripe.SubscriptionScheduleStatusCanceled || schedule.Status == stripe.SubscriptionScheduleStatusReleased {
+			return nil
+		}
+		if _, err := subschedule.Cancel(scheduleID, &stripe.SubscriptionScheduleCancelParams{Params: stripe.Params{Context: ctx}}); err != nil && !isStripeResourceMissing(err) {
+			return err
+		}
+		return nil
+	}
+
+	if subscriptionID != "" {
+		stripeSub, err := sub.Get(subscriptionID, &stripe.SubscriptionParams{Params: stripe.Params{Context: ctx}})
+		if err != nil {
+			if isStripeResourceMissing(err) {
+				return nil
+			}
+			return err
+		}
+		if stripeSub.Status == stripe.SubscriptionStatusCanceled || stripeSub.Status == stripe.SubscriptionStatusIncompleteExpired {
+			return nil
+		}
+		if _, err := sub.Cancel(subscriptionID, &stripe.SubscriptionCancelParams{Params: stripe.Params{Context: ctx}}); err != nil && !isStripeResourceMissing(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findOperationSubscription looks up the Stripe schedule or subscription
+// tagged with the operation, for when the step that created it did not get
+// to save its ID.
+func findOperationSubscription(ctx context.Context, op *saga.Operation) (scheduleID string, subscriptionID string) {
+	customerID := op.Get("stripe_customer_id")
+	if customerID == "" {
+		return "", ""
+	}
+
+	scheduleParams := &stripe.SubscriptionScheduleListParams{Customer: customerID}
+	scheduleParams.Context = ctx
+	schedules := subschedule.List(scheduleParams)
+	for schedules.Next() {
+		if schedules.SubscriptionSchedule().Metadata[operationMetadataKey] == op.ID.String() {
+			return schedules.SubscriptionSchedule().ID, ""
+		}
+	}
+
+	subscriptionParams := &stripe.SubscriptionListParams{Customer: customerID, Status: "all"}
+	subscriptionParams.Context = ctx
+	subscriptions := sub.List(subscriptionParams)
+	for subscriptions.Next() {
+		if subscriptions.Subscription().Metadata[operationMetadataKey] == op.ID.String() {
+			return "", subscriptions.Subscription().ID
+		}
+	}
+
+	return "", ""
+}
+
+// recordOperationSubscription fills in the reserved subscription from Stripe
+// and records its creation. Stripe is read before the transaction starts, so
+// no row lock is held while waiting on it.
+func recordOperationSubscription(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		var input subscribeInput
+		if err := op.DecodeInput(&input); err != nil {
+			return saga.Abort(err)
+		}
+
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		var schedule *stripe.SubscriptionSchedule
+		var stripeSub *stripe.Subscription
+		var err error
+		if scheduleID := op.Get("stripe_schedule_id"); scheduleID != "" {
+			schedule, err = subschedule.Get(scheduleID, &stripe.SubscriptionScheduleParams{Params: stripe.Params{Context: ctx}})
+		} else {
+			stripeSub, err = sub.Get(op.Get("stripe_subscription_id"), &stripe.SubscriptionParams{Params: stripe.Params{Context: ctx}})
+		}
+		if err != nil {
+			return stripeStepError(err)
+		}
+
+		return db.Transaction(func(tx *gorm.DB) error {
+			var subscription models.Subscription
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+			if subscription.StripeID != "" || subscription.StripeScheduleID != "" {
+				return nil // Recorded by an earlier run
+			}
+
+			var product models.Product
+			if err := tx.First(&product, input.ProductID).Error; err != nil {
+				return err
+			}
+
+			next := subscription.Status
+			if schedule != nil {
+				subscription.StripeScheduleID = schedule.ID
+				next = models.SubscriptionStatusScheduled
+				// A schedule starting now creates its Stripe subscription
+				// straight away
+				if schedule.Subscription != nil {
+					subscription.StripeID = schedule.Subscription.ID
+					next = models.SubscriptionStatusActive
+				}
+			} else {
+				subscription.StripeID = stripeSub.ID
+				next = models.SubscriptionStatusFromStripe(string(stripeSub.Status))
+				if stripeSub.TrialEnd > 0 {
+					subscription.TrialEndDate = time.Unix(stripeSub.TrialEnd, 0)
+				}
+
+				// Record the base plan as the first subscription item, at the
+				// price Stripe bills it
+				prices := billedPricesFromStripe(stripeSub)
+				subscription.DiscountPercentOff = prices.PercentOff
+				subscription.DiscountAmountOff = prices.AmountOff
+				if len(prices.Items) > 0 {
+					subscription.Items = []models.SubscriptionItem{{
+						SubscriptionID: subscription.ID,
+						ProductID:      product.ID,
+						Kind:           models.ProductKindBase,
+						Quantity:       prices.Items[0].Quantity,
+						StripeItemID:   prices.Items[0].StripeItemID,
+						StripePriceID:  input.PriceID,
+						UnitAmount:     prices.Items[0].UnitAmount,
+						Interval:       prices.Items[0].Interval,
+						IntervalCount:  prices.Items[0].IntervalCount,
+					}}
+				}
+			}
+
+			if next != subscription.Status {
+				if err := subscription.TransitionTo(next); err != nil {
+					return saga.Abort(err)
+				}
+			}
+			if err := tx.Omit(clause.Associations).Save(&subscription).Error; err != nil {
+				return err
+			}
+			if len(subscription.Items) > 0 {
+				if err := tx.Create(&subscription.Items).Error; err != nil {
+					return err
+				}
+			}
+
+			return recordSubscriptionEvent(tx, models.SubscriptionEventCreated, nil, subscription, &op.UserID, models.EventSourceAPI)
+		})
+	}
+}
+
+// billedPricesFromStripe returns what Stripe bills for a subscription. Coupons
+// that only apply to one invoice are not recurring discounts and are left out.
+func billedPricesFromStripe(stripeSub *stripe.Subscription) billedPrices {
+	var prices billedPrices
+	if stripeSub.Items != nil {
+		for _, stripeItem := range stripeSub.Items.Data {
+			prices.Items = append(prices.Items, billedItemFromStripe(stripeItem))
+		}
+	}
+	if stripeSub.Discount != nil && stripeSub.Discount.Coupon != nil && stripeSub.Discount.Coupon.Duration != stripe.CouponDurationOnce {
+		prices.PercentOff = stripeSub.Discount.Coupon.PercentOff
+		prices.AmountOff = stripeSub.Discount.Coupon.AmountOff
+	}
+	return prices
+}
+
+// billedItemFromStripe returns what Stripe bills for a subscription item.
+func billedItemFromStripe(stripeItem *stripe.SubscriptionItem) billedItem {
+	billed := billedItem{StripeItemID: stripeItem.ID, Quantity: stripeItem.Quantity}
+	if stripeItem.Price != nil {
+		billed.StripePriceID = stripeItem.Price.ID
+		billed.UnitAmount = stripeItem.Price.UnitAmount
+		if stripeItem.Price.Recurring != nil {
+			billed.Interval = string(stripeItem.Price.Recurring.Interval)
+			billed.IntervalCount = stripeItem.Price.Recurring.IntervalCount
+		}
+	}
+	return billed
+}
+
+// cancelReservedSubscription cancels the subscription reserved by Subscribe
+// once the operation is undone. It never existed in Stripe, so no event is
+// recorded.
+func cancelReservedSubscription(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		var subscription models.Subscription
+		if err := db.First(&subscription, op.SubscriptionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		if subscription.Status == models.SubscriptionStatusCanceled {
+			return nil
+		}
+
+		if err := subscription.TransitionTo(models.SubscriptionStatusCanceled); err != nil {
+			return err
+		}
+		subscription.EndDate = time.Now()
+		return db.Omit(clause.Associations).Save(&subscription).Error
+	}
+}
+
+// addAddonInput is the input of an add-on operation.
+type addAddonInput struct {
+	ProductID uuid.UUID `json:"product_id"`
+	Quantity  int64     `json:"quantity"`
+	PriceID   string    `json:"price_id"`
+}
+
+// addAddonSaga adds the add-on to the Stripe subscription and then records
+// the subscription item. If recording fails, the Stripe item is removed
+// again.
+func addAddonSaga(db *gorm.DB) saga.Saga {
+	return saga.Saga{
+		Kind: billingOperationAddAddon,
+		Steps: []saga.Step{
+			{Name: "item", Run: createOperationItem(db), Compensate: deleteOperationItem(db)},
+			{Name: "record", Run: recordOperationItem(db)},
+		},
+	}
+}
+
+func createOperationItem(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		if op.Get("stripe_item_id") != "" {
+			return nil
+		}
+
+		var input addAddonInput
+		if err := op.DecodeInput(&input); err != nil {
+			return saga.Abort(err)
+		}
+
+		var subscription models.Subscription
+		if err := db.First(&subscription, op.SubscriptionID).Error; err != nil {
+			return err
+		}
+		if subscription.Status == models.SubscriptionStatusCanceled {
+			return saga.Abort(errors.New("subscription was cancelled"))
+		}
+
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		params := &stripe.SubscriptionItemParams{
+			Params:            stripe.Params{Context: ctx},
+			Subscription:      stripe.String(subscription.StripeID),
+			Price:             stripe.String(input.PriceID),
+			Quantity:          stripe.Int64(input.Quantity),
+			ProrationBehavior: stripe.String(addonProrationBehavior),
+		}
+		params.AddMetadata(operationMetadataKey, op.ID.String())
+		params.SetIdempotencyKey(op.IdempotencyKey())
+
+		stripeItem, err := subitem.New(params)
+		if err != nil {
+			return stripeStepError(err)
+		}
+		billed := billedItemFromStripe(stripeItem)
+		op.Set("stripe_item_id", stripeItem.ID)
+		op.Set("unit_amount", strconv.FormatInt(billed.UnitAmount, 10))
+		op.Set("interval", billed.Interval)
+		op.Set("interval_count", strconv.FormatInt(billed.IntervalCount, 10))
+		return nil
+	}
+}
+
+func deleteOperationItem(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		itemID := op.Get("stripe_item_id")
+		if itemID == "" {
+			var subscription models.Subscription
+			if err := db.First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+			itemParams := &stripe.SubscriptionItemListParams{Subscription: stripe.String(subscription.StripeID)}
+			itemParams.Context = ctx
+			items := subitem.List(itemParams)
+			for items.Next() {
+				if items.SubscriptionItem().Metadata[operationMetadataKey] == op.ID.String() {
+					itemID = items.SubscriptionItem().ID
+				}
+			}
+			if err := items.Err(); err != nil && !isStripeResourceMissing(err) {
+				return err
+			}
+		}
+		if itemID == "" {
+			return nil
+		}
+
+		_, err := subitem.Del(itemID, &stripe.SubscriptionItemParams{
+			Params:            stripe.Params{Context: ctx},
+			ProrationBehavior: stripe.String(addonProrationBehavior),
+		})
+		if err != nil && !isStripeResourceMissing(err) {
+			return err
+		}
+		return nil
+	}
+}
+
+func recordOperationItem(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		var input addAddonInput
+		if err := op.DecodeInput(&input); err != nil {
+			return saga.Abort(err)
+		}
+
+		return db.Transaction(func(tx *gorm.DB) error {
+			var subscription models.Subscription
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+			for _, existing := range subscription.Items {
+				if existing.StripeItemID == op.Get("stripe_item_id") {
+					return nil // Recorded by an earlier run
+				}
+			}
+
+			item := models.SubscriptionItem{
+				SubscriptionID: subscription.ID,
+				ProductID:      input.ProductID,
+				Kind:           models.ProductKindAddon,
+				Quantity:       input.Quantity,
+				StripeItemID:   op.Get("stripe_item_id"),
+				StripePriceID:  input.PriceID,
+				Interval:       op.Get("interval"),
+			}
+			item.UnitAmount, _ = strconv.ParseInt(op.Get("unit_amount"), 10, 64)
+			item.IntervalCount, _ = strconv.ParseInt(op.Get("interval_count"), 10, 64)
+
+			before := subscription.Snapshot()
+			if err := tx.Create(&item).Error; err != nil {
+				return err
+			}
+
+			subscription.Items = append(subscription.Items, item)
+			return recordSubscriptionEvent(tx, models.SubscriptionEventAddonAdded, &before, subscription, &op.UserID, models.EventSourceAPI)
+		})
+	}
+}
+
+// cancelInput is the input of a cancel operation: the Stripe schedule of a
+// subscription that has not started yet, or else its Stripe subscription.
+type cancelInput struct {
+	StripeScheduleID string `json:"stripe_schedule_id,omitempty"`
+	StripeID         string `json:"stripe_id,omitempty"`
+}
+
+// cancelSaga cancels the Stripe subscription or schedule and then the local
+// subscription. A Stripe cancellation cannot be undone, so it is the only
+// step that may fail for good; recording it is retried, and the nightly
+// reconciliation with Stripe catches up if it never succeeds.
+func cancelSaga(db *gorm.DB) saga.Saga {
+	return saga.Saga{
+		Kind: billingOperationCancel,
+		Steps: []saga.Step{
+			{Name: "subscription", Run: cancelOperationBilling},
+			{Name: "record", Run: recordOperationCancellation(db)},
+		},
+	}
+}
+
+func cancelOperationBilling(ctx context.Context, op *saga.Operation) error {
+	var input cancelInput
+	if err := op.DecodeInput(&input); err != nil {
+		return saga.Abort(err)
+	}
+
+	// Reuse the subscribe compensation, which cancels whichever of the two
+	// is set and does nothing if it is already cancelled
+	op.Set("stripe_schedule_id", input.StripeScheduleID)
+	op.Set("stripe_subscription_id", input.StripeID)
+	if err := cancelOperationSubscription(ctx, op); err != nil {
+		return stripeStepError(err)
+	}
+	return nil
+}
+
+func recordOperationCancellation(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var subscription models.Subscription
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+			if subscription.Status == models.SubscriptionStatusCanceled {
+				return nil // Recorded by an earlier run or Stripe's webhook
+			}
+
+			before := subscription.Snapshot()
+			subscription.EndDate = time.Now()
+			return transitionSubscription(tx, &subscription, before, models.SubscriptionStatusCanceled, &op.UserID, models.EventSourceAPI)
+		})
+	}
+}
+
+// removeAddonInput is the input of an add-on removal operation.
+type removeAddonInput struct {
+	ItemID        uuid.UUID `json:"item_id"`
+	ProductID     uuid.UUID `json:"product_id"`
+	Quantity      int64     `json:"quantity"`
+	StripeItemID  string    `json:"stripe_item_id"`
+	StripePriceID string    `json:"stripe_price_id"`
+}
+
+// removeAddonSaga removes the add-on from the Stripe subscription and then
+// deletes the subscription item. If deleting it fails for good, the add-on
+// is added back to the Stripe subscription so that billing matches the
+// subscription items again.
+func removeAddonSaga(db *gorm.DB) saga.Saga {
+	return saga.Saga{
+		Kind: billingOperationRemoveAddon,
+		Steps: []saga.Step{
+			{Name: "item", Run: deleteOperationStripeItem, Compensate: restoreOperationItem(db)},
+			{Name: "record", Run: recordOperationItemRemoval(db)},
+		},
+	}
+}
+
+func deleteOperationStripeItem(ctx context.Context, op *saga.Operation) error {
+	var input removeAddonInput
+	if err := op.DecodeInput(&input); err != nil {
+		return saga.Abort(err)
+	}
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	params := &stripe.SubscriptionItemParams{
+		Params:            stripe.Params{Context: ctx},
+		ProrationBehavior: stripe.String(addonProrationBehavior),
+	}
+	params.SetIdempotencyKey(op.IdempotencyKey())
+	if _, err := subitem.Del(input.StripeItemID, params); err != nil && !isStripeResourceMissing(err) {
+		return stripeStepError(err)
+	}
+	return nil
+}
+
+// restoreOperationItem adds the removed add-on back to the Stripe
+// subscription while the subscription item still exists locally, and points
+// the item at the new Stripe item.
+func restoreOperationItem(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		var input removeAddonInput
+		if err := op.DecodeInput(&input); err != nil {
+			return err
+		}
+
+		var item models.SubscriptionItem
+		if err := db.First(&item, input.ItemID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		var subscription models.Subscription
+		if err := db.First(&subscription, op.SubscriptionID).Error; err != nil {
+			return err
+		}
+		if subscription.Status == models.SubscriptionStatusCanceled {
+			return nil
+		}
+
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		// Nothing to restore if the step failed before removing the item
+		_, err := subitem.Get(item.StripeItemID, &stripe.SubscriptionItemParams{Params: stripe.Params{Context: ctx}})
+		if err == nil {
+			return nil
+		}
+		if !isStripeResourceMissing(err) {
+			return err
+		}
+
+		params := &stripe.SubscriptionItemParams{
+			Params:            stripe.Params{Context: ctx},
+			Subscription:      stripe.String(subscription.StripeID),
+			Price:             stripe.String(input.StripePriceID),
+			Quantity:          stripe.Int64(input.Quantity),
+			ProrationBehavior: stripe.String(addonProrationBehavior),
+		}
+		params.AddMetadata(operationMetadataKey, op.ID.String())
+		params.SetIdempotencyKey(op.IdempotencyKey() + ":restore")
+		stripeItem, err := subitem.New(params)
+		if err != nil {
+			return err
+		}
+
+		return db.Model(&item).Update("stripe_item_id", stripeItem.ID).Error
+	}
+}
+
+func recordOperationItemRemoval(db *gorm.DB) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		var input removeAddonInput
+		if err := op.DecodeInput(&input); err != nil {
+			return saga.Abort(err)
+		}
+
+		return db.Transaction(func(tx *gorm.DB) error {
+			var subscription models.Subscription
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+
+			before := subscription.Snapshot()
+			var remaining []models.SubscriptionItem
+			for _, existing := range subscription.Items {
+				if existing.ID != input.ItemID {
+					remaining = append(remaining, existing)
+				}
+			}
+			if len(remaining) == len(subscription.Items) {
+				return nil // Recorded by an earlier run
+			}
+
+			if err := tx.Delete(&models.SubscriptionItem{}, "id = ?", input.ItemID).Error; err != nil {
+				return err
+			}
+
+			subscription.Items = remaining
+			return recordSubscriptionEvent(tx, models.SubscriptionEventAddonRemoved, &before, subscription, &op.UserID, models.EventSourceAPI)
+		})
+	}
+}
+
+// GetBillingOperation returns a billing operation started by the user, for
+// example to follow a subscription being created. Admins can see every
+// operation.
+func GetBillingOperation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var operation models.BillingOperation
+		if err := db.First(&operation, "id = ?", c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Billing operation not found"})
+			return
+		}
+		if operation.UserID != userID.(uuid.UUID) && !isUserAdmin(db, userID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Billing operation not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, operation)
+	}
+}
+
+// GetBillingOperations lists billing operations, newest first, optionally
+// filtered by status and kind, e.g. to find operations stuck compensating.
+// Admin only.
+func GetBillingOperations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		query := db.Order("created_at DESC").Limit(100)
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if kind := c.Query("kind"); kind != "" {
+			query = query.Where("kind = ?", kind)
+		}
+
+		var operations []models.BillingOperation
+		if err := query.Find(&operations).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch billing operations"})
+			return
+		}
+
+		c.JSON(http.StatusOK, operations)
+	}
+}
@@ -0,0 +1,246 @@
+// handlers/catalog_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/price"
+	"github.com/stripe/stripe-go/v79/product"
+)
+
+// CatalogImportItem describes what happened to a single Stripe product during an import.
+type CatalogImportItem struct {
+	StripeProductID string `json:"stripe_product_id"`
+	ProductID       string `json:"product_id,omitempty"`
+	Name            string `json:"name"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+// CatalogImportReport summarises a catalog import run.
+type CatalogImportReport struct {
+	DryRun  bool                `json:"dry_run"`
+	Created []CatalogImportItem `json:"created"`
+	Updated []CatalogImportItem `json:"updated"`
+	Skipped []CatalogImportItem `json:"skipped"`
+}
+
+// ImportStripeCatalog lists the active Stripe products with their monthly,
+// yearly and one-time USD prices and upserts them into the products table,
+// matched by Stripe product ID. A "kind" metadata entry of "base" or "addon"
+// sets the product kind and a "lifetime" entry sets lifetime access. With
+// dryRun set nothing is written.
+func ImportStripeCatalog(ctx context.Context, db *gorm.DB, dryRun bool) (*CatalogImportReport, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	report := &CatalogImportReport{
+		DryRun:  dryRun,
+		Created: []CatalogImportItem{},
+		Updated: []CatalogImportItem{},
+		Skipped: []CatalogImportItem{},
+	}
+
+	productParams := &stripe.ProductListParams{Active: stripe.Bool(true)}
+	productParams.Context = ctx
+	iter := product.List(productParams)
+	for iter.Next() {
+		stripeProduct := iter.Product()
+		item := CatalogImportItem{StripeProductID: stripeProduct.ID, Name: stripeProduct.Name}
+
+		monthly, yearly, oneTime, err := listProductPrices(ctx, stripeProduct)
+		if err != nil {
+			return nil, err
+		}
+		if monthly == nil && yearly == nil && oneTime == nil {
+			item.Reason = "no active monthly, yearly or one-time USD price"
+			report.Skipped = append(report.Skipped, item)
+			continue
+		}
+
+		existing, err := findProductForStripe(db, stripeProduct.ID, monthly, yearly, oneTime)
+		if err != nil {
+			return nil, err
+		}
+
+		// Start from the local product so fields Stripe does not know about
+		// are kept
+		imported := models.Product{Kind: models.ProductKindBase}
+		if existing != nil {
+			imported = *existing
+		}
+		imported.Name = stripeProduct.Name
+		imported.Description = stripeProduct.Description
+		imported.StripeProductID = stripeProduct.ID
+
+		// The kind and lifetime access can be managed from the Stripe
+		// dashboard through metadata
+		if kind := stripeProduct.Metadata["kind"]; kind == models.ProductKindBase || kind == models.ProductKindAddon {
+			imported.Kind = kind
+		}
+		if lifetime, err := strconv.ParseBool(stripeProduct.Metadata["lifetime"]); err == nil {
+			imported.LifetimeAccess = lifetime
+		}
+
+		imported.MonthlyPrice, imported.StripeMonthlyPriceID = 0, ""
+		if monthly != nil {
+			imported.MonthlyPrice = float64(monthly.UnitAmount) / 100
+			imported.StripeMonthlyPriceID = monthly.ID
+		}
+		imported.YearlyPrice, imported.StripeYearlyPriceID = 0, ""
+		if yearly != nil {
+			imported.YearlyPrice = float64(yearly.UnitAmount) / 100
+			imported.StripeYearlyPriceID = yearly.ID
+		}
+		imported.OneTimePrice, imported.StripeOneTimePriceID = 0, ""
+		if oneTime != nil {
+			imported.OneTimePrice = float64(oneTime.UnitAmount) / 100
+			imported.StripeOneTimePriceID = oneTime.ID
+		}
+
+		if existing == nil {
+			imported.ID = uuid.New()
+			item.ProductID = imported.ID.String()
+			if !dryRun {
+				if err := db.Create(&imported).Error; err != nil {
+					return nil, err
+				}
+			}
+			report.Created = append(report.Created, item)
+			continue
+		}
+
+		item.ProductID = existing.ID.String()
+		if *existing == imported {
+			item.Reason = "already up to date"
+			report.Skipped = append(report.Skipped, item)
+			continue
+		}
+
+		if !dryRun {
+			if err := db.Save(&imported).Error; err != nil {
+				return nil, err
+			}
+		}
+		report.Updated = append(report.Updated, item)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// listProductPrices returns the product's monthly, yearly and one-time USD
+// prices. The product's default price wins when several prices share an
+// interval, otherwise the most recently created one is used.
+func listProductPrices(ctx context.Context, stripeProduct *stripe.Product) (*stripe.Price, *stripe.Price, *stripe.Price, error) {
+	var monthly, yearly, oneTime *stripe.Price
+
+	params := &stripe.PriceListParams{
+		Product:  stripe.String(stripeProduct.ID),
+		Active:   stripe.Bool(true),
+		Currency: stripe.String(string(stripe.CurrencyUSD)),
+	}
+	params.Context = ctx
+	iter := price.List(params)
+	for iter.Next() {
+		p := iter.Price()
+		isDefault := stripeProduct.DefaultPrice != nil && stripeProduct.DefaultPrice.ID == p.ID
+
+		if p.Type == stripe.PriceTypeOneTime {
+			if oneTime == nil || isDefault {
+				oneTime = p
+			}
+			continue
+		}
+		if p.Recurring == nil || p.Recurring.IntervalCount != 1 {
+			continue
+		}
+
+		switch p.Recurring.Interval {
+		case stripe.PriceRecurringIntervalMonth:
+			if monthly == nil || isDefault {
+				monthly = p
+			}
+		case stripe.PriceRecurringIntervalYear:
+			if yearly == nil || isDefault {
+				yearly = p
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return monthly, yearly, oneTime, nil
+}
+
+// findProductForStripe looks a local product up by Stripe product ID, falling
+// back to its price IDs for products created before the product ID was stored.
+func findProductForStripe(db *gorm.DB, stripeProductID string, monthly, yearly, oneTime *stripe.Price) (*models.Product, error) {
+	var existing models.Product
+
+	err := db.Where("stripe_product_id = ?", stripeProductID).First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var priceIDs []string
+	if monthly != nil {
+		priceIDs = append(priceIDs, monthly.ID)
+	}
+	if yearly != nil {
+		priceIDs = append(priceIDs, yearly.ID)
+	}
+	if oneTime != nil {
+		priceIDs = append(priceIDs, oneTime.ID)
+	}
+
+	err = db.Where("(stripe_product_id = '' OR stripe_product_id IS NULL) AND (stripe_monthly_price_id IN ? OR stripe_yearly_price_id IN ? OR stripe_one_time_price_id IN ?)", priceIDs, priceIDs, priceIDs).
+		First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &existing, nil
+}
+
+func ImportProductsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run value"})
+			return
+		}
+
+		report, err := ImportStripeCatalog(c.Request.Context(), db, dryRun)
+		if err != nil {
+			respondStripeError(c, err, "Failed to import products from Stripe")
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,167 @@
+// handlers/entitlement_handler.go
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/entitlements"
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func GetEntitlements(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		grants, err := entitlements.ForUser(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve entitlements"})
+			return
+		}
+
+		response := make([]entitlements.Grant, 0, len(grants))
+		for _, grant := range grants {
+			response = append(response, grant)
+		}
+		sort.Slice(response, func(i, j int) bool { return response[i].Feature < response[j].Feature })
+
+		c.JSON(http.StatusOK, gin.H{"entitlements": response})
+	}
+}
+
+func GetFeatures(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var features []models.Feature
+		if err := db.Order("key").Find(&features).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch features"})
+			return
+		}
+
+		c.JSON(http.StatusOK, features)
+	}
+}
+
+func CreateFeature(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var input struct {
+			Key         string `json:"key" binding:"required,max=100"`
+			Name        string `json:"name" binding:"required"`
+			Description string `json:"description"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+
+		var existing models.Feature
+		if err := db.Where("key = ?", input.Key).First(&existing).Error; err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Feature already exists"})
+			return
+		}
+
+		feature := models.Feature{
+			Key:         input.Key,
+			Name:        input.Name,
+			Description: input.Description,
+		}
+
+		if err := db.Create(&feature).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create feature"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, feature)
+	}
+}
+
+// SetProductEntitlement grants a feature to a product, or updates its limit.
+func SetProductEntitlement(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var input struct {
+			FeatureKey string `json:"feature_key" binding:"required"`
+			Limit      *int64 `json:"limit" binding:"omitempty,min=0"` // Omit for unlimited
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+
+		var product models.Product
+		if err := db.Where("id = ?", c.Param("id")).First(&product).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		var feature models.Feature
+		if err := db.Where("key = ?", input.FeatureKey).First(&feature).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Feature not found"})
+			return
+		}
+
+		entitlement := models.Entitlement{
+			ProductID: product.ID,
+			FeatureID: feature.ID,
+			Limit:     input.Limit,
+		}
+
+		if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Omit("Feature").Create(&entitlement).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save entitlement"})
+			return
+		}
+		entitlement.Feature = feature
+
+		c.JSON(http.StatusOK, entitlement)
+	}
+}
+
+func DeleteProductEntitlement(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var feature models.Feature
+		if err := db.Where("key = ?", c.Param("feature_key")).First(&feature).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Feature not found"})
+			return
+		}
+
+		result := db.Where("product_id = ? AND feature_id = ?", c.Param("id"), feature.ID).Delete(&models.Entitlement{})
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete entitlement"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Entitlement not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Entitlement removed successfully"})
+	}
+}
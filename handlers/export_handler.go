@@ -0,0 +1,246 @@
+// handlers/export_handler.go
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/export"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// exportFilters returns the scope of an export from the same filters as the
+// admin list of its resource. Paging and sorting parameters are ignored.
+func exportFilters(resource string, values url.Values) (export.Scope, error) {
+	switch resource {
+	case export.ResourceSubscriptions:
+		return adminSubscriptionFilters(values)
+	case export.ResourceUsers:
+		return adminUserFilters(values)
+	}
+	return nil, export.ErrUnknownResource
+}
+
+// ExportSubscriptions exports subscriptions with their users' emails and
+// products. Admin only.
+func ExportSubscriptions(db *gorm.DB) gin.HandlerFunc {
+	return exportResource(db, export.ResourceSubscriptions)
+}
+
+// ExportUsers exports users with their number of live subscriptions. Admin
+// only.
+func ExportUsers(db *gorm.DB) gin.HandlerFunc {
+	return exportResource(db, export.ResourceUsers)
+}
+
+// exportResource streams every row of resource that matches the admin list
+// filters as CSV or NDJSON (format, default csv). Large exports are better
+// created with CreateExport.
+func exportResource(db *gorm.DB, resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		format := c.DefaultQuery("format", export.FormatCSV)
+		if !export.ValidFormat(format) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": export.ErrUnknownFormat.Error()})
+			return
+		}
+		filters := c.Request.URL.Query()
+		filters.Del("format")
+		scope, err := exportFilters(resource, filters)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		filename := fmt.Sprintf("%s-%s.%s", resource, time.Now().UTC().Format("20060102-150405"), format)
+		c.Header("Content-Type", export.ContentType(format))
+		c.Header("Content-Disposition", "attachment; filename="+filename)
+		c.Status(http.StatusOK)
+
+		// Rows are written as they are read; an error part way through can
+		// only cut the response short
+		rows, err := export.Write(db.WithContext(c.Request.Context()), resource, format, scope, c.Writer)
+		if err != nil {
+			utils.Log("Error exporting", resource, "after", rows, "rows:", err)
+		}
+	}
+}
+
+// CreateExport queues an export of a resource with the admin list filters,
+// to be written by a queue worker and downloaded once it completes. Admin
+// only.
+func CreateExport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var request struct {
+			Resource string            `json:"resource" binding:"required"`
+			Format   string            `json:"format"`
+			Filters  map[string]string `json:"filters"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !export.ValidResource(request.Resource) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": export.ErrUnknownResource.Error()})
+			return
+		}
+		if request.Format == "" {
+			request.Format = export.FormatCSV
+		}
+		if !export.ValidFormat(request.Format) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": export.ErrUnknownFormat.Error()})
+			return
+		}
+		filters := url.Values{}
+		for name, value := range request.Filters {
+			filters.Set(name, value)
+		}
+		if _, err := exportFilters(request.Resource, filters); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		exp := models.Export{
+			RequestedByID: userID.(uuid.UUID),
+			Resource:      request.Resource,
+			Format:        request.Format,
+			Filters:       filters.Encode(),
+			Status:        models.ExportStatusPending,
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&exp).Error; err != nil {
+				return err
+			}
+			_, err := jobs.Enqueue(tx, export.Task{ExportID: exp.ID}, jobs.EnqueueOptions{MaxAttempts: 3})
+			return err
+		})
+		if err != nil {
+			utils.Log("Error queueing export:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue export"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "Export is being prepared", "export": exp})
+	}
+}
+
+// findExport loads the export in the :id parameter, responding with an error
+// if it cannot.
+func findExport(c *gin.Context, db *gorm.DB) (*models.Export, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export ID"})
+		return nil, false
+	}
+
+	var exp models.Export
+	err = db.First(&exp, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export"})
+		return nil, false
+	}
+	return &exp, true
+}
+
+// GetExports lists asynchronous exports, newest first. Admin only.
+func GetExports(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var exports []models.Export
+		if err := db.Order("created_at DESC").Limit(100).Find(&exports).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch exports"})
+			return
+		}
+
+		c.JSON(http.StatusOK, exports)
+	}
+}
+
+// GetExport returns the status of an asynchronous export. Admin only.
+func GetExport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		exp, ok := findExport(c, db)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, exp)
+	}
+}
+
+// DownloadExport sends the file of a completed export, or 410 Gone once it
+// has expired. Admin only.
+func DownloadExport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		exp, ok := findExport(c, db)
+		if !ok {
+			return
+		}
+		if exp.Status != models.ExportStatusCompleted && exp.Status != models.ExportStatusExpired {
+			c.JSON(http.StatusConflict, gin.H{"error": "Export is not completed", "status": exp.Status})
+			return
+		}
+
+		// Check that the file is still there before starting the response
+		var first models.ExportChunk
+		if exp.Size > 0 {
+			if err := db.Select("export_id").Where("export_id = ? AND seq = 0", exp.ID).First(&first).Error; err != nil {
+				exp.Status = models.ExportStatusExpired
+			}
+		}
+		if exp.Status == models.ExportStatusExpired || exp.ExpiresAt == nil || exp.ExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusGone, gin.H{"error": export.ErrExpired.Error()})
+			return
+		}
+
+		c.Header("Content-Type", export.ContentType(exp.Format))
+		c.Header("Content-Disposition", "attachment; filename="+export.Filename(*exp))
+		c.Header("Content-Length", strconv.FormatInt(exp.Size, 10))
+		c.Status(http.StatusOK)
+		if err := export.Copy(db.WithContext(c.Request.Context()), *exp, c.Writer); err != nil {
+			utils.Log("Error downloading export", exp.ID, ":", err)
+		}
+	}
+}
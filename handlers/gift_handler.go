@@ -0,0 +1,356 @@
+// handlers/gift_handler.go
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/checkout/session"
+)
+
+const (
+	// How long a paid gift code can be redeemed for
+	giftCodeValidity = 365 * 24 * time.Hour
+
+	maxGiftMonths = 36
+
+	// Plan of subscriptions redeemed from gift codes
+	giftPlan = "gift"
+)
+
+func CreateGift(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		userID, _ := c.Get("user_id")
+
+		var giftRequest struct {
+			ProductID      uuid.UUID `json:"product_id" binding:"required"`
+			Months         int       `json:"months" binding:"required,min=1"`
+			RecipientEmail string    `json:"recipient_email" binding:"omitempty,email"`
+			Message        string    `json:"message" binding:"max=500"`
+			SuccessURL     string    `json:"success_url" binding:"required,url"`
+			CancelURL      string    `json:"cancel_url" binding:"required,url"`
+		}
+
+		if err := c.ShouldBindJSON(&giftRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if giftRequest.Months > maxGiftMonths {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A gift can cover at most %d months", maxGiftMonths)})
+			return
+		}
+
+		var product models.Product
+		if err := db.First(&product, giftRequest.ProductID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if product.IsAddon() || product.MonthlyPrice <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product cannot be gifted"})
+			return
+		}
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		code, err := utils.GenerateCode("GIFT", 3)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate gift code"})
+			return
+		}
+
+		gift := models.Gift{
+			PurchaserID:    user.ID,
+			ProductID:      product.ID,
+			Months:         giftRequest.Months,
+			Amount:         product.MonthlyPrice * float64(giftRequest.Months),
+			RecipientEmail: giftRequest.RecipientEmail,
+			Message:        giftRequest.Message,
+			Code:           code,
+			Status:         models.GiftStatusPending,
+		}
+
+		if err := db.Create(&gift).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create gift"})
+			return
+		}
+
+		// The buyer pays for all months up front; the gift becomes redeemable
+		// once the checkout.session.completed webhook arrives
+		params := &stripe.CheckoutSessionParams{
+			Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
+			CustomerEmail:     stripe.String(user.Email),
+			ClientReferenceID: stripe.String(gift.ID.String()),
+			SuccessURL:        stripe.String(giftRequest.SuccessURL),
+			CancelURL:         stripe.String(giftRequest.CancelURL),
+			LineItems: []*stripe.CheckoutSessionLineItemParams{
+				{
+					PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+						Currency:   stripe.String(string(stripe.CurrencyUSD)),
+						UnitAmount: stripe.Int64(int64(math.Round(gift.Amount * 100))), // Stripe uses cents
+						ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+							Name: stripe.String(fmt.Sprintf("Gift: %s (%d months)", product.Name, gift.Months)),
+						},
+					},
+					Quantity: stripe.Int64(1),
+				},
+			},
+			Metadata: map[string]string{
+				"gift_id": gift.ID.String(),
+			},
+		}
+		if key := stripeIdempotencyKey(c, "gift-checkout-session"); key != "" {
+			params.SetIdempotencyKey(key)
+		}
+		params.Context = c.Request.Context()
+		checkoutSession, err := session.New(params)
+		if err != nil {
+			db.Delete(&gift)
+			respondStripeError(c, err, "Failed to create Stripe checkout session")
+			return
+		}
+
+		// The webhooks find the gift by the gift_id metadata, so a paid
+		// session is never lost; if the session ID cannot be stored the
+		// session is expired instead, so that it cannot be paid
+		gift.StripeCheckoutSessionID = checkoutSession.ID
+		if err := db.Save(&gift).Error; err != nil {
+			if _, expireErr := session.Expire(checkoutSession.ID, &stripe.CheckoutSessionExpireParams{Params: stripe.Params{Context: c.Request.Context()}}); expireErr != nil {
+				utils.Log("Error expiring checkout session", checkoutSession.ID, "of gift", gift.ID, ":", expireErr)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update gift"})
+			return
+		}
+
+		recordGiftAudit(db, &gift.ID, &user.ID, "created", fmt.Sprintf("%d months of %s", gift.Months, product.Name), c.ClientIP())
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":      "Gift created successfully",
+			"gift_id":      gift.ID,
+			"checkout_url": checkoutSession.URL,
+		})
+	}
+}
+
+// GetGifts lists the gifts the user bought. Codes are only shown once paid.
+func GetGifts(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var gifts []models.Gift
+		if err := db.Where("purchaser_id = ?", userID).Order("created_at DESC").Find(&gifts).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch gifts"})
+			return
+		}
+
+		for i := range gifts {
+			if gifts[i].Status == models.GiftStatusPending {
+				gifts[i].Code = ""
+			}
+		}
+
+		c.JSON(http.StatusOK, gifts)
+	}
+}
+
+var (
+	errGiftNotRedeemable = errors.New("gift code is not valid")
+	errGiftExpired       = errors.New("gift code has expired")
+	errAlreadySubscribed = errors.New("user already has an active subscription")
+)
+
+func RedeemGift(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+
+		var redeemRequest struct {
+			Code string `json:"code" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&redeemRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		code := strings.ToUpper(strings.TrimSpace(redeemRequest.Code))
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		var gift models.Gift
+		var subscription models.Subscription
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Lock the gift so that the code can only be redeemed once
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&gift).Error; err != nil {
+				return errGiftNotRedeemable
+			}
+			if gift.Status != models.GiftStatusPaid {
+				return errGiftNotRedeemable
+			}
+			if gift.ExpiresAt != nil && gift.ExpiresAt.Before(time.Now()) {
+				return errGiftExpired
+			}
+
+			if err := lockSubscriptions(tx, user.ID, nil); err != nil {
+				return err
+			}
+			if err := ensureNoLiveSubscription(tx, tx.Where("user_id = ? AND organization_id IS NULL", user.ID), &user.ID, models.EventSourceAPI); err != nil {
+				return err
+			}
+
+			// Gift subscriptions are prepaid and have no recurring Stripe billing
+			now := time.Now()
+			subscription = models.Subscription{
+				UserID:    user.ID,
+				ProductID: gift.ProductID,
+				StartDate: now,
+				EndDate:   now.AddDate(0, gift.Months, 0),
+				Status:    models.SubscriptionStatusActive,
+				Plan:      giftPlan,
+			}
+			if err := tx.Create(&subscription).Error; err != nil {
+				return err
+			}
+
+			gift.Status = models.GiftStatusRedeemed
+			gift.RedeemedByID = &user.ID
+			gift.RedeemedAt = &now
+			gift.SubscriptionID = &subscription.ID
+			if err := tx.Save(&gift).Error; err != nil {
+				return err
+			}
+			return recordSubscriptionEvent(tx, models.SubscriptionEventCreated, nil, subscription, &user.ID, models.EventSourceAPI)
+		})
+
+		switch {
+		case err == nil:
+			recordGiftAudit(db, &gift.ID, &user.ID, "redeemed", "subscription "+subscription.ID.String(), c.ClientIP())
+		case errors.Is(err, errGiftNotRedeemable), errors.Is(err, errGiftExpired):
+			var giftID *uuid.UUID
+			if gift.ID != uuid.Nil {
+				giftID = &gift.ID
+			}
+			recordGiftAudit(db, giftID, &user.ID, "redeem_failed", err.Error(), c.ClientIP())
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, errAlreadySubscribed), isLiveSubscriptionConflict(err):
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active subscription"})
+			return
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem gift"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":      "Gift redeemed successfully",
+			"subscription": subscription,
+		})
+	}
+}
+
+// findCheckoutGift finds the gift a Checkout Session was created for, by the
+// gift_id in its metadata. The session ID is stored after the session is
+// created and may be missing.
+func findCheckoutGift(db *gorm.DB, checkoutSession *stripe.CheckoutSession) (models.Gift, error) {
+	var gift models.Gift
+	err := db.Where("id = ?", checkoutSession.Metadata["gift_id"]).First(&gift).Error
+	if err == nil && gift.StripeCheckoutSessionID != "" && gift.StripeCheckoutSessionID != checkoutSession.ID {
+		return gift, fmt.Errorf("gift %s belongs to checkout session %s, not %s", gift.ID, gift.StripeCheckoutSessionID, checkoutSession.ID)
+	}
+	return gift, err
+}
+
+// completeGiftPayment makes the gift behind a completed Checkout Session
+// redeemable.
+func completeGiftPayment(db *gorm.DB, checkoutSession *stripe.CheckoutSession) error {
+	gift, err := findCheckoutGift(db, checkoutSession)
+	if err != nil {
+		return err
+	}
+
+	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid || gift.Status != models.GiftStatusPending {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(giftCodeValidity)
+	gift.StripeCheckoutSessionID = checkoutSession.ID
+	gift.Status = models.GiftStatusPaid
+	gift.ExpiresAt = &expiresAt
+	if checkoutSession.PaymentIntent != nil {
+		gift.StripePaymentIntentID = checkoutSession.PaymentIntent.ID
+	}
+
+	if err := db.Save(&gift).Error; err != nil {
+		return err
+	}
+
+	recordGiftAudit(db, &gift.ID, nil, "paid", "checkout session "+checkoutSession.ID, "")
+	return nil
+}
+
+func recordGiftAudit(db *gorm.DB, giftID *uuid.UUID, actorID *uuid.UUID, action string, detail string, ip string) {
+	entry := models.GiftAuditEntry{
+		GiftID:    giftID,
+		ActorID:   actorID,
+		Action:    action,
+		Detail:    detail,
+		IPAddress: ip,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		utils.Log("Error recording gift audit entry:", err)
+	}
+}
+
+// GetGiftAudit returns the audit trail of a gift. Admin only.
+func GetGiftAudit(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var gift models.Gift
+		if err := db.Where("id = ?", c.Param("id")).First(&gift).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Gift not found"})
+			return
+		}
+
+		var entries []models.GiftAuditEntry
+		if err := db.Where("gift_id = ?", gift.ID).Order("created_at").Find(&entries).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch gift audit trail"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"gift":  gift,
+			"audit": entries,
+		})
+	}
+}
@@ -0,0 +1,268 @@
+// handlers/job_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/export"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/metrics"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/notify"
+	"github.com/yeboahd24/subscription-stripe/saga"
+	"github.com/yeboahd24/subscription-stripe/stripeclient"
+	"github.com/yeboahd24/subscription-stripe/utils"
+	"github.com/yeboahd24/subscription-stripe/webhooks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/sub"
+	"gorm.io/gorm"
+)
+
+// BackgroundJobs are the jobs started by cmd/main.go.
+func BackgroundJobs(db *gorm.DB) []jobs.Job {
+	return []jobs.Job{
+		{
+			Name:     "expire-trials",
+			Schedule: "*/5 * * * *",
+			Run:      func(ctx context.Context) error { return UpdateTrialStatus(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "activate-schedules",
+			Schedule: "*/5 * * * *",
+			Run:      func(ctx context.Context) error { return ActivateStartedSchedules(ctx, db.WithContext(ctx)) },
+		},
+		{
+			Name:     "expire-prepaid",
+			Schedule: "@hourly",
+			Run:      func(ctx context.Context) error { return ExpirePrepaidSubscriptions(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "expire-wallets",
+			Schedule: "@hourly",
+			Run:      func(ctx context.Context) error { return ExpireWallets(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "renewal-reminders",
+			Schedule: "0 9 * * *",
+			Run:      func(ctx context.Context) error { return SendRenewalReminders(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "trial-ending-reminders",
+			Schedule: "15 * * * *",
+			Run:      func(ctx context.Context) error { return SendTrialEndingReminders(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "prune-queued-jobs",
+			Schedule: "0 4 * * *",
+			Run:      func(ctx context.Context) error { return PruneQueuedJobs(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "prune-exports",
+			Schedule: "@hourly",
+			Run:      func(ctx context.Context) error { return export.Prune(db.WithContext(ctx)) },
+		},
+		{
+			Name:     "reconcile-subscriptions",
+			Schedule: "30 3 * * *",
+			Run:      func(ctx context.Context) error { return ReconcileSubscriptions(ctx, db.WithContext(ctx)) },
+		},
+		{
+			// Shortly after midnight UTC, record how the day that just ended
+			// finished
+			Name:     "snapshot-revenue",
+			Schedule: "5 0 * * *",
+			Run: func(ctx context.Context) error {
+				return metrics.TakeSnapshot(db.WithContext(ctx), metrics.Day(time.Now()).AddDate(0, 0, -1))
+			},
+		},
+	}
+}
+
+// reminderWindow reads how many days ahead a reminder is sent from the
+// environment variable.
+func reminderWindow(variable string, defaultDays int) time.Duration {
+	days, err := strconv.Atoi(os.Getenv(variable))
+	if err != nil || days < 1 {
+		days = defaultDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// intervalHours formats d as a Postgres interval.
+func intervalHours(d time.Duration) string {
+	return strconv.Itoa(int(d.Hours())) + " hours"
+}
+
+// SendRenewalReminders emails the owners of paid subscriptions renewing
+// within the reminder window. Each renewal date is reminded once.
+func SendRenewalReminders(db *gorm.DB) error {
+	now := time.Now()
+	window := reminderWindow("RENEWAL_REMINDER_DAYS", 7)
+
+	var subscriptions []models.Subscription
+	err := db.Preload("User").
+		Where("status = ? AND stripe_id != '' AND end_date BETWEEN ? AND ?", models.SubscriptionStatusActive, now, now.Add(window)).
+		Where("renewal_reminder_sent_at IS NULL OR renewal_reminder_sent_at < end_date - ?::interval", intervalHours(window)).
+		Find(&subscriptions).Error
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		data := subscriptionEmailData(db, subscription)
+		data["RenewsAt"] = formatEmailDate(subscription.EndDate)
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			uniqueKey := fmt.Sprintf("renewal-reminder:%s:%d", subscription.ID, subscription.EndDate.Unix())
+			if err := notify.Enqueue(tx, subscription.User.Email, notify.TemplateRenewalReminder, data, uniqueKey); err != nil {
+				return err
+			}
+			return tx.Model(&subscription).Update("renewal_reminder_sent_at", now).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendTrialEndingReminders warns users whose trial ends within
+// TRIAL_REMINDER_DAYS days (default 3). Each trial end date is reminded once.
+func SendTrialEndingReminders(db *gorm.DB) error {
+	now := time.Now()
+	window := reminderWindow("TRIAL_REMINDER_DAYS", 3)
+
+	var subscriptions []models.Subscription
+	err := db.Preload("User").
+		Where("status = ? AND trial_end_date BETWEEN ? AND ?", models.SubscriptionStatusTrialing, now, now.Add(window)).
+		Where("trial_reminder_sent_at IS NULL OR trial_reminder_sent_at < trial_end_date - ?::interval", intervalHours(window)).
+		Find(&subscriptions).Error
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		data := subscriptionEmailData(db, subscription)
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			uniqueKey := fmt.Sprintf("trial-ending:%s:%d", subscription.ID, subscription.TrialEndDate.Unix())
+			if err := notify.Enqueue(tx, subscription.User.Email, notify.TemplateTrialEnding, data, uniqueKey); err != nil {
+				return err
+			}
+			return tx.Model(&subscription).Update("trial_reminder_sent_at", now).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PruneQueuedJobs deletes finished queued jobs after 30 days. Dead jobs are
+// kept until an admin retries or discards them.
+func PruneQueuedJobs(db *gorm.DB) error {
+	return db.Where("status IN ? AND finished_at < ?",
+		[]string{models.QueuedJobStatusSucceeded, models.QueuedJobStatusDiscarded},
+		time.Now().AddDate(0, 0, -30)).
+		Delete(&models.QueuedJob{}).Error
+}
+
+// RegisterTasks registers the handlers for every queued task.
+func RegisterTasks(q *jobs.Queue, db *gorm.DB, notifier *notify.Notifier) {
+	jobs.Handle(q, notifier.Deliver)
+	jobs.Handle(q, webhooks.NewDeliverer(db).Deliver)
+
+	coordinator := saga.NewCoordinator(db)
+	for _, s := range BillingSagas(db) {
+		coordinator.Register(s)
+	}
+	jobs.Handle(q, coordinator.Run)
+
+	jobs.Handle(q, export.NewRunner(db, exportFilters).Run)
+}
+
+// ReconcileSubscriptions compares every live subscription with Stripe and
+// applies the status, current period and prices Stripe reports, in case
+// webhooks were missed.
+func ReconcileSubscriptions(ctx context.Context, db *gorm.DB) error {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	var subscriptions []models.Subscription
+	return db.Where("stripe_id != '' AND status != ?", models.SubscriptionStatusCanceled).
+		FindInBatches(&subscriptions, 100, func(tx *gorm.DB, batch int) error {
+			for _, subscription := range subscriptions {
+				stripeSub, err := sub.Get(subscription.StripeID, &stripe.SubscriptionParams{Params: stripe.Params{Context: ctx}})
+				if errors.Is(err, stripeclient.ErrCircuitOpen) {
+					return err // Try again on the next run
+				}
+				if err != nil {
+					utils.Log("Error fetching Stripe subscription", subscription.StripeID, ":", err)
+					continue
+				}
+
+				if stripeSub.CurrentPeriodEnd > 0 {
+					periodEnd := time.Unix(stripeSub.CurrentPeriodEnd, 0)
+					if !periodEnd.Equal(subscription.EndDate) {
+						before := subscription.Snapshot()
+						err := db.Transaction(func(tx *gorm.DB) error {
+							if err := tx.Model(&subscription).Update("end_date", periodEnd).Error; err != nil {
+								return err
+							}
+							subscription.EndDate = periodEnd
+							return recordSubscriptionEvent(tx, models.SubscriptionEventEndDateChanged, &before, subscription, nil, models.EventSourceJob)
+						})
+						if err != nil {
+							return err
+						}
+					}
+				}
+
+				if err := syncBilledPrices(db, subscription.StripeID, billedPricesFromStripe(stripeSub)); err != nil {
+					return err
+				}
+
+				status := models.SubscriptionStatusFromStripe(string(stripeSub.Status))
+				if err := updateSubscriptionStatus(db, subscription.StripeID, status, models.EventSourceJob); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// GetJobRuns lists recent background job runs, newest first. Admin only.
+func GetJobRuns(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		query := db.Order("scheduled_at DESC").Limit(100)
+		if job := c.Query("job"); job != "" {
+			query = query.Where("job = ?", job)
+		}
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+
+		var runs []models.JobRun
+		if err := query.Find(&runs).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch job runs"})
+			return
+		}
+
+		c.JSON(http.StatusOK, runs)
+	}
+}
@@ -0,0 +1,152 @@
+// handlers/metrics_handler.go
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/metrics"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// maxMetricsDays limits the range of a metrics report.
+const maxMetricsDays = 366
+
+// GetMetrics reports MRR, ARR, subscriber counts, MRR movements and trial
+// conversion between from and to (YYYY-MM-DD, inclusive; by default the last
+// 30 days), optionally grouped by product or plan. Admin only.
+func GetMetrics(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		query := metrics.Query{To: metrics.Day(time.Now()), GroupBy: c.Query("group_by")}
+		if to := c.Query("to"); to != "" {
+			parsed, err := time.Parse("2006-01-02", to)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date in the form YYYY-MM-DD"})
+				return
+			}
+			query.To = parsed
+		}
+		query.From = query.To.AddDate(0, 0, -29)
+		if from := c.Query("from"); from != "" {
+			parsed, err := time.Parse("2006-01-02", from)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date in the form YYYY-MM-DD"})
+				return
+			}
+			query.From = parsed
+		}
+
+		if query.From.After(query.To) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+			return
+		}
+		if query.To.Sub(query.From) >= maxMetricsDays*24*time.Hour {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The range can span at most 366 days"})
+			return
+		}
+		if query.GroupBy != "" && query.GroupBy != metrics.GroupByProduct && query.GroupBy != metrics.GroupByPlan {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be product or plan"})
+			return
+		}
+
+		report, err := metrics.Compute(db.WithContext(c.Request.Context()), query)
+		if err != nil {
+			utils.Log("Error computing metrics:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute metrics"})
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// maxCohortMonths limits the number of cohorts in a cohort report.
+const maxCohortMonths = 36
+
+// GetCohorts reports the retention of the subscribers who first subscribed in
+// each month between from and to (YYYY-MM, inclusive; by default the last 12
+// months), optionally limited to a product, a plan, or trial or direct
+// signups. The report is JSON, or CSV with format=csv. Admin only.
+func GetCohorts(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		query := metrics.CohortQuery{To: metrics.Month(time.Now()), Plan: c.Query("plan"), Signup: c.Query("signup")}
+		if to := c.Query("to"); to != "" {
+			parsed, err := time.Parse("2006-01", to)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a month in the form YYYY-MM"})
+				return
+			}
+			query.To = parsed
+		}
+		query.From = query.To.AddDate(0, -11, 0)
+		if from := c.Query("from"); from != "" {
+			parsed, err := time.Parse("2006-01", from)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a month in the form YYYY-MM"})
+				return
+			}
+			query.From = parsed
+		}
+
+		if query.From.After(query.To) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+			return
+		}
+		if !query.From.AddDate(0, maxCohortMonths, 0).After(query.To) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The range can span at most 36 months"})
+			return
+		}
+		if productID := c.Query("product_id"); productID != "" {
+			parsed, err := uuid.Parse(productID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+				return
+			}
+			query.ProductID = &parsed
+		}
+		if query.Signup != "" && query.Signup != metrics.SignupTrial && query.Signup != metrics.SignupDirect {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "signup must be trial or direct"})
+			return
+		}
+		format := c.DefaultQuery("format", "json")
+		if format != "json" && format != "csv" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+			return
+		}
+
+		report, err := metrics.Cohorts(db.WithContext(c.Request.Context()), query)
+		if err != nil {
+			utils.Log("Error computing cohorts:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute cohorts"})
+			return
+		}
+
+		if format == "csv" {
+			c.Header("Content-Type", "text/csv")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=cohorts-%s-%s.csv", report.From, report.To))
+			if err := report.WriteCSV(c.Writer); err != nil {
+				utils.Log("Error writing cohorts:", err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,570 @@
+// handlers/organization_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/middleware"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/notify"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/customer"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Invitations can be accepted for a week.
+const invitationValidity = 7 * 24 * time.Hour
+
+var (
+	errNoSeatsAvailable   = errors.New("no seats available")
+	errInvitationNotFound = errors.New("invitation not found")
+	errInvitationExpired  = errors.New("invitation expired")
+	errAlreadyMember      = errors.New("already a member")
+)
+
+type organizationMemberResponse struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	HasSeat   bool      `json:"has_seat"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// subscriptionScope restricts a subscription query to the account the request
+// acts for: the organization selected with X-Organization-ID, or the user's
+// personal subscriptions.
+func subscriptionScope(c *gin.Context, db *gorm.DB) *gorm.DB {
+	if member, ok := middleware.OrganizationMember(c); ok {
+		return db.Where("organization_id = ?", member.OrganizationID)
+	}
+	userID, _ := c.Get("user_id")
+	return db.Where("user_id = ? AND organization_id IS NULL", userID)
+}
+
+// canManageSubscriptions reports whether the caller may change subscriptions
+// in the current context. Only owners and admins manage an organization's.
+func canManageSubscriptions(c *gin.Context) bool {
+	member, ok := middleware.OrganizationMember(c)
+	return !ok || member.CanManage()
+}
+
+// contextOrganizationID returns the organization the request acts for, or nil
+// for the user's personal account.
+func contextOrganizationID(c *gin.Context) *uuid.UUID {
+	if member, ok := middleware.OrganizationMember(c); ok {
+		return &member.OrganizationID
+	}
+	return nil
+}
+
+// ensureOrganizationStripeCustomer returns the organization's Stripe customer
+// ID, creating the customer the first time. Invoices go to the billing email.
+func ensureOrganizationStripeCustomer(ctx context.Context, db *gorm.DB, organizationID uuid.UUID, billingEmail string, idempotencyKey string) (string, error) {
+	var organization models.Organization
+	if err := db.First(&organization, organizationID).Error; err != nil {
+		return "", err
+	}
+	if organization.StripeCustomerID != "" {
+		return organization.StripeCustomerID, nil
+	}
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	params := &stripe.CustomerParams{
+		Params: stripe.Params{Context: ctx},
+		Name:   stripe.String(organization.Name),
+		Email:  stripe.String(billingEmail),
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	stripeCustomer, err := customer.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	if err := db.Model(&organization).Update("stripe_customer_id", stripeCustomer.ID).Error; err != nil {
+		return "", err
+	}
+
+	return stripeCustomer.ID, nil
+}
+
+// purchasedSeats is the number of seats bought through the organization's
+// subscriptions that currently grant access. Paused and unpaid subscriptions
+// keep their seats in Stripe but grant none here.
+func purchasedSeats(db *gorm.DB, organizationID uuid.UUID) (int64, error) {
+	var seats int64
+	err := db.Model(&models.Subscription{}).
+		Where("organization_id = ? AND status IN ?", organizationID, models.GrantingSubscriptionStatuses).
+		Select("COALESCE(SUM(seats), 0)").
+		Scan(&seats).Error
+	return seats, err
+}
+
+// findMembership loads the caller's membership of the organization in the
+// route, responding with 404 when they are not a member.
+func findMembership(c *gin.Context, db *gorm.DB) (*models.OrganizationMember, bool) {
+	userID, _ := c.Get("user_id")
+
+	var member models.OrganizationMember
+	if err := db.Where("organization_id = ? AND user_id = ?", c.Param("id"), userID).First(&member).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return nil, false
+	}
+
+	return &member, true
+}
+
+func CreateOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var input struct {
+			Name string `json:"name" binding:"required,max=255"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+
+		organization := models.Organization{
+			Name:    input.Name,
+			OwnerID: id,
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&organization).Error; err != nil {
+				return err
+			}
+			return tx.Create(&models.OrganizationMember{
+				OrganizationID: organization.ID,
+				UserID:         id,
+				Role:           models.OrganizationRoleOwner,
+			}).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, organization)
+	}
+}
+
+func GetOrganizations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+
+		var organizations []struct {
+			models.Organization
+			Role    string `json:"role"`
+			HasSeat bool   `json:"has_seat"`
+		}
+		err := db.Table("organizations").
+			Select("organizations.*, organization_members.role, organization_members.has_seat").
+			Joins("JOIN organization_members ON organization_members.organization_id = organizations.id").
+			Where("organization_members.user_id = ?", userID).
+			Order("organizations.created_at").
+			Scan(&organizations).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organizations"})
+			return
+		}
+
+		c.JSON(http.StatusOK, organizations)
+	}
+}
+
+func GetOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := findMembership(c, db); !ok {
+			return
+		}
+
+		var organization models.Organization
+		if err := db.First(&organization, "id = ?", c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+
+		var members []organizationMemberResponse
+		err := db.Table("organization_members").
+			Select("organization_members.user_id, custom_users.email, organization_members.role, organization_members.has_seat, organization_members.created_at").
+			Joins("JOIN custom_users ON custom_users.id = organization_members.user_id").
+			Where("organization_members.organization_id = ?", organization.ID).
+			Order("organization_members.created_at").
+			Scan(&members).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+			return
+		}
+
+		seats, err := purchasedSeats(db, organization.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch seats"})
+			return
+		}
+
+		var assigned int64
+		for _, member := range members {
+			if member.HasSeat {
+				assigned++
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"organization":   organization,
+			"members":        members,
+			"seats":          seats,
+			"seats_assigned": assigned,
+		})
+	}
+}
+
+func InviteOrganizationMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := findMembership(c, db)
+		if !ok {
+			return
+		}
+		if !member.CanManage() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var input struct {
+			Email string `json:"email" binding:"required,email"`
+			Role  string `json:"role" binding:"omitempty,oneof=admin member"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if input.Role == "" {
+			input.Role = models.OrganizationRoleMember
+		}
+		email := strings.ToLower(input.Email)
+
+		var existingMembers int64
+		db.Table("organization_members").
+			Joins("JOIN custom_users ON custom_users.id = organization_members.user_id").
+			Where("organization_members.organization_id = ? AND LOWER(custom_users.email) = ?", member.OrganizationID, email).
+			Count(&existingMembers)
+		if existingMembers > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "User is already a member of this organization"})
+			return
+		}
+
+		var existingInvitation models.OrganizationInvitation
+		if err := db.Where("organization_id = ? AND email = ? AND status = ? AND expires_at > ?", member.OrganizationID, email, models.InvitationStatusPending, time.Now()).First(&existingInvitation).Error; err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "An invitation is already pending for this email"})
+			return
+		}
+
+		invitation := models.OrganizationInvitation{
+			OrganizationID: member.OrganizationID,
+			Email:          email,
+			Role:           input.Role,
+			InvitedByID:    member.UserID,
+			Status:         models.InvitationStatusPending,
+			ExpiresAt:      time.Now().Add(invitationValidity),
+		}
+
+		var organization models.Organization
+		var inviter models.CustomUser
+		if err := db.First(&organization, member.OrganizationID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+		db.Select("email").First(&inviter, member.UserID)
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&invitation).Error; err != nil {
+				return err
+			}
+			return notify.Enqueue(tx, invitation.Email, notify.TemplateOrganizationInvitation, map[string]interface{}{
+				"OrganizationName": organization.Name,
+				"InvitedBy":        inviter.Email,
+				"Role":             invitation.Role,
+				"ExpiresAt":        formatEmailDate(invitation.ExpiresAt),
+			}, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, invitation)
+	}
+}
+
+func RevokeOrganizationInvitation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := findMembership(c, db)
+		if !ok {
+			return
+		}
+		if !member.CanManage() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		result := db.Model(&models.OrganizationInvitation{}).
+			Where("id = ? AND organization_id = ? AND status = ?", c.Param("invitation_id"), member.OrganizationID, models.InvitationStatusPending).
+			Update("status", models.InvitationStatusRevoked)
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invitation"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked successfully"})
+	}
+}
+
+// GetInvitations lists the pending invitations sent to the user's email.
+func GetInvitations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		var invitations []models.OrganizationInvitation
+		if err := db.Where("email = ? AND status = ? AND expires_at > ?", strings.ToLower(user.Email), models.InvitationStatusPending, time.Now()).
+			Order("created_at DESC").Find(&invitations).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+			return
+		}
+
+		c.JSON(http.StatusOK, invitations)
+	}
+}
+
+func AcceptInvitation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		var member models.OrganizationMember
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var invitation models.OrganizationInvitation
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id = ? AND status = ?", c.Param("id"), models.InvitationStatusPending).
+				First(&invitation).Error; err != nil {
+				return errInvitationNotFound
+			}
+			if !strings.EqualFold(invitation.Email, user.Email) {
+				return errInvitationNotFound
+			}
+			if time.Now().After(invitation.ExpiresAt) {
+				return errInvitationExpired
+			}
+
+			var existing int64
+			tx.Model(&models.OrganizationMember{}).Where("organization_id = ? AND user_id = ?", invitation.OrganizationID, user.ID).Count(&existing)
+			if existing > 0 {
+				return errAlreadyMember
+			}
+
+			member = models.OrganizationMember{
+				OrganizationID: invitation.OrganizationID,
+				UserID:         user.ID,
+				Role:           invitation.Role,
+			}
+			if err := tx.Create(&member).Error; err != nil {
+				return err
+			}
+
+			now := time.Now()
+			invitation.Status = models.InvitationStatusAccepted
+			invitation.AcceptedAt = &now
+			return tx.Save(&invitation).Error
+		})
+
+		switch {
+		case errors.Is(err, errInvitationNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+			return
+		case errors.Is(err, errInvitationExpired):
+			c.JSON(http.StatusGone, gin.H{"error": "Invitation has expired"})
+			return
+		case errors.Is(err, errAlreadyMember):
+			c.JSON(http.StatusConflict, gin.H{"error": "You are already a member of this organization"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Invitation accepted successfully",
+			"member":  member,
+		})
+	}
+}
+
+// UpdateOrganizationMember changes a member's role. Only the owner can do so.
+func UpdateOrganizationMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := findMembership(c, db)
+		if !ok {
+			return
+		}
+		if member.Role != models.OrganizationRoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var input struct {
+			Role string `json:"role" binding:"required,oneof=admin member"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+
+		result := db.Model(&models.OrganizationMember{}).
+			Where("organization_id = ? AND user_id = ? AND role != ?", member.OrganizationID, c.Param("user_id"), models.OrganizationRoleOwner).
+			Update("role", input.Role)
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Member updated successfully"})
+	}
+}
+
+// RemoveOrganizationMember removes a member, freeing their seat. Members can
+// remove themselves; the owner cannot be removed.
+func RemoveOrganizationMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := findMembership(c, db)
+		if !ok {
+			return
+		}
+		if !member.CanManage() && member.UserID.String() != c.Param("user_id") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		result := db.Where("organization_id = ? AND user_id = ? AND role != ?", member.OrganizationID, c.Param("user_id"), models.OrganizationRoleOwner).
+			Delete(&models.OrganizationMember{})
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+	}
+}
+
+// AssignOrganizationSeat gives a member one of the organization's seats, or
+// takes it back. Members with a seat inherit the organization's entitlements.
+func AssignOrganizationSeat(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		member, ok := findMembership(c, db)
+		if !ok {
+			return
+		}
+		if !member.CanManage() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var input struct {
+			Assigned *bool `json:"assigned" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+
+		var target models.OrganizationMember
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Lock the organization so concurrent assignments cannot exceed
+			// the number of seats
+			var organization models.Organization
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&organization, member.OrganizationID).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("organization_id = ? AND user_id = ?", member.OrganizationID, c.Param("user_id")).First(&target).Error; err != nil {
+				return err
+			}
+			if target.HasSeat == *input.Assigned {
+				return nil
+			}
+
+			if *input.Assigned {
+				seats, err := purchasedSeats(tx, organization.ID)
+				if err != nil {
+					return err
+				}
+				var assigned int64
+				if err := tx.Model(&models.OrganizationMember{}).Where("organization_id = ? AND has_seat = ?", organization.ID, true).Count(&assigned).Error; err != nil {
+					return err
+				}
+				if assigned >= seats {
+					return errNoSeatsAvailable
+				}
+			}
+
+			target.HasSeat = *input.Assigned
+			return tx.Model(&target).Update("has_seat", target.HasSeat).Error
+		})
+
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		case errors.Is(err, errNoSeatsAvailable):
+			c.JSON(http.StatusConflict, gin.H{"error": "All seats are assigned; buy more seats first"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update seat"})
+			return
+		}
+
+		c.JSON(http.StatusOK, target)
+	}
+}
@@ -0,0 +1,559 @@
+// handlers/override_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/saga"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/sub"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// compPlan is the plan of complimentary subscriptions granted by admins.
+// Like gifts they have no Stripe billing, and they are canceled once their
+// end date passes.
+const compPlan = "comp"
+
+var (
+	errOverrideCanceled        = errors.New("canceled subscriptions cannot be changed")
+	errOverrideScheduled       = errors.New("scheduled subscriptions cannot be changed until they start")
+	errOverrideNotTrialing     = errors.New("subscription is not in a trial")
+	errOverrideStripeShorten   = errors.New("the end date of a Stripe subscription can only be moved later")
+	errOverrideEndBeforeStart  = errors.New("the end date cannot be moved before the start date")
+	errOverrideEndDateNotInUse = errors.New("subscription has no end date to move")
+	errOverridePending         = errors.New("subscription is already being changed in Stripe")
+)
+
+// deferStripeBilling moves the end of a Stripe subscription's trial, and so
+// its next invoice, to until. Nothing is prorated, so the time until then is
+// free. A time that has passed ends the trial now.
+func deferStripeBilling(ctx context.Context, stripeID string, until time.Time, idempotencyKey string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		Params:            stripe.Params{Context: ctx},
+		ProrationBehavior: stripe.String("none"),
+	}
+	if until.After(time.Now()) {
+		params.TrialEnd = stripe.Int64(until.Unix())
+	} else {
+		params.TrialEndNow = stripe.Bool(true)
+	}
+	params.SetIdempotencyKey(idempotencyKey)
+	return sub.Update(stripeID, params)
+}
+
+// applyStripeBilling copies the trial end, period end and status Stripe
+// reports after a change onto the local subscription. A status the local
+// lifecycle does not allow is left for the reconcile job to sort out, as the
+// change has already been made in Stripe.
+func applyStripeBilling(subscription *models.Subscription, stripeSub *stripe.Subscription) {
+	if stripeSub.TrialEnd > 0 {
+		subscription.TrialEndDate = time.Unix(stripeSub.TrialEnd, 0)
+	}
+	if stripeSub.CurrentPeriodEnd > 0 {
+		subscription.EndDate = time.Unix(stripeSub.CurrentPeriodEnd, 0)
+	}
+	status := models.SubscriptionStatusFromStripe(string(stripeSub.Status))
+	if status == subscription.Status {
+		return
+	}
+	if err := subscription.TransitionTo(status); err != nil {
+		utils.Log("Not applying Stripe status of subscription", subscription.ID, ":", err)
+	}
+}
+
+// findOverrideSubscription loads the subscription in the :id parameter under
+// its account's lock, rejecting subscriptions admins cannot change.
+func findOverrideSubscription(c *gin.Context, tx *gorm.DB, subscription *models.Subscription) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return gorm.ErrRecordNotFound
+	}
+	if err := tx.First(subscription, "id = ?", id).Error; err != nil {
+		return err
+	}
+	if err := lockSubscriptions(tx, subscription.UserID, subscription.OrganizationID); err != nil {
+		return err
+	}
+	// Reload now that no other change can be in flight
+	if err := tx.First(subscription, "id = ?", subscription.ID).Error; err != nil {
+		return err
+	}
+
+	switch subscription.Status {
+	case models.SubscriptionStatusCanceled:
+		return errOverrideCanceled
+	case models.SubscriptionStatusScheduled:
+		return errOverrideScheduled
+	}
+	return nil
+}
+
+// adminSubscriptionResponse returns the admin view of a subscription, with
+// its user and product loaded.
+func adminSubscriptionResponse(db *gorm.DB, subscription models.Subscription) adminSubscriptionView {
+	var user models.CustomUser
+	db.First(&user, "id = ?", subscription.UserID)
+	var product models.Product
+	db.First(&product, "id = ?", subscription.ProductID)
+	return newAdminSubscriptionView(subscription, &user, product)
+}
+
+// respondOverrideError answers an override that failed for err.
+func respondOverrideError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+	case errors.Is(err, errOverrideCanceled), errors.Is(err, errOverrideScheduled), errors.Is(err, errOverrideNotTrialing), errors.Is(err, errOverridePending):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errOverrideStripeShorten), errors.Is(err, errOverrideEndBeforeStart), errors.Is(err, errOverrideEndDateNotInUse):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		utils.Log("Error applying subscription override:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription"})
+	}
+}
+
+// GrantCompSubscription gives a user free access to a product for a number of
+// days through a complimentary subscription, which has no Stripe billing.
+// A reason is required and kept in the subscription's history. Admin only.
+func GrantCompSubscription(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, adminID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var request struct {
+			ProductID uuid.UUID `json:"product_id" binding:"required"`
+			Days      int       `json:"days" binding:"required,min=1,max=3650"`
+			Reason    string    `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		reason := strings.TrimSpace(request.Reason)
+		if reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+			return
+		}
+
+		var user models.CustomUser
+		if err := db.First(&user, "id = ?", c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		var product models.Product
+		if err := db.First(&product, request.ProductID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if product.IsAddon() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Add-on products can only be added to an existing subscription"})
+			return
+		}
+
+		now := time.Now()
+		subscription := models.Subscription{
+			UserID:    user.ID,
+			ProductID: product.ID,
+			StartDate: now,
+			EndDate:   now.AddDate(0, 0, request.Days),
+			Status:    models.SubscriptionStatusActive,
+			Plan:      compPlan,
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := lockSubscriptions(tx, user.ID, nil); err != nil {
+				return err
+			}
+			if err := ensureNoLiveSubscription(tx, tx.Where("user_id = ? AND organization_id IS NULL", user.ID), contextActorID(c), models.EventSourceAdmin); err != nil {
+				return err
+			}
+
+			if err := tx.Create(&subscription).Error; err != nil {
+				return err
+			}
+			return recordAdminOverride(tx, models.SubscriptionEventCreated, nil, subscription, contextActorID(c), reason)
+		})
+		if errors.Is(err, errAlreadySubscribed) || isLiveSubscriptionConflict(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active subscription"})
+			return
+		}
+		if err != nil {
+			utils.Log("Error granting complimentary subscription:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant complimentary subscription"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":      "Complimentary subscription granted successfully",
+			"subscription": newAdminSubscriptionView(subscription, &user, product),
+		})
+	}
+}
+
+// startBillingOverride records a billing operation that applies an override
+// to a Stripe subscription: Stripe is updated by a worker, outside the
+// subscription's lock, and the override is recorded once Stripe accepted it.
+// Only one such operation may run for a subscription at a time.
+func startBillingOverride(tx *gorm.DB, c *gin.Context, kind string, subscription models.Subscription, input billingOverrideInput) (*models.BillingOperation, error) {
+	var pending int64
+	if err := tx.Model(&models.BillingOperation{}).
+		Where("subscription_id = ? AND kind IN ? AND status IN ?", subscription.ID,
+			[]string{billingOperationExtendTrial, billingOperationShiftEndDate},
+			[]string{models.BillingOperationStatusPending, models.BillingOperationStatusRunning, models.BillingOperationStatusCompensating}).
+		Count(&pending).Error; err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		return nil, errOverridePending
+	}
+
+	operation := &models.BillingOperation{
+		Kind:           kind,
+		UserID:         *contextActorID(c),
+		OrganizationID: subscription.OrganizationID,
+		SubscriptionID: &subscription.ID,
+	}
+	return operation, saga.Start(tx, operation, input)
+}
+
+// ExtendTrial moves the end of a subscription's trial a number of days later,
+// counted from now if the trial has already ended. A paused trial without
+// Stripe billing is resumed. Trials billed in Stripe are extended by a
+// billing operation and the response is 202 Accepted. A reason is required
+// and kept in the subscription's history. Admin only.
+func ExtendTrial(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, adminID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var request struct {
+			Days   int    `json:"days" binding:"required,min=1,max=3650"`
+			Reason string `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		reason := strings.TrimSpace(request.Reason)
+		if reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+			return
+		}
+
+		var subscription models.Subscription
+		var operation *models.BillingOperation
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := findOverrideSubscription(c, tx, &subscription); err != nil {
+				return err
+			}
+			trialing := subscription.Status == models.SubscriptionStatusTrialing
+			lapsedTrial := subscription.IsLapsedTrial()
+			if !trialing && !lapsedTrial {
+				return errOverrideNotTrialing
+			}
+
+			from := subscription.TrialEndDate
+			if from.Before(time.Now()) {
+				from = time.Now()
+			}
+			trialEnd := from.AddDate(0, 0, request.Days)
+
+			if subscription.StripeID != "" {
+				var err error
+				operation, err = startBillingOverride(tx, c, billingOperationExtendTrial, subscription, billingOverrideInput{
+					StripeID: subscription.StripeID,
+					Until:    trialEnd,
+					Previous: subscription.TrialEndDate,
+					Reason:   reason,
+				})
+				return err
+			}
+
+			before := subscription.Snapshot()
+			subscription.TrialEndDate = trialEnd
+			if lapsedTrial {
+				if err := subscription.TransitionTo(models.SubscriptionStatusTrialing); err != nil {
+					return err
+				}
+			}
+			// Warn about the new trial end again
+			subscription.TrialReminderSentAt = nil
+
+			if err := tx.Omit(clause.Associations).Save(&subscription).Error; err != nil {
+				return err
+			}
+			return recordAdminOverride(tx, models.SubscriptionEventTrialExtended, &before, subscription, contextActorID(c), reason)
+		})
+		if err != nil {
+			respondOverrideError(c, err)
+			return
+		}
+
+		if operation != nil {
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":   "Trial is being extended",
+				"operation": operation,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Trial extended successfully",
+			"subscription": adminSubscriptionResponse(db, subscription),
+		})
+	}
+}
+
+// ShiftEndDate moves a subscription's end date by a number of days, earlier
+// or later. Stripe subscriptions can only be moved later: Stripe's billing
+// period cannot be set directly, so their next invoice is deferred with a
+// trial until the new end date, by a billing operation, and the response is
+// 202 Accepted. Stripe reports them as trialing until then, but they keep
+// their status here, with BillingDeferredUntil set, so that they are not
+// counted or notified as trials. A reason is required and kept in the
+// subscription's history. Admin only.
+func ShiftEndDate(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, adminID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var request struct {
+			Days   int    `json:"days" binding:"required,min=-3650,max=3650"` // Negative to move it earlier
+			Reason string `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		reason := strings.TrimSpace(request.Reason)
+		if reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+			return
+		}
+
+		var subscription models.Subscription
+		var operation *models.BillingOperation
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := findOverrideSubscription(c, tx, &subscription); err != nil {
+				return err
+			}
+			if subscription.EndDate.IsZero() {
+				return errOverrideEndDateNotInUse
+			}
+
+			endDate := subscription.EndDate.AddDate(0, 0, request.Days)
+			if !endDate.After(subscription.StartDate) {
+				return errOverrideEndBeforeStart
+			}
+
+			if subscription.StripeID != "" {
+				if request.Days < 0 || !endDate.After(time.Now()) {
+					return errOverrideStripeShorten
+				}
+				var err error
+				operation, err = startBillingOverride(tx, c, billingOperationShiftEndDate, subscription, billingOverrideInput{
+					StripeID: subscription.StripeID,
+					Until:    endDate,
+					Previous: subscription.EndDate,
+					Reason:   reason,
+				})
+				return err
+			}
+
+			before := subscription.Snapshot()
+			subscription.EndDate = endDate
+			// Remind about the new renewal date again
+			subscription.RenewalReminderSentAt = nil
+
+			if err := tx.Omit(clause.Associations).Save(&subscription).Error; err != nil {
+				return err
+			}
+			return recordAdminOverride(tx, models.SubscriptionEventEndDateChanged, &before, subscription, contextActorID(c), reason)
+		})
+		if err != nil {
+			respondOverrideError(c, err)
+			return
+		}
+
+		if operation != nil {
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":   "End date is being moved",
+				"operation": operation,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "End date moved successfully",
+			"subscription": adminSubscriptionResponse(db, subscription),
+		})
+	}
+}
+
+// billingOverrideInput is the input of an extend_trial or shift_end_date
+// operation: the Stripe subscription, the trial end or end date it moves to,
+// and the one it had, which is restored if the override cannot be recorded.
+type billingOverrideInput struct {
+	StripeID string    `json:"stripe_id"`
+	Until    time.Time `json:"until"`
+	Previous time.Time `json:"previous"`
+	Reason   string    `json:"reason"`
+}
+
+// billingOverrideSaga defers the Stripe subscription's billing and then
+// records the override on the subscription.
+func billingOverrideSaga(db *gorm.DB, kind string) saga.Saga {
+	return saga.Saga{
+		Kind: kind,
+		Steps: []saga.Step{
+			{Name: "billing", Run: deferOperationBilling, Compensate: restoreOperationBilling},
+			{Name: "record", Run: recordOperationOverride(db, kind)},
+		},
+	}
+}
+
+func deferOperationBilling(ctx context.Context, op *saga.Operation) error {
+	if op.Get("stripe_status") != "" {
+		return nil
+	}
+
+	var input billingOverrideInput
+	if err := op.DecodeInput(&input); err != nil {
+		return saga.Abort(err)
+	}
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	stripeSub, err := deferStripeBilling(ctx, input.StripeID, input.Until, op.IdempotencyKey())
+	if err != nil {
+		return stripeStepError(err)
+	}
+
+	op.Set("trial_end", strconv.FormatInt(stripeSub.TrialEnd, 10))
+	op.Set("current_period_end", strconv.FormatInt(stripeSub.CurrentPeriodEnd, 10))
+	op.Set("stripe_status", string(stripeSub.Status))
+	return nil
+}
+
+// restoreOperationBilling moves the Stripe trial end back to where it was, if
+// the operation moved it.
+func restoreOperationBilling(ctx context.Context, op *saga.Operation) error {
+	var input billingOverrideInput
+	if err := op.DecodeInput(&input); err != nil {
+		return err
+	}
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	stripeSub, err := sub.Get(input.StripeID, &stripe.SubscriptionParams{Params: stripe.Params{Context: ctx}})
+	if err != nil {
+		if isStripeResourceMissing(err) {
+			return nil
+		}
+		return err
+	}
+	if stripeSub.Status == stripe.SubscriptionStatusCanceled || stripeSub.TrialEnd != input.Until.Unix() {
+		return nil
+	}
+
+	_, err = deferStripeBilling(ctx, input.StripeID, input.Previous, op.IdempotencyKey()+":restore")
+	return err
+}
+
+// recordOperationOverride applies the dates Stripe returned to the
+// subscription and records the override with the admin and reason.
+func recordOperationOverride(db *gorm.DB, kind string) func(ctx context.Context, op *saga.Operation) error {
+	return func(ctx context.Context, op *saga.Operation) error {
+		var input billingOverrideInput
+		if err := op.DecodeInput(&input); err != nil {
+			return saga.Abort(err)
+		}
+		trialEnd, _ := strconv.ParseInt(op.Get("trial_end"), 10, 64)
+		periodEnd, _ := strconv.ParseInt(op.Get("current_period_end"), 10, 64)
+
+		return db.Transaction(func(tx *gorm.DB) error {
+			var subscription models.Subscription
+			if err := tx.First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+			if err := lockSubscriptions(tx, subscription.UserID, subscription.OrganizationID); err != nil {
+				return err
+			}
+			if err := tx.First(&subscription, op.SubscriptionID).Error; err != nil {
+				return err
+			}
+			if subscription.Status == models.SubscriptionStatusCanceled {
+				return nil // Nothing left to change
+			}
+
+			before := subscription.Snapshot()
+			eventType := models.SubscriptionEventTrialExtended
+			if kind == billingOperationShiftEndDate {
+				endDate := input.Until
+				if periodEnd > 0 {
+					endDate = time.Unix(periodEnd, 0)
+				}
+				if subscription.BillingDeferredUntil != nil && subscription.BillingDeferredUntil.Unix() == endDate.Unix() {
+					return nil // Recorded by an earlier run
+				}
+				subscription.EndDate = endDate
+				subscription.BillingDeferredUntil = &endDate
+				// Remind about the new renewal date again
+				subscription.RenewalReminderSentAt = nil
+				eventType = models.SubscriptionEventEndDateChanged
+			} else {
+				if subscription.TrialEndDate.Unix() == trialEnd {
+					return nil // Recorded by an earlier run
+				}
+				applyStripeBilling(&subscription, &stripe.Subscription{
+					TrialEnd:         trialEnd,
+					CurrentPeriodEnd: periodEnd,
+					Status:           stripe.SubscriptionStatus(op.Get("stripe_status")),
+				})
+				// Warn about the new trial end again
+				subscription.TrialReminderSentAt = nil
+			}
+
+			if err := tx.Omit(clause.Associations).Save(&subscription).Error; err != nil {
+				return err
+			}
+			return recordAdminOverride(tx, eventType, &before, subscription, &op.UserID, input.Reason)
+		})
+	}
+}
+
+// ExpirePrepaidSubscriptions cancels complimentary and gift subscriptions
+// whose end date has passed. They have no Stripe billing to end them, and
+// would otherwise keep their account from subscribing again.
+func ExpirePrepaidSubscriptions(db *gorm.DB) error {
+	var subscriptions []models.Subscription
+	if err := db.Where("plan IN ? AND status != ? AND end_date < ?", []string{compPlan, giftPlan}, models.SubscriptionStatusCanceled, time.Now()).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		if err := transitionSubscription(db, &subscription, subscription.Snapshot(), models.SubscriptionStatusCanceled, nil, models.EventSourceJob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
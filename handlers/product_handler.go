@@ -2,6 +2,7 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
 	"os"
 
@@ -28,54 +29,94 @@ func GetProducts(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func createStripeProduct(name string, description string, monthlyPrice float64, yearlyPrice float64) (*models.Product, error) {
+// createStripeProduct creates the product and its prices in Stripe. A price is
+// only created for the amounts that are set. When idempotencyKey is set each
+// Stripe call is made idempotent so that a retried request does not create
+// duplicates.
+func createStripeProduct(ctx context.Context, name string, description string, monthlyPrice float64, yearlyPrice float64, oneTimePrice float64, idempotencyKey string) (*models.Product, error) {
 	// Create the product in Stripe
 	params := &stripe.ProductParams{
+		Params:      stripe.Params{Context: ctx},
 		Name:        stripe.String(name),
 		Description: stripe.String(description),
 	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey + ":product")
+	}
 	stripeProduct, err := product.New(params)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create monthly price
-	monthlyPriceParams := &stripe.PriceParams{
-		Product:    stripe.String(stripeProduct.ID),
-		UnitAmount: stripe.Int64(int64(monthlyPrice * 100)), // Stripe uses cents
-		Currency:   stripe.String(string(stripe.CurrencyUSD)),
-		Recurring: &stripe.PriceRecurringParams{
-			Interval: stripe.String(string(stripe.PriceRecurringIntervalMonth)),
-		},
+	// Create the product in your database
+	product := &models.Product{
+		ID:              uuid.New(),
+		Name:            name,
+		Description:     description,
+		MonthlyPrice:    monthlyPrice,
+		YearlyPrice:     yearlyPrice,
+		OneTimePrice:    oneTimePrice,
+		StripeProductID: stripeProduct.ID,
 	}
-	monthlyStripePrice, err := price.New(monthlyPriceParams)
-	if err != nil {
-		return nil, err
+
+	// Create monthly price
+	if monthlyPrice > 0 {
+		monthlyPriceParams := &stripe.PriceParams{
+			Params:     stripe.Params{Context: ctx},
+			Product:    stripe.String(stripeProduct.ID),
+			UnitAmount: stripe.Int64(int64(monthlyPrice * 100)), // Stripe uses cents
+			Currency:   stripe.String(string(stripe.CurrencyUSD)),
+			Recurring: &stripe.PriceRecurringParams{
+				Interval: stripe.String(string(stripe.PriceRecurringIntervalMonth)),
+			},
+		}
+		if idempotencyKey != "" {
+			monthlyPriceParams.SetIdempotencyKey(idempotencyKey + ":monthly-price")
+		}
+		monthlyStripePrice, err := price.New(monthlyPriceParams)
+		if err != nil {
+			return nil, err
+		}
+		product.StripeMonthlyPriceID = monthlyStripePrice.ID
 	}
 
 	// Create yearly price
-	yearlyPriceParams := &stripe.PriceParams{
-		Product:    stripe.String(stripeProduct.ID),
-		UnitAmount: stripe.Int64(int64(yearlyPrice * 100)), // Stripe uses cents
-		Currency:   stripe.String(string(stripe.CurrencyUSD)),
-		Recurring: &stripe.PriceRecurringParams{
-			Interval: stripe.String(string(stripe.PriceRecurringIntervalYear)),
-		},
-	}
-	yearlyStripePrice, err := price.New(yearlyPriceParams)
-	if err != nil {
-		return nil, err
+	if yearlyPrice > 0 {
+		yearlyPriceParams := &stripe.PriceParams{
+			Params:     stripe.Params{Context: ctx},
+			Product:    stripe.String(stripeProduct.ID),
+			UnitAmount: stripe.Int64(int64(yearlyPrice * 100)), // Stripe uses cents
+			Currency:   stripe.String(string(stripe.CurrencyUSD)),
+			Recurring: &stripe.PriceRecurringParams{
+				Interval: stripe.String(string(stripe.PriceRecurringIntervalYear)),
+			},
+		}
+		if idempotencyKey != "" {
+			yearlyPriceParams.SetIdempotencyKey(idempotencyKey + ":yearly-price")
+		}
+		yearlyStripePrice, err := price.New(yearlyPriceParams)
+		if err != nil {
+			return nil, err
+		}
+		product.StripeYearlyPriceID = yearlyStripePrice.ID
 	}
 
-	// Create the product in your database
-	product := &models.Product{
-		ID:                   uuid.New(),
-		Name:                 name,
-		Description:          description,
-		MonthlyPrice:         monthlyPrice,
-		YearlyPrice:          yearlyPrice,
-		StripeMonthlyPriceID: monthlyStripePrice.ID,
-		StripeYearlyPriceID:  yearlyStripePrice.ID,
+	// Create one-time price
+	if oneTimePrice > 0 {
+		oneTimePriceParams := &stripe.PriceParams{
+			Params:     stripe.Params{Context: ctx},
+			Product:    stripe.String(stripeProduct.ID),
+			UnitAmount: stripe.Int64(int64(oneTimePrice * 100)), // Stripe uses cents
+			Currency:   stripe.String(string(stripe.CurrencyUSD)),
+		}
+		if idempotencyKey != "" {
+			oneTimePriceParams.SetIdempotencyKey(idempotencyKey + ":one-time-price")
+		}
+		oneTimeStripePrice, err := price.New(oneTimePriceParams)
+		if err != nil {
+			return nil, err
+		}
+		product.StripeOneTimePriceID = oneTimeStripePrice.ID
 	}
 
 	return product, nil
@@ -104,10 +145,14 @@ func CreateProductHandler(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		var input struct {
-			Name         string  `json:"name" binding:"required"`
-			Description  string  `json:"description" binding:"required"`
-			MonthlyPrice float64 `json:"monthly_price" binding:"required"`
-			YearlyPrice  float64 `json:"yearly_price" binding:"required"`
+			Name                 string      `json:"name" binding:"required"`
+			Description          string      `json:"description" binding:"required"`
+			MonthlyPrice         float64     `json:"monthly_price" binding:"omitempty,gt=0"`
+			YearlyPrice          float64     `json:"yearly_price" binding:"omitempty,gt=0"`
+			OneTimePrice         float64     `json:"one_time_price" binding:"omitempty,gt=0"`
+			LifetimeAccess       bool        `json:"lifetime_access"`
+			Kind                 string      `json:"kind" binding:"omitempty,oneof=base addon"`
+			CompatibleProductIDs []uuid.UUID `json:"compatible_product_ids"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -115,14 +160,60 @@ func CreateProductHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		product, err := createStripeProduct(input.Name, input.Description, input.MonthlyPrice, input.YearlyPrice)
+		// Recurring products need both prices; one-time products may skip them
+		recurring := input.MonthlyPrice > 0 || input.YearlyPrice > 0
+		if (recurring || input.OneTimePrice == 0) && (input.MonthlyPrice == 0 || input.YearlyPrice == 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Monthly and yearly prices are required unless the product is only sold once"})
+			return
+		}
+		if input.LifetimeAccess && input.OneTimePrice == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Lifetime access requires a one-time price"})
+			return
+		}
+
+		if input.Kind == "" {
+			input.Kind = models.ProductKindBase
+		}
+		if len(input.CompatibleProductIDs) > 0 {
+			if input.Kind != models.ProductKindAddon {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Only add-on products can have compatible products"})
+				return
+			}
+
+			var baseCount int64
+			if err := db.Model(&models.Product{}).Where("id IN ? AND kind = ?", input.CompatibleProductIDs, models.ProductKindBase).Count(&baseCount).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+				return
+			}
+			if baseCount != int64(len(input.CompatibleProductIDs)) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Compatible products must be existing base products"})
+				return
+			}
+		}
+
+		product, err := createStripeProduct(c.Request.Context(), input.Name, input.Description, input.MonthlyPrice, input.YearlyPrice, input.OneTimePrice, stripeIdempotencyKey(c, "create-product"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
+			respondStripeError(c, err, "Failed to create product")
 			return
 		}
 
-		// Save product to database (assuming a SaveProduct function exists)
-		if err := db.Create(product).Error; err != nil {
+		product.Kind = input.Kind
+		product.LifetimeAccess = input.LifetimeAccess
+
+		// Save the product together with its compatibility rules
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(product).Error; err != nil {
+				return err
+			}
+			for _, baseID := range input.CompatibleProductIDs {
+				rule := models.AddonCompatibility{AddonProductID: product.ID, BaseProductID: baseID}
+				if err := tx.Create(&rule).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save product", "details": err.Error()})
 			return
 		}
@@ -0,0 +1,222 @@
+// handlers/purchase_handler.go
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/checkout/session"
+)
+
+func PurchaseProduct(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		userID, _ := c.Get("user_id")
+
+		var purchaseRequest struct {
+			ProductID  uuid.UUID `json:"product_id" binding:"required"`
+			SuccessURL string    `json:"success_url" binding:"required,url"`
+			CancelURL  string    `json:"cancel_url" binding:"required,url"`
+		}
+
+		if err := c.ShouldBindJSON(&purchaseRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var product models.Product
+		if err := db.First(&product, purchaseRequest.ProductID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if !product.IsOneTime() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product cannot be bought with a one-time payment"})
+			return
+		}
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if product.LifetimeAccess && HasLifetimeAccess(db, user.ID, product.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has lifetime access to this product"})
+			return
+		}
+
+		purchase := models.Purchase{
+			UserID:    user.ID,
+			ProductID: product.ID,
+			Amount:    product.OneTimePrice,
+			Currency:  string(stripe.CurrencyUSD),
+			Status:    models.PurchaseStatusPending,
+			Lifetime:  product.LifetimeAccess,
+		}
+
+		if err := db.Create(&purchase).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create purchase"})
+			return
+		}
+
+		// Create a Checkout Session in payment mode. The purchase is completed
+		// by the checkout.session.completed webhook.
+		params := &stripe.CheckoutSessionParams{
+			Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
+			CustomerEmail:     stripe.String(user.Email),
+			ClientReferenceID: stripe.String(purchase.ID.String()),
+			SuccessURL:        stripe.String(purchaseRequest.SuccessURL),
+			CancelURL:         stripe.String(purchaseRequest.CancelURL),
+			LineItems: []*stripe.CheckoutSessionLineItemParams{
+				{
+					Price:    stripe.String(product.StripeOneTimePriceID),
+					Quantity: stripe.Int64(1),
+				},
+			},
+			Metadata: map[string]string{
+				"purchase_id": purchase.ID.String(),
+			},
+		}
+		if key := stripeIdempotencyKey(c, "checkout-session"); key != "" {
+			params.SetIdempotencyKey(key)
+		}
+		params.Context = c.Request.Context()
+		checkoutSession, err := session.New(params)
+		if err != nil {
+			db.Delete(&purchase)
+			respondStripeError(c, err, "Failed to create Stripe checkout session")
+			return
+		}
+
+		purchase.StripeCheckoutSessionID = checkoutSession.ID
+		if err := db.Save(&purchase).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":      "Checkout session created successfully",
+			"purchase":     purchase,
+			"checkout_url": checkoutSession.URL,
+		})
+	}
+}
+
+func GetPurchases(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var purchases []models.Purchase
+		if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&purchases).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purchases"})
+			return
+		}
+
+		c.JSON(http.StatusOK, purchases)
+	}
+}
+
+// completePurchase marks the purchase behind a completed Checkout Session as
+// paid.
+func completePurchase(db *gorm.DB, checkoutSession *stripe.CheckoutSession) error {
+	var purchase models.Purchase
+	if err := db.Where("stripe_checkout_session_id = ?", checkoutSession.ID).First(&purchase).Error; err != nil {
+		return err
+	}
+
+	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid || purchase.Status == models.PurchaseStatusPaid {
+		return nil
+	}
+
+	now := time.Now()
+	purchase.Status = models.PurchaseStatusPaid
+	purchase.PaidAt = &now
+	if checkoutSession.PaymentIntent != nil {
+		purchase.StripePaymentIntentID = checkoutSession.PaymentIntent.ID
+	}
+
+	return db.Save(&purchase).Error
+}
+
+// HasLifetimeAccess reports whether the user owns a paid lifetime purchase of
+// the product.
+func HasLifetimeAccess(db *gorm.DB, userID uuid.UUID, productID uuid.UUID) bool {
+	var count int64
+	db.Model(&models.Purchase{}).
+		Where("user_id = ? AND product_id = ? AND lifetime = ? AND status = ?", userID, productID, true, models.PurchaseStatusPaid).
+		Count(&count)
+	return count > 0
+}
+
+// HasProductAccess reports whether the user may use the product, either
+// through an active subscription or a lifetime purchase.
+func HasProductAccess(db *gorm.DB, userID uuid.UUID, productID uuid.UUID) bool {
+	return productAccessSource(db, userID, productID) != ""
+}
+
+// productAccessSource returns "subscription", "organization" or "lifetime"
+// depending on what grants the user access to the product, or an empty string
+// without access.
+func productAccessSource(db *gorm.DB, userID uuid.UUID, productID uuid.UUID) string {
+	var count int64
+	db.Model(&models.Subscription{}).
+		Where("user_id = ? AND organization_id IS NULL AND product_id = ? AND status IN ?", userID, productID, models.GrantingSubscriptionStatuses).
+		Count(&count)
+	if count > 0 {
+		return "subscription"
+	}
+
+	// Seats on an organization's subscription grant access too
+	db.Model(&models.Subscription{}).
+		Joins("JOIN organization_members ON organization_members.organization_id = subscriptions.organization_id").
+		Where("organization_members.user_id = ? AND organization_members.has_seat = ?", userID, true).
+		Where("subscriptions.product_id = ? AND subscriptions.status IN ?", productID, models.GrantingSubscriptionStatuses).
+		Count(&count)
+	if count > 0 {
+		return "organization"
+	}
+
+	if HasLifetimeAccess(db, userID, productID) {
+		return "lifetime"
+	}
+
+	return ""
+}
+
+func GetProductAccess(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		productID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID format"})
+			return
+		}
+
+		source := productAccessSource(db, id, productID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"product_id": productID,
+			"has_access": source != "",
+			"source":     source,
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// handlers/queue_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// GetQueuedJobs lists queued jobs, oldest due first, optionally filtered by
+// status and kind. Admin only.
+func GetQueuedJobs(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		query := db.Order("run_at").Limit(100)
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if kind := c.Query("kind"); kind != "" {
+			query = query.Where("kind = ?", kind)
+		}
+
+		var queued []models.QueuedJob
+		if err := query.Find(&queued).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+			return
+		}
+
+		c.JSON(http.StatusOK, queued)
+	}
+}
+
+// GetQueuedJob returns a single queued job. Admin only.
+func GetQueuedJob(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		jobID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+			return
+		}
+
+		var job models.QueuedJob
+		if err := db.First(&job, "id = ?", jobID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// RetryQueuedJob runs a dead, discarded or pending job again now, with a fresh
+// set of attempts. Admin only.
+func RetryQueuedJob(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		jobID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+			return
+		}
+
+		job, err := jobs.Retry(db, jobID)
+		if err != nil {
+			respondQueueError(c, err, "Failed to retry job")
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// DiscardQueuedJob takes a job off the queue without running it. Admin only.
+func DiscardQueuedJob(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		jobID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+			return
+		}
+
+		job, err := jobs.Discard(db, jobID)
+		if err != nil {
+			respondQueueError(c, err, "Failed to discard job")
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+func respondQueueError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	case errors.Is(err, jobs.ErrJobRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is running"})
+	case errors.Is(err, jobs.ErrJobNotFailed):
+		c.JSON(http.StatusConflict, gin.H{"error": "Only dead or discarded jobs can be retried"})
+	case errors.Is(err, jobs.ErrDuplicateJob):
+		c.JSON(http.StatusConflict, gin.H{"error": "Another job with the same unique key is queued"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
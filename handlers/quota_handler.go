@@ -0,0 +1,125 @@
+// handlers/quota_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/entitlements"
+	"github.com/yeboahd24/subscription-stripe/middleware"
+	"github.com/yeboahd24/subscription-stripe/quota"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetUsage lists the user's usage against the limit of every feature their
+// plan grants, for the current billing period.
+func GetUsage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		grants, err := entitlements.ForUser(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve entitlements"})
+			return
+		}
+
+		response := make([]quota.Usage, 0, len(grants))
+		for _, grant := range grants {
+			usage, err := quota.Check(db, id, grant)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+				return
+			}
+			response = append(response, usage)
+		}
+		sort.Slice(response, func(i, j int) bool { return response[i].Feature < response[j].Feature })
+
+		c.JSON(http.StatusOK, gin.H{"usage": response})
+	}
+}
+
+func GetFeatureUsage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		grants, err := entitlements.ForUser(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve entitlements"})
+			return
+		}
+
+		grant, ok := grants[c.Param("feature")]
+		if !ok {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Your plan does not include this feature", "feature": c.Param("feature")})
+			return
+		}
+
+		usage, err := quota.Check(db, id, grant)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+			return
+		}
+
+		c.JSON(http.StatusOK, usage)
+	}
+}
+
+// RecordUsage consumes units of a feature's quota, for usage that happens
+// outside this API.
+func RecordUsage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var input struct {
+			Amount int64 `json:"amount" binding:"required,gt=0"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+
+		grants, err := entitlements.ForUser(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve entitlements"})
+			return
+		}
+
+		grant, ok := grants[c.Param("feature")]
+		if !ok {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Your plan does not include this feature", "feature": c.Param("feature")})
+			return
+		}
+
+		usage, err := quota.Increment(db, id, grant, input.Amount)
+		if errors.Is(err, quota.ErrQuotaExceeded) {
+			middleware.QuotaExceeded(c, usage)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update usage"})
+			return
+		}
+
+		c.JSON(http.StatusOK, usage)
+	}
+}
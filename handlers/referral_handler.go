@@ -0,0 +1,270 @@
+// handlers/referral_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/customerbalancetransaction"
+	"github.com/stripe/stripe-go/v72/sub"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// referralSettings configures the referral program. They are read from the
+// environment:
+//
+//	REFERRAL_REWARD_TYPE    "balance" (default) credits the referrer's Stripe
+//	                        customer balance, "coupon" applies a coupon to the
+//	                        referrer's subscription
+//	REFERRAL_CREDIT_AMOUNT  balance credit in cents; defaults to one month of
+//	                        the plan the referred user bought
+//	REFERRAL_COUPON_ID      Stripe coupon for "coupon" rewards
+//	REFERRAL_MAX_CREDITS    cap on rewarded referrals per referrer (default 12)
+type referralSettings struct {
+	RewardType   string
+	CreditAmount int64
+	CouponID     string
+	MaxCredits   int64
+}
+
+func loadReferralSettings() referralSettings {
+	settings := referralSettings{
+		RewardType: os.Getenv("REFERRAL_REWARD_TYPE"),
+		CouponID:   os.Getenv("REFERRAL_COUPON_ID"),
+		MaxCredits: 12,
+	}
+	if settings.RewardType != "coupon" {
+		settings.RewardType = "balance"
+	}
+	if amount, err := strconv.ParseInt(os.Getenv("REFERRAL_CREDIT_AMOUNT"), 10, 64); err == nil && amount > 0 {
+		settings.CreditAmount = amount
+	}
+	if max, err := strconv.ParseInt(os.Getenv("REFERRAL_MAX_CREDITS"), 10, 64); err == nil && max >= 0 {
+		settings.MaxCredits = max
+	}
+	return settings
+}
+
+var errInvalidReferralCode = errors.New("invalid referral code")
+
+// ensureReferralCode gives the user a referral code if they do not have one.
+func ensureReferralCode(db *gorm.DB, user *models.CustomUser) error {
+	if user.ReferralCode != nil {
+		return nil
+	}
+
+	code, err := utils.GenerateCode("REF", 2)
+	if err != nil {
+		return err
+	}
+	user.ReferralCode = &code
+
+	return db.Model(user).Update("referral_code", code).Error
+}
+
+// recordReferral links a newly registered user to the owner of the referral
+// code. Self-referrals, detected by comparing normalized email addresses, are
+// recorded as rejected so they can be audited but never earn a reward.
+func recordReferral(tx *gorm.DB, user *models.CustomUser, code string) error {
+	var referrer models.CustomUser
+	if err := tx.Where("referral_code = ?", code).First(&referrer).Error; err != nil {
+		return errInvalidReferralCode
+	}
+
+	referral := models.Referral{
+		ReferrerID:     referrer.ID,
+		ReferredUserID: user.ID,
+		Code:           code,
+		Status:         models.ReferralStatusPending,
+	}
+	if utils.NormalizeEmail(referrer.Email) == utils.NormalizeEmail(user.Email) {
+		referral.Status = models.ReferralStatusRejected
+		referral.RejectReason = "self_referral"
+	} else {
+		user.ReferredByID = &referrer.ID
+		if err := tx.Model(user).Update("referred_by_id", referrer.ID).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&referral).Error
+}
+
+// convertReferral rewards the referrer once the first invoice of a referred
+// user's subscription is paid, so that trials which never pay earn nothing.
+// The referrer's row is locked while the cap is checked and the reward
+// recorded, so concurrent conversions cannot exceed REFERRAL_MAX_CREDITS.
+// Failures are logged rather than returned so that they never fail the
+// webhook; the referral stays pending and the next paid invoice retries it.
+func convertReferral(ctx context.Context, db *gorm.DB, subscription models.Subscription) {
+	var product models.Product
+	if err := db.First(&product, subscription.ProductID).Error; err != nil {
+		utils.Log("Error fetching referred product:", err)
+		return
+	}
+	settings := loadReferralSettings()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var referral models.Referral
+		if err := tx.Where("referred_user_id = ? AND status = ?", subscription.UserID, models.ReferralStatusPending).First(&referral).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		var referrer models.CustomUser
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&referrer, referral.ReferrerID).Error; err != nil {
+			return err
+		}
+		// Another delivery of the invoice may have converted it while we waited
+		if err := tx.First(&referral, referral.ID).Error; err != nil {
+			return err
+		}
+		if referral.Status != models.ReferralStatusPending {
+			return nil
+		}
+
+		now := time.Now()
+		referral.SubscriptionID = &subscription.ID
+		referral.ConvertedAt = &now
+
+		var rewarded int64
+		if err := tx.Model(&models.Referral{}).Where("referrer_id = ? AND status = ?", referral.ReferrerID, models.ReferralStatusConverted).Count(&rewarded).Error; err != nil {
+			return err
+		}
+		if rewarded >= settings.MaxCredits {
+			referral.Status = models.ReferralStatusCapped
+			return tx.Save(&referral).Error
+		}
+
+		if err := rewardReferrer(ctx, tx, &referrer, &referral, settings, product); err != nil {
+			return err
+		}
+		referral.Status = models.ReferralStatusConverted
+		return tx.Save(&referral).Error
+	})
+	if err != nil {
+		utils.Log("Error converting referral:", err)
+	}
+}
+
+// convertInvoiceReferral converts the pending referral of the user behind a
+// Stripe subscription whose invoice was paid.
+func convertInvoiceReferral(ctx context.Context, db *gorm.DB, stripeSubscriptionID string) error {
+	var subscription models.Subscription
+	if err := db.Where("stripe_id = ?", stripeSubscriptionID).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	convertReferral(ctx, db, subscription)
+	return nil
+}
+
+// rewardReferrer applies the configured coupon to the referrer's paid
+// subscription, or credits their Stripe customer balance. Coupon rewards fall
+// back to a balance credit when the referrer has no paid subscription.
+func rewardReferrer(ctx context.Context, db *gorm.DB, referrer *models.CustomUser, referral *models.Referral, settings referralSettings, product models.Product) error {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	if settings.RewardType == "coupon" && settings.CouponID != "" {
+		var referrerSubscription models.Subscription
+		err := db.Where("user_id = ? AND organization_id IS NULL AND status = ? AND stripe_id != ''", referrer.ID, models.SubscriptionStatusActive).Last(&referrerSubscription).Error
+		if err == nil {
+			_, err := sub.Update(referrerSubscription.StripeID, &stripe.SubscriptionParams{
+				Params: stripe.Params{Context: ctx},
+				Coupon: stripe.String(settings.CouponID),
+			})
+			if err != nil {
+				return err
+			}
+			referral.RewardType = "coupon"
+			referral.StripeReference = settings.CouponID
+			return nil
+		}
+	}
+
+	amount := settings.CreditAmount
+	if amount == 0 {
+		amount = int64(math.Round(product.MonthlyPrice * 100)) // Stripe uses cents
+	}
+
+	// Keyed so a retry after a rollback finds the same customer
+	customerID, err := ensureStripeCustomer(ctx, db, referrer, "referral-customer:"+referral.ID.String())
+	if err != nil {
+		return err
+	}
+
+	// A negative amount credits the balance against the next invoices
+	params := &stripe.CustomerBalanceTransactionParams{
+		Params:      stripe.Params{Context: ctx},
+		Customer:    stripe.String(customerID),
+		Amount:      stripe.Int64(-amount),
+		Currency:    stripe.String(string(stripe.CurrencyUSD)),
+		Description: stripe.String(fmt.Sprintf("Referral credit for referral %s", referral.ID)),
+	}
+	params.SetIdempotencyKey("referral:" + referral.ID.String())
+	transaction, err := customerbalancetransaction.New(params)
+	if err != nil {
+		return err
+	}
+
+	referral.RewardType = "balance"
+	referral.RewardAmount = amount
+	referral.StripeReference = transaction.ID
+	return nil
+}
+
+func GetReferrals(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if err := ensureReferralCode(db, &user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate referral code"})
+			return
+		}
+
+		var referrals []models.Referral
+		if err := db.Where("referrer_id = ?", user.ID).Order("created_at DESC").Find(&referrals).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch referrals"})
+			return
+		}
+
+		var converted int
+		var credited int64
+		for _, referral := range referrals {
+			if referral.Status == models.ReferralStatusConverted {
+				converted++
+				credited += referral.RewardAmount
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"referral_code":  *user.ReferralCode,
+			"converted":      converted,
+			"credited_cents": credited,
+			"referrals":      referrals,
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// handlers/schedule_handler.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/stripeclient"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/subschedule"
+	"gorm.io/gorm"
+)
+
+// SchedulePhase is one phase of a scheduled subscription. Every phase but the
+// last must run for a fixed number of billing cycles; the last one continues
+// until the subscription is cancelled.
+type SchedulePhase struct {
+	Plan       string `json:"plan" binding:"omitempty,oneof=monthly yearly"` // Defaults to the requested plan
+	Iterations int64  `json:"iterations" binding:"omitempty,min=1"`          // Number of billing cycles
+	Coupon     string `json:"coupon"`                                        // Optional Stripe coupon ID for this phase; admins only
+}
+
+func validateSchedule(startAt *time.Time, phases []SchedulePhase) error {
+	if startAt != nil && !startAt.After(time.Now()) {
+		return errors.New("start_at must be in the future")
+	}
+
+	for i, phase := range phases {
+		if i < len(phases)-1 && phase.Iterations == 0 {
+			return errors.New("every phase except the last must set iterations")
+		}
+	}
+
+	return nil
+}
+
+// subscriptionScheduleParams builds the Stripe subscription schedule for a
+// subscription to product starting at startAt, or now if it is nil. It also
+// returns the plan of the first phase. Stripe creates the actual subscription
+// when the schedule starts; see ActivateStartedSchedules.
+func subscriptionScheduleParams(db *gorm.DB, product models.Product, customerID string, plan string, seats int64, startAt *time.Time, phases []SchedulePhase) (*stripe.SubscriptionScheduleParams, string, error) {
+	if len(phases) == 0 {
+		phases = []SchedulePhase{{}}
+	}
+
+	phaseParams := make([]*stripe.SubscriptionSchedulePhaseParams, 0, len(phases))
+	for _, phase := range phases {
+		phasePlan := phase.Plan
+		if phasePlan == "" {
+			phasePlan = plan
+		}
+
+		stripePriceID, err := getStripePriceID(db, product, phasePlan)
+		if err != nil {
+			return nil, "", err
+		}
+
+		params := &stripe.SubscriptionSchedulePhaseParams{
+			Items: []*stripe.SubscriptionSchedulePhaseItemParams{
+				{
+					Price: stripe.String(stripePriceID),
+				},
+			},
+		}
+		if seats > 0 {
+			params.Items[0].Quantity = stripe.Int64(seats)
+		}
+		if phase.Iterations > 0 {
+			params.Iterations = stripe.Int64(phase.Iterations)
+		}
+		if phase.Coupon != "" {
+			params.Coupon = stripe.String(phase.Coupon)
+		}
+		phaseParams = append(phaseParams, params)
+	}
+
+	scheduleParams := &stripe.SubscriptionScheduleParams{
+		Customer: stripe.String(customerID),
+		// Keep the subscription running on the last phase's price once the
+		// schedule ends
+		EndBehavior: stripe.String(string(stripe.SubscriptionScheduleEndBehaviorRelease)),
+		Phases:      phaseParams,
+	}
+	if startAt != nil {
+		scheduleParams.StartDate = stripe.Int64(startAt.Unix())
+	} else {
+		scheduleParams.StartDateNow = stripe.Bool(true)
+	}
+
+	firstPlan := phases[0].Plan
+	if firstPlan == "" {
+		firstPlan = plan
+	}
+
+	return scheduleParams, firstPlan, nil
+}
+
+// ActivateStartedSchedules moves scheduled subscriptions whose start date has
+// passed to "active" once Stripe has created the underlying subscription.
+func ActivateStartedSchedules(ctx context.Context, db *gorm.DB) error {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	var subscriptions []models.Subscription
+	if err := db.Where("status = ? AND start_date <= ?", models.SubscriptionStatusScheduled, time.Now()).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		schedule, err := subschedule.Get(subscription.StripeScheduleID, &stripe.SubscriptionScheduleParams{Params: stripe.Params{Context: ctx}})
+		if errors.Is(err, stripeclient.ErrCircuitOpen) {
+			return err // Try again on the next run
+		}
+		if err != nil {
+			utils.Log("Error fetching Stripe subscription schedule:", err)
+			continue
+		}
+
+		before := subscription.Snapshot()
+		next := models.SubscriptionStatusActive
+
+		switch schedule.Status {
+		case stripe.SubscriptionScheduleStatusCanceled:
+			next = models.SubscriptionStatusCanceled
+		case stripe.SubscriptionScheduleStatusNotStarted:
+			continue
+		default:
+			stripeSub := schedule.Subscription
+			if stripeSub == nil {
+				stripeSub = schedule.ReleasedSubscription
+			}
+			if stripeSub == nil {
+				continue
+			}
+			subscription.StripeID = stripeSub.ID
+		}
+
+		if err := transitionSubscription(db, &subscription, before, next, nil, models.EventSourceJob); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planMonths returns the length of a billing cycle in months.
+func planMonths(plan string) int {
+	switch plan {
+	case "monthly":
+		return 1
+	case "yearly":
+		return 12
+	}
+	return 0
+}
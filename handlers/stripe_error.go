@@ -0,0 +1,60 @@
+// handlers/stripe_error.go
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/yeboahd24/subscription-stripe/stripeclient"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondStripeError answers a request whose Stripe call failed. Declined
+// cards and invalid requests are the client's to fix and are returned as
+// such; when Stripe is unavailable the client is told to try again later.
+// message describes what failed and is used where Stripe's own message is
+// not meant for the client.
+func respondStripeError(c *gin.Context, err error, message string) {
+	utils.Log(message+":", err)
+
+	switch {
+	case errors.Is(err, stripeclient.ErrCircuitOpen):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider is unavailable, please try again later"})
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Payment provider did not respond in time, please try again"})
+		return
+	case errors.Is(err, context.Canceled):
+		// The client went away; 499 is nginx's status for this
+		c.Status(499)
+		return
+	}
+
+	stripeErr, ok := stripeclient.AsError(err)
+	if !ok {
+		c.JSON(http.StatusBadGateway, gin.H{"error": message})
+		return
+	}
+
+	switch stripeErr.Type {
+	case stripeclient.ErrorTypeCard:
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"error":        stripeErr.Message,
+			"code":         stripeErr.Code,
+			"decline_code": stripeErr.DeclineCode,
+		})
+	case stripeclient.ErrorTypeRateLimit:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider is busy, please try again shortly"})
+	case stripeclient.ErrorTypeIdempotency:
+		c.JSON(http.StatusConflict, gin.H{"error": "Request conflicts with an earlier request with the same idempotency key"})
+	case stripeclient.ErrorTypeInvalidRequest:
+		c.JSON(http.StatusBadRequest, gin.H{"error": message, "code": stripeErr.Code, "param": stripeErr.Param})
+	default:
+		// API errors, and authentication or permission errors from a
+		// misconfigured key
+		c.JSON(http.StatusBadGateway, gin.H{"error": message})
+	}
+}
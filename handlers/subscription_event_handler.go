@@ -0,0 +1,253 @@
+// handlers/subscription_event_handler.go
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/notify"
+	"github.com/yeboahd24/subscription-stripe/utils"
+	"github.com/yeboahd24/subscription-stripe/webhooks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// recordSubscriptionEvent appends a transition to the subscription's history.
+// before is nil for newly created subscriptions. It should be called in the
+// transaction making the change, so that the change is rolled back with the
+// event if recording it fails.
+func recordSubscriptionEvent(db *gorm.DB, eventType string, before *models.SubscriptionSnapshot, after models.Subscription, actorID *uuid.UUID, source string) error {
+	return appendSubscriptionEvent(db, models.SubscriptionEvent{
+		SubscriptionID: after.ID,
+		Type:           eventType,
+		ActorID:        actorID,
+		Source:         source,
+	}, before, after)
+}
+
+// recordAdminOverride appends a change an admin made by hand to the
+// subscription's history, together with their reason.
+func recordAdminOverride(db *gorm.DB, eventType string, before *models.SubscriptionSnapshot, after models.Subscription, actorID *uuid.UUID, reason string) error {
+	return appendSubscriptionEvent(db, models.SubscriptionEvent{
+		SubscriptionID: after.ID,
+		Type:           eventType,
+		ActorID:        actorID,
+		Source:         models.EventSourceAdmin,
+		Reason:         reason,
+	}, before, after)
+}
+
+// appendSubscriptionEvent stores the event, then queues its email and
+// webhooks. Only storing it can fail; the notifications are best effort.
+func appendSubscriptionEvent(db *gorm.DB, event models.SubscriptionEvent, before *models.SubscriptionSnapshot, after models.Subscription) error {
+	var err error
+	if before != nil {
+		if event.Before, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+	if event.After, err = json.Marshal(after.Snapshot()); err != nil {
+		return err
+	}
+
+	if err := db.Create(&event).Error; err != nil {
+		return err
+	}
+
+	notifySubscriptionEvent(db, event, after)
+
+	if err := webhooks.Emit(db, webhooks.SubscriptionEventType(event.Type), subscriptionWebhookData(event, after)); err != nil {
+		utils.Log("Error emitting subscription webhook:", err)
+	}
+	return nil
+}
+
+// subscriptionWebhookData is the data of subscription webhook events: the
+// subscription after the change, and before it unless it was just created.
+func subscriptionWebhookData(event models.SubscriptionEvent, subscription models.Subscription) gin.H {
+	return gin.H{
+		"subscription_event_id": event.ID,
+		"subscription_id":       subscription.ID,
+		"user_id":               subscription.UserID,
+		"actor_id":              event.ActorID,
+		"source":                event.Source,
+		"subscription":          event.After,
+		"previous":              event.Before,
+	}
+}
+
+// subscriptionEventEmails are the emails customers get for subscription
+// events. A new subscription is announced by the email for its status.
+var subscriptionEventEmails = map[string]string{
+	models.SubscriptionEventActivated:     notify.TemplateSubscriptionStarted,
+	models.SubscriptionEventTrialStarted:  notify.TemplateTrialStarted,
+	models.SubscriptionEventPaymentFailed: notify.TemplatePaymentFailed,
+	models.SubscriptionEventCancelled:     notify.TemplateSubscriptionCancelled,
+}
+
+// notifySubscriptionEvent queues the email for the event, if there is one, to
+// the user who holds the subscription.
+func notifySubscriptionEvent(db *gorm.DB, event models.SubscriptionEvent, subscription models.Subscription) {
+	template, ok := subscriptionEventEmails[event.Type]
+	if event.Type == models.SubscriptionEventCreated {
+		switch subscription.Status {
+		case models.SubscriptionStatusActive:
+			template, ok = notify.TemplateSubscriptionStarted, true
+		case models.SubscriptionStatusTrialing:
+			template, ok = notify.TemplateTrialStarted, true
+		}
+	}
+	if !ok {
+		return
+	}
+
+	var user models.CustomUser
+	if err := db.First(&user, subscription.UserID).Error; err != nil {
+		utils.Log("Error loading user to notify:", err)
+		return
+	}
+
+	if err := notify.Enqueue(db, user.Email, template, subscriptionEmailData(db, subscription), "subscription-event:"+event.ID.String()); err != nil {
+		utils.Log("Error queueing subscription email:", err)
+	}
+}
+
+// subscriptionEmailData is the template data describing a subscription.
+func subscriptionEmailData(db *gorm.DB, subscription models.Subscription) map[string]interface{} {
+	var product models.Product
+	db.Select("name").First(&product, subscription.ProductID)
+
+	return map[string]interface{}{
+		"Product":      product.Name,
+		"Plan":         subscription.Plan,
+		"Seats":        subscription.Seats,
+		"EndDate":      formatEmailDate(subscription.EndDate),
+		"TrialEndDate": formatEmailDate(subscription.TrialEndDate),
+	}
+}
+
+func formatEmailDate(t time.Time) string {
+	return t.Format("January 2, 2006")
+}
+
+// transitionSubscription moves the subscription to the next status through
+// its lifecycle, saves it together with any other changes the caller made
+// since taking the before snapshot, and records the transition in the same
+// transaction. Illegal moves return a *models.InvalidTransitionError and
+// change nothing.
+func transitionSubscription(db *gorm.DB, subscription *models.Subscription, before models.SubscriptionSnapshot, next models.SubscriptionStatus, actorID *uuid.UUID, source string) error {
+	from := subscription.Status
+	if err := subscription.TransitionTo(next); err != nil {
+		return err
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Save(subscription).Error; err != nil {
+			return err
+		}
+		return recordSubscriptionEvent(tx, transitionEventType(from, next), &before, *subscription, actorID, source)
+	})
+	if err != nil {
+		subscription.Status = from
+		return err
+	}
+	return nil
+}
+
+// transitionEventType names the event recorded for a status change.
+func transitionEventType(from models.SubscriptionStatus, to models.SubscriptionStatus) string {
+	switch {
+	case to == models.SubscriptionStatusCanceled:
+		return models.SubscriptionEventCancelled
+	case to == models.SubscriptionStatusPastDue, to == models.SubscriptionStatusUnpaid:
+		return models.SubscriptionEventPaymentFailed
+	case from == models.SubscriptionStatusTrialing:
+		return models.SubscriptionEventTrialEnded
+	case to == models.SubscriptionStatusTrialing:
+		return models.SubscriptionEventTrialStarted
+	case to == models.SubscriptionStatusPaused:
+		return models.SubscriptionEventPaused
+	case from == models.SubscriptionStatusPastDue, from == models.SubscriptionStatusUnpaid:
+		return models.SubscriptionEventPaymentRecovered
+	case from == models.SubscriptionStatusPaused:
+		return models.SubscriptionEventResumed
+	}
+	return models.SubscriptionEventActivated
+}
+
+// contextActorID returns the authenticated user as the actor of an event.
+func contextActorID(c *gin.Context) *uuid.UUID {
+	userID, _ := c.Get("user_id")
+	if id, ok := userID.(uuid.UUID); ok {
+		return &id
+	}
+	return nil
+}
+
+// GetSubscriptionEvents returns the history of a subscription, oldest first.
+// It is visible to the subscription's owner, the owners and admins of the
+// organization it belongs to, and admins.
+func GetSubscriptionEvents(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		subscriptionID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID format"})
+			return
+		}
+
+		var subscription models.Subscription
+		if err := db.First(&subscription, subscriptionID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+
+		if !canViewSubscription(db, subscription, userID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+
+		var events []models.SubscriptionEvent
+		if err := db.Where("subscription_id = ?", subscription.ID).Order("created_at, id").Find(&events).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription events"})
+			return
+		}
+
+		// Reasons for admin overrides are internal notes
+		if !isUserAdmin(db, userID) {
+			for i := range events {
+				events[i].Reason = ""
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"subscription_id": subscription.ID,
+			"events":          events,
+		})
+	}
+}
+
+func canViewSubscription(db *gorm.DB, subscription models.Subscription, userID interface{}) bool {
+	if subscription.OrganizationID == nil {
+		if id, ok := userID.(uuid.UUID); ok && subscription.UserID == id {
+			return true
+		}
+	} else {
+		var member models.OrganizationMember
+		if err := db.Where("organization_id = ? AND user_id = ?", subscription.OrganizationID, userID).First(&member).Error; err == nil && member.CanManage() {
+			return true
+		}
+	}
+
+	return isUserAdmin(db, userID)
+}
@@ -1,19 +1,23 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/saga"
 	"github.com/yeboahd24/subscription-stripe/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/sub"
 	"gorm.io/gorm"
 )
 
@@ -24,8 +28,11 @@ func Subscribe(db *gorm.DB) gin.HandlerFunc {
 		userID, _ := c.Get("user_id")
 
 		var subscribeRequest struct {
-			ProductID uuid.UUID `json:"product_id" binding:"required"`
-			Plan      string    `json:"plan" binding:"required,oneof=monthly yearly"` // Removed "trial"
+			ProductID uuid.UUID       `json:"product_id" binding:"required"`
+			Plan      string          `json:"plan" binding:"required,oneof=monthly yearly"` // Removed "trial"
+			StartAt   *time.Time      `json:"start_at"`                                     // Optional future start date
+			Phases    []SchedulePhase `json:"phases" binding:"omitempty,dive"`              // Optional multi-phase schedule
+			Seats     int64           `json:"seats" binding:"omitempty,min=1"`              // Organization subscriptions only
 		}
 
 		if err := c.ShouldBindJSON(&subscribeRequest); err != nil {
@@ -33,94 +40,132 @@ func Subscribe(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !canManageSubscriptions(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only organization owners and admins can manage subscriptions"})
+			return
+		}
+
+		organizationID := contextOrganizationID(c)
+		seats, err := subscriptionSeats(organizationID, subscribeRequest.Seats)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Coupons are discounts granted by the business, not chosen by customers
+		for _, phase := range subscribeRequest.Phases {
+			if phase.Coupon != "" && !isUserAdmin(db, userID) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can apply coupons to phases"})
+				return
+			}
+		}
+
+		scheduled := subscribeRequest.StartAt != nil || len(subscribeRequest.Phases) > 0
+		if scheduled {
+			if err := validateSchedule(subscribeRequest.StartAt, subscribeRequest.Phases); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
 		var product models.Product
 		if err := db.First(&product, subscribeRequest.ProductID).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
 
+		if product.IsAddon() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Add-on products can only be added to an existing subscription"})
+			return
+		}
+
+		if !product.IsRecurring() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product is only sold as a one-time purchase"})
+			return
+		}
+
 		var user models.CustomUser
 		if err := db.First(&user, userID).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 
-		// Create Stripe customer
-		params := &stripe.CustomerParams{
-			Email: stripe.String(user.Email),
-		}
-		stripeCustomer, err := customer.New(params)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Stripe customer"})
+		if organizationID == nil && HasLifetimeAccess(db, user.ID, product.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has lifetime access to this product"})
 			return
 		}
 
+		// Fail before anything is recorded if the product has no price for
+		// the plan
 		stripePriceID, err := getStripePriceID(db, product, subscribeRequest.Plan)
-
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Stripe Price ID"})
 			return
 		}
 
-		// Create Stripe subscription
-		subParams := &stripe.SubscriptionParams{
-			Customer: stripe.String(stripeCustomer.ID),
-			Items: []*stripe.SubscriptionItemsParams{
-				{
-					Price: stripe.String(stripePriceID),
-				},
-			},
-			TrialPeriodDays: stripe.Int64(30),
+		// Reserve the subscription and record the operation that creates it
+		// in Stripe together; a worker makes the Stripe calls and undoes them
+		// if a later step fails
+		startDate := time.Now()
+		if subscribeRequest.StartAt != nil {
+			startDate = *subscribeRequest.StartAt
 		}
-		stripeSub, err := sub.New(subParams)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Stripe subscription"})
-			return
+		firstPlan := subscribeRequest.Plan
+		if len(subscribeRequest.Phases) > 0 && subscribeRequest.Phases[0].Plan != "" {
+			firstPlan = subscribeRequest.Phases[0].Plan
 		}
-
-		// Check if the user already has an active subscription
-		var existingSubscription models.Subscription
-		if err := db.Where("user_id = ? AND status != ?", user.ID, "cancelled").First(&existingSubscription).Error; err == nil {
-			// User already has an active subscription
+		subscription := models.Subscription{
+			UserID:         user.ID,
+			ProductID:      product.ID,
+			StartDate:      startDate,
+			EndDate:        startDate.AddDate(0, planMonths(firstPlan), 0),
+			Status:         models.SubscriptionStatusIncomplete,
+			Plan:           firstPlan,
+			OrganizationID: organizationID,
+			Seats:          seats,
+		}
+		operation := models.BillingOperation{
+			Kind:           billingOperationSubscribe,
+			UserID:         user.ID,
+			OrganizationID: organizationID,
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// Check for an existing subscription under the account's lock,
+			// so that parallel requests cannot both pass
+			if err := lockSubscriptions(tx, user.ID, organizationID); err != nil {
+				return err
+			}
+			if err := ensureNoLiveSubscription(tx, subscriptionScope(c, tx), &user.ID, models.EventSourceAPI); err != nil {
+				return err
+			}
+
+			if err := tx.Create(&subscription).Error; err != nil {
+				return err
+			}
+			operation.SubscriptionID = &subscription.ID
+			return saga.Start(tx, &operation, subscribeInput{
+				ProductID: product.ID,
+				Plan:      subscribeRequest.Plan,
+				PriceID:   stripePriceID,
+				StartAt:   subscribeRequest.StartAt,
+				Phases:    subscribeRequest.Phases,
+				Seats:     seats,
+			})
+		})
+		if errors.Is(err, errAlreadySubscribed) || isLiveSubscriptionConflict(err) {
 			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active subscription"})
 			return
 		}
-
-		var existingUserSubscription models.Subscription
-		if err := db.Where("user_id = ? AND (status = ? OR status = ?)", user.ID, "active", "completed").First(&existingUserSubscription).Error; err == nil {
-			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active or completed subscription"})
-			return
-		}
-
-		// Create local subscription
-		subscription := models.Subscription{
-			UserID:       user.ID,
-			ProductID:    product.ID,
-			StartDate:    time.Now(),
-			TrialEndDate: time.Time{}, // Set to zero value since trial is removed
-			EndDate: time.Now().AddDate(0, func() int {
-				if subscribeRequest.Plan == "monthly" {
-					return 1
-				} else if subscribeRequest.Plan == "yearly" {
-					return 12
-				}
-				return 0 // No end date for trial
-			}(), 0),
-			Status:    "active",
-			Plan:      subscribeRequest.Plan,
-			StripeID:  stripeSub.ID,
-			IsInTrial: false, // Set IsInTrial to false since trials are removed
-		}
-
-		if err := db.Create(&subscription).Error; err != nil {
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{
-			"message":      "Subscription created successfully",
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":      "Subscription is being created",
 			"subscription": subscription,
-			"stripe_id":    stripeSub.ID,
+			"operation":    operation,
 		})
 	}
 }
@@ -149,44 +194,44 @@ func GetSubscription(db *gorm.DB) gin.HandlerFunc {
 
 		utils.Log("Fetching subscription for userID:", userID)
 
-		// Update trial status before fetching the subscription
-		if err := UpdateTrialStatus(db); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update trial status"})
-			return
-		}
-
 		var subscription models.Subscription
-		if err := db.Where("user_id = ? AND status = ?", userID, "active").Last(&subscription).Error; err != nil {
+		if err := subscriptionScope(c, db).Preload("Items").Where("status IN ?", models.GrantingSubscriptionStatuses).Last(&subscription).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Active Subscription not found for userID: " + userID.(uuid.UUID).String()})
 			return
 		}
 
 		response := struct {
-			ID           string    `json:"id"`
-			UserID       string    `json:"user_id"`
-			ProductID    string    `json:"product_id"`
-			StartDate    time.Time `json:"start_date"`
-			EndDate      time.Time `json:"end_date"`
-			TrialEndDate time.Time `json:"trial_end_date"`
-			Status       string    `json:"status"`
-			Plan         string    `json:"plan"`
-			StripeID     string    `json:"stripe_id"`
-			CreatedAt    time.Time `json:"created_at"`
-			UpdatedAt    time.Time `json:"updated_at"`
-			IsInTrial    bool      `json:"is_in_trial"`
+			ID             string                    `json:"id"`
+			UserID         string                    `json:"user_id"`
+			ProductID      string                    `json:"product_id"`
+			StartDate      time.Time                 `json:"start_date"`
+			EndDate        time.Time                 `json:"end_date"`
+			TrialEndDate   time.Time                 `json:"trial_end_date"`
+			Status         models.SubscriptionStatus `json:"status"`
+			Plan           string                    `json:"plan"`
+			StripeID       string                    `json:"stripe_id"`
+			CreatedAt      time.Time                 `json:"created_at"`
+			UpdatedAt      time.Time                 `json:"updated_at"`
+			IsInTrial      bool                      `json:"is_in_trial"`
+			OrganizationID *uuid.UUID                `json:"organization_id,omitempty"`
+			Seats          int64                     `json:"seats,omitempty"`
+			Items          []models.SubscriptionItem `json:"items"`
 		}{
-			ID:           subscription.ID.String(),
-			UserID:       subscription.UserID.String(),
-			ProductID:    subscription.ProductID.String(),
-			StartDate:    subscription.StartDate,
-			EndDate:      subscription.EndDate,
-			TrialEndDate: subscription.TrialEndDate,
-			Status:       subscription.Status,
-			Plan:         subscription.Plan,
-			StripeID:     subscription.StripeID,
-			CreatedAt:    subscription.CreatedAt,
-			UpdatedAt:    subscription.UpdatedAt,
-			IsInTrial:    subscription.IsInTrial,
+			ID:             subscription.ID.String(),
+			UserID:         subscription.UserID.String(),
+			ProductID:      subscription.ProductID.String(),
+			StartDate:      subscription.StartDate,
+			EndDate:        subscription.EndDate,
+			TrialEndDate:   subscription.TrialEndDate,
+			Status:         subscription.Status,
+			Plan:           subscription.Plan,
+			StripeID:       subscription.StripeID,
+			CreatedAt:      subscription.CreatedAt,
+			UpdatedAt:      subscription.UpdatedAt,
+			IsInTrial:      subscription.IsInTrial(),
+			OrganizationID: subscription.OrganizationID,
+			Seats:          subscription.Seats,
+			Items:          subscription.Items,
 		}
 
 		c.JSON(http.StatusOK, response)
@@ -194,10 +239,13 @@ func GetSubscription(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+var errCancellationPending = errors.New("subscription is already being cancelled")
+
+// CancelSubscription cancels a subscription. Subscriptions billed in Stripe
+// are cancelled by a billing operation and the response is 202 Accepted;
+// others are cancelled straight away.
 func CancelSubscription(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-
 		var request struct {
 			SubscriptionID string `json:"subscription_id" binding:"required"`
 		}
@@ -207,26 +255,74 @@ func CancelSubscription(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !canManageSubscriptions(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only organization owners and admins can manage subscriptions"})
+			return
+		}
+
 		// Use subscription_id from the request
 		var subscription models.Subscription
-		if err := db.Where("id = ? AND status != ?", request.SubscriptionID, "cancelled").Last(&subscription).Error; err != nil {
+		var operation *models.BillingOperation
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Serialize with other changes to the account's subscriptions
+			if err := lockSubscriptions(tx, *contextActorID(c), contextOrganizationID(c)); err != nil {
+				return err
+			}
+			if err := subscriptionScope(c, tx).Where("id = ? AND status != ?", request.SubscriptionID, models.SubscriptionStatusCanceled).Last(&subscription).Error; err != nil {
+				return err
+			}
+
+			// Cancel the Stripe subscription, or its schedule if it has not
+			// started yet, through a worker that retries until the local
+			// subscription is cancelled too
+			input := cancelInput{StripeID: subscription.StripeID}
+			if subscription.Status == models.SubscriptionStatusScheduled {
+				input = cancelInput{StripeScheduleID: subscription.StripeScheduleID}
+			}
+			if input.StripeID != "" || input.StripeScheduleID != "" {
+				var pending int64
+				if err := tx.Model(&models.BillingOperation{}).
+					Where("subscription_id = ? AND kind = ? AND status IN ?", subscription.ID, billingOperationCancel,
+						[]string{models.BillingOperationStatusPending, models.BillingOperationStatusRunning}).
+					Count(&pending).Error; err != nil {
+					return err
+				}
+				if pending > 0 {
+					return errCancellationPending
+				}
+
+				operation = &models.BillingOperation{
+					Kind:           billingOperationCancel,
+					UserID:         *contextActorID(c),
+					OrganizationID: subscription.OrganizationID,
+					SubscriptionID: &subscription.ID,
+				}
+				return saga.Start(tx, operation, input)
+			}
+
+			// Free trials, gifts and comps are not billed in Stripe
+			before := subscription.Snapshot()
+			subscription.EndDate = time.Now()
+
+			return transitionSubscription(tx, &subscription, before, models.SubscriptionStatusCanceled, contextActorID(c), models.EventSourceAPI)
+		})
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
 			c.JSON(http.StatusNotFound, gin.H{"error": "Active subscription not found"})
 			return
-		}
-
-		// Cancel Stripe subscription
-		_, err := sub.Cancel(subscription.StripeID, nil)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel Stripe subscription"})
+		case errors.Is(err, errCancellationPending):
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is already being cancelled"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription status"})
 			return
 		}
 
-		// Update local subscription
-		subscription.Status = "cancelled"
-		subscription.EndDate = time.Now()
-
-		if err := db.Save(&subscription).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription status"})
+		if operation != nil {
+			c.JSON(http.StatusAccepted, gin.H{
+				"message":   "Subscription is being cancelled",
+				"operation": operation,
+			})
 			return
 		}
 
@@ -234,6 +330,21 @@ func CancelSubscription(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// subscriptionSeats returns the number of seats to buy. Organization
+// subscriptions default to one seat; personal ones have none.
+func subscriptionSeats(organizationID *uuid.UUID, requested int64) (int64, error) {
+	if organizationID == nil {
+		if requested > 0 {
+			return 0, errors.New("seats can only be bought for an organization")
+		}
+		return 0, nil
+	}
+	if requested == 0 {
+		return 1, nil
+	}
+	return requested, nil
+}
+
 func getStripePriceID(db *gorm.DB, product models.Product, plan string) (string, error) {
 	var stripePriceID string
 
@@ -265,18 +376,69 @@ func getStripePriceID(db *gorm.DB, product models.Product, plan string) (string,
 	return stripePriceID, nil
 }
 
+// ensureStripeCustomer returns the user's Stripe customer ID, creating the
+// customer and storing its ID on the user the first time.
+func ensureStripeCustomer(ctx context.Context, db *gorm.DB, user *models.CustomUser, idempotencyKey string) (string, error) {
+	if user.StripeCustomerID != "" {
+		return user.StripeCustomerID, nil
+	}
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	params := &stripe.CustomerParams{
+		Params: stripe.Params{Context: ctx},
+		Email:  stripe.String(user.Email),
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	stripeCustomer, err := customer.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	user.StripeCustomerID = stripeCustomer.ID
+	if err := db.Model(user).Update("stripe_customer_id", stripeCustomer.ID).Error; err != nil {
+		return "", err
+	}
+
+	return stripeCustomer.ID, nil
+}
+
+// stripeIdempotencyKey derives a Stripe idempotency key for one step of the
+// current request from its Idempotency-Key header. It returns an empty string
+// when the client did not send one. The client key is hashed to stay within
+// Stripe's 255 character limit.
+func stripeIdempotencyKey(c *gin.Context, step string) string {
+	key := c.GetString("idempotency_key")
+	if key == "" {
+		return ""
+	}
+	userID, _ := c.Get("user_id")
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%v:%s:%s", userID, hex.EncodeToString(sum[:]), step)
+}
+
+// UpdateTrialStatus ends trials whose trial period is over. Free trials
+// without a Stripe subscription are paused until the account subscribes,
+// starts a new trial or cancels them, which replace or end the lapsed trial
+// instead of conflicting with it (see ensureNoLiveSubscription); Stripe
+// trials become active, and Stripe's webhooks correct the status if the first
+// payment fails. It runs as the expire-trials background job.
 func UpdateTrialStatus(db *gorm.DB) error {
 	var subscriptions []models.Subscription
 
-	// Get all subscriptions that are still in trial
-	if err := db.Where("is_in_trial = ? AND trial_end_date < ?", true, time.Now()).Find(&subscriptions).Error; err != nil {
+	// Get all subscriptions whose trial has ended
+	if err := db.Where("status = ? AND trial_end_date < ?", models.SubscriptionStatusTrialing, time.Now()).Find(&subscriptions).Error; err != nil {
 		return err
 	}
 
-	// Update each subscription's IsInTrial status
 	for _, subscription := range subscriptions {
-		subscription.IsInTrial = false
-		if err := db.Save(&subscription).Error; err != nil {
+		next := models.SubscriptionStatusActive
+		if subscription.StripeID == "" {
+			next = models.SubscriptionStatusPaused
+		}
+		if err := transitionSubscription(db, &subscription, subscription.Snapshot(), next, nil, models.EventSourceJob); err != nil {
 			return err
 		}
 	}
@@ -284,22 +446,13 @@ func UpdateTrialStatus(db *gorm.DB) error {
 	return nil
 }
 
-// - **Performance**:
-// 	Depending on the number of subscriptions,
-// 	you may want to optimize the query or run this function
-// 	in a background job to avoid performance issues.
-
-// - **Scheduled Jobs**: For a more robust solution,
-// 	consider implementing a scheduled job
-// 	(using a library like `cron` in Go) to periodically check
-//  	and update trial statuses without needing to rely on user actions.
-
 func TrialSubscribe(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("user_id")
 
 		var trialRequest struct {
 			ProductID uuid.UUID `json:"product_id" binding:"required"`
+			Seats     int64     `json:"seats" binding:"omitempty,min=1"` // Organization trials only
 		}
 
 		if err := c.ShouldBindJSON(&trialRequest); err != nil {
@@ -307,45 +460,78 @@ func TrialSubscribe(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !canManageSubscriptions(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only organization owners and admins can manage subscriptions"})
+			return
+		}
+
+		organizationID := contextOrganizationID(c)
+		seats, err := subscriptionSeats(organizationID, trialRequest.Seats)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		var product models.Product
 		if err := db.First(&product, trialRequest.ProductID).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
 
-		var user models.CustomUser
-		if err := db.First(&user, userID).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		if product.IsAddon() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Add-on products can only be added to an existing subscription"})
 			return
 		}
 
-		// Check if the user already has an active subscription
-		var existingSubscription models.Subscription
-		if err := db.Where("user_id = ? AND status != ?", user.ID, "cancelled").First(&existingSubscription).Error; err == nil {
-			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active subscription"})
+		if !product.IsRecurring() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product is only sold as a one-time purchase"})
 			return
 		}
 
-		// Check if the user already has an active or completed subscription
-		var existingUserSubscription models.Subscription
-		if err := db.Where("user_id = ? AND (status = ? OR status = ?)", user.ID, "active", "completed").First(&existingUserSubscription).Error; err == nil {
-			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active or completed subscription"})
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if organizationID == nil && HasLifetimeAccess(db, user.ID, product.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has lifetime access to this product"})
 			return
 		}
 
 		// Create local trial subscription
 		subscription := models.Subscription{
-			UserID:       user.ID,
-			ProductID:    product.ID,
-			StartDate:    time.Now(),
-			TrialEndDate: time.Now().AddDate(0, 0, 30), // Set trial period of 30 days
-			EndDate:      time.Time{},                  // No end date for trial
-			Status:       "active",
-			Plan:         "trial", // Set plan to trial
-			IsInTrial:    true,    // Set IsInTrial to true
+			UserID:         user.ID,
+			ProductID:      product.ID,
+			StartDate:      time.Now(),
+			TrialEndDate:   time.Now().AddDate(0, 0, 30), // Set trial period of 30 days
+			EndDate:        time.Time{},                  // No end date for trial
+			Status:         models.SubscriptionStatusTrialing,
+			Plan:           "trial", // Set plan to trial
+			OrganizationID: organizationID,
+			Seats:          seats,
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// Check if the user already has an active subscription, under the
+			// account's lock so that parallel requests cannot both pass
+			if err := lockSubscriptions(tx, user.ID, organizationID); err != nil {
+				return err
+			}
+			if err := ensureNoLiveSubscription(tx, subscriptionScope(c, tx), &user.ID, models.EventSourceAPI); err != nil {
+				return err
+			}
+
+			if err := tx.Create(&subscription).Error; err != nil {
+				return err
+			}
+			return recordSubscriptionEvent(tx, models.SubscriptionEventTrialStarted, nil, subscription, &user.ID, models.EventSourceAPI)
+		})
+		if errors.Is(err, errAlreadySubscribed) || isLiveSubscriptionConflict(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has an active subscription"})
+			return
 		}
-
-		if err := db.Create(&subscription).Error; err != nil {
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create trial subscription"})
 			return
 		}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/database"
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TestMain keeps app.log, which handlers log to, out of the source tree.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "handlers")
+	if err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL and migrates
+// it, or skips the test when it is not set. Tests clean up the rows they
+// create.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := database.Init(url)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	return db
+}
+
+// createSubscriber creates a user and a product they can subscribe to, and
+// removes them and everything recorded for them after the test.
+func createSubscriber(t *testing.T, db *gorm.DB) (models.CustomUser, models.Product) {
+	t.Helper()
+
+	user := models.CustomUser{Email: fmt.Sprintf("subscriber-%s@example.com", uuid.New())}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	product := models.Product{
+		ID:                   uuid.New(),
+		Name:                 "Pro",
+		Kind:                 models.ProductKindBase,
+		MonthlyPrice:         20,
+		StripeMonthlyPriceID: "price_test_monthly",
+	}
+	if err := db.Create(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		var operationIDs []uuid.UUID
+		db.Model(&models.BillingOperation{}).Where("user_id = ?", user.ID).Pluck("id", &operationIDs)
+		for _, id := range operationIDs {
+			db.Where("unique_key = ?", "billing-operation:"+id.String()).Delete(&models.QueuedJob{})
+		}
+		db.Where("user_id = ?", user.ID).Delete(&models.BillingOperation{})
+		db.Where("subscription_id IN (?)", db.Model(&models.Subscription{}).Select("id").Where("user_id = ?", user.ID)).Delete(&models.SubscriptionEvent{})
+		db.Where("user_id = ?", user.ID).Delete(&models.Subscription{})
+		db.Delete(&product)
+		db.Delete(&user)
+	})
+	return user, product
+}
+
+// call runs handler for a request by user with body as JSON, and returns
+// the response status.
+func call(handler gin.HandlerFunc, userID uuid.UUID, body string) int {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set("user_id", userID)
+	handler(c)
+	return recorder.Code
+}
+
+func TestConcurrentSubscribe(t *testing.T) {
+	db := testDB(t)
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name      string
+		subscribe int // Parallel Subscribe calls
+		trials    int // Parallel TrialSubscribe calls
+	}{
+		{"subscribe", 8, 0},
+		{"trial", 0, 8},
+		{"subscribe and trial", 4, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, product := createSubscriber(t, db)
+			subscribeBody := fmt.Sprintf(`{"product_id":%q,"plan":"monthly"}`, product.ID)
+			trialBody := fmt.Sprintf(`{"product_id":%q}`, product.ID)
+
+			var mu sync.Mutex
+			statuses := map[int]int{}
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			run := func(handler gin.HandlerFunc, body string) {
+				defer wg.Done()
+				<-start
+				status := call(handler, user.ID, body)
+				mu.Lock()
+				statuses[status]++
+				mu.Unlock()
+			}
+			for i := 0; i < tt.subscribe; i++ {
+				wg.Add(1)
+				go run(Subscribe(db), subscribeBody)
+			}
+			for i := 0; i < tt.trials; i++ {
+				wg.Add(1)
+				go run(TrialSubscribe(db), trialBody)
+			}
+			close(start)
+			wg.Wait()
+
+			created := statuses[http.StatusAccepted] + statuses[http.StatusCreated]
+			if created != 1 || statuses[http.StatusConflict] != tt.subscribe+tt.trials-1 {
+				t.Errorf("got statuses %v, want one created and the rest %d", statuses, http.StatusConflict)
+			}
+
+			var live int64
+			if err := db.Model(&models.Subscription{}).
+				Where("user_id = ? AND product_id = ? AND status != ?", user.ID, product.ID, models.SubscriptionStatusCanceled).
+				Count(&live).Error; err != nil {
+				t.Fatal(err)
+			}
+			if live != 1 {
+				t.Errorf("got %d live subscriptions, want 1", live)
+			}
+		})
+	}
+}
+
+func TestLiveSubscriptionIndex(t *testing.T) {
+	db := testDB(t)
+	user, product := createSubscriber(t, db)
+
+	subscription := func(status models.SubscriptionStatus) *models.Subscription {
+		return &models.Subscription{UserID: user.ID, ProductID: product.ID, StartDate: time.Now(), Status: status, Plan: "monthly"}
+	}
+
+	if err := db.Create(subscription(models.SubscriptionStatusCanceled)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(subscription(models.SubscriptionStatusActive)).Error; err != nil {
+		t.Fatalf("live subscription next to a canceled one: %v", err)
+	}
+	// Bypassing the lock, the index still refuses a second live subscription
+	err := db.Create(subscription(models.SubscriptionStatusTrialing)).Error
+	if !isLiveSubscriptionConflict(err) {
+		t.Errorf("second live subscription: got %v, want a live subscription conflict", err)
+	}
+}
@@ -0,0 +1,63 @@
+// handlers/subscription_lock.go
+package handlers
+
+import (
+	"errors"
+	"hash/fnv"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// uniqueViolation is the Postgres error code for a unique constraint
+// violation.
+const uniqueViolation = "23505"
+
+// lockSubscriptions serializes changes to the subscriptions of one account,
+// the organization's if organizationID is set and the user's otherwise. The
+// lock is held until tx ends, so checks made after taking it, such as for an
+// existing subscription, stay true until the change is committed.
+func lockSubscriptions(tx *gorm.DB, userID uuid.UUID, organizationID *uuid.UUID) error {
+	account := "user:" + userID.String()
+	if organizationID != nil {
+		account = "organization:" + organizationID.String()
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte("subscriptions:" + account))
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", int64(hash.Sum64())).Error
+}
+
+// isLiveSubscriptionConflict reports whether err is a violation of the
+// indexes allowing one live subscription per account and product, i.e. a
+// concurrent request created the subscription first.
+func isLiveSubscriptionConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation &&
+		(pgErr.ConstraintName == models.LiveUserSubscriptionIndex || pgErr.ConstraintName == models.LiveOrganizationSubscriptionIndex)
+}
+
+// ensureNoLiveSubscription returns errAlreadySubscribed if any subscription
+// matched by scope is not canceled. Lapsed free trials do not count: they are
+// canceled in tx so that the account can subscribe or start over. Call it
+// with the account's lock held.
+func ensureNoLiveSubscription(tx *gorm.DB, scope *gorm.DB, actorID *uuid.UUID, source string) error {
+	var subscriptions []models.Subscription
+	if err := scope.Where("status != ?", models.SubscriptionStatusCanceled).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if !subscription.IsLapsedTrial() {
+			return errAlreadySubscribed
+		}
+	}
+	for i := range subscriptions {
+		if err := transitionSubscription(tx, &subscriptions[i], subscriptions[i].Snapshot(), models.SubscriptionStatusCanceled, actorID, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
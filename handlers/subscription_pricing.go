@@ -0,0 +1,106 @@
+// handlers/subscription_pricing.go
+package handlers
+
+import (
+	"errors"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"gorm.io/gorm"
+)
+
+// billedItem is what Stripe bills for one item of a subscription.
+type billedItem struct {
+	StripeItemID  string
+	StripePriceID string
+	Quantity      int64
+	UnitAmount    int64
+	Interval      string
+	IntervalCount int64
+}
+
+// billedPrices is what Stripe bills for a subscription: the price of each of
+// its items and the recurring discount of its coupon, if any.
+type billedPrices struct {
+	Items      []billedItem
+	PercentOff float64
+	AmountOff  int64
+}
+
+// syncBilledPrices records the prices Stripe bills the subscription behind
+// stripeSubscriptionID at, so that revenue is reported at what customers pay
+// rather than at the products' current prices. Subscriptions started by a
+// schedule have no items until Stripe bills them; their base item is recorded
+// here once Stripe bills one of the product's prices.
+func syncBilledPrices(db *gorm.DB, stripeSubscriptionID string, prices billedPrices) error {
+	var subscription models.Subscription
+	if err := db.Preload("Items").Where("stripe_id = ?", stripeSubscriptionID).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var product models.Product
+	if err := db.First(&product, subscription.ProductID).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		hasBase := false
+		recorded := map[string]bool{}
+		for _, item := range subscription.Items {
+			hasBase = hasBase || item.Kind == models.ProductKindBase
+			recorded[item.StripeItemID] = true
+		}
+
+		for _, billed := range prices.Items {
+			for i, item := range subscription.Items {
+				if item.StripeItemID != billed.StripeItemID {
+					continue
+				}
+				if item.UnitAmount == billed.UnitAmount && item.Interval == billed.Interval &&
+					item.IntervalCount == billed.IntervalCount && item.Quantity == billed.Quantity {
+					continue
+				}
+				if err := tx.Model(&subscription.Items[i]).Updates(map[string]interface{}{
+					"unit_amount":    billed.UnitAmount,
+					"interval":       billed.Interval,
+					"interval_count": billed.IntervalCount,
+					"quantity":       billed.Quantity,
+				}).Error; err != nil {
+					return err
+				}
+			}
+
+			if hasBase || recorded[billed.StripeItemID] {
+				continue
+			}
+			if billed.StripePriceID != product.StripeMonthlyPriceID && billed.StripePriceID != product.StripeYearlyPriceID {
+				continue
+			}
+			if err := tx.Create(&models.SubscriptionItem{
+				SubscriptionID: subscription.ID,
+				ProductID:      product.ID,
+				Kind:           models.ProductKindBase,
+				Quantity:       billed.Quantity,
+				StripeItemID:   billed.StripeItemID,
+				StripePriceID:  billed.StripePriceID,
+				UnitAmount:     billed.UnitAmount,
+				Interval:       billed.Interval,
+				IntervalCount:  billed.IntervalCount,
+			}).Error; err != nil {
+				return err
+			}
+			hasBase = true
+		}
+
+		if subscription.DiscountPercentOff == prices.PercentOff && subscription.DiscountAmountOff == prices.AmountOff {
+			return nil
+		}
+		return tx.Model(&subscription).Updates(map[string]interface{}{
+			"discount_percent_off": prices.PercentOff,
+			"discount_amount_off":  prices.AmountOff,
+		}).Error
+	})
+}
@@ -0,0 +1,400 @@
+// handlers/wallet_handler.go
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/checkout/session"
+)
+
+const (
+	minWalletTopUp = 500     // $5.00
+	maxWalletTopUp = 1000000 // $10,000.00
+)
+
+var (
+	ErrInsufficientFunds   = errors.New("insufficient wallet balance")
+	ErrWalletReferenceUsed = errors.New("wallet entry reference already used for a different amount")
+)
+
+// walletCreditValidity is how long wallet credit lasts after the last top-up,
+// configured in days through WALLET_CREDIT_VALIDITY_DAYS. Zero disables expiry.
+func walletCreditValidity() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("WALLET_CREDIT_VALIDITY_DAYS"))
+	if err != nil || days < 0 {
+		days = 365
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// ApplyWalletEntry appends an entry to the user's wallet ledger and updates the
+// balance in one transaction. The wallet row is locked for the duration so that
+// concurrent spends are serialised and can never take the balance below zero.
+// An entry of the same type with a reference that was already applied is
+// returned unchanged, unless its amount differs, which is an error.
+func ApplyWalletEntry(db *gorm.DB, userID uuid.UUID, entryType string, amount int64, reference string, description string) (*models.WalletEntry, error) {
+	var entry models.WalletEntry
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		wallet, err := lockWallet(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		if reference != "" {
+			err := tx.Where("user_id = ? AND type = ? AND reference = ?", userID, entryType, reference).First(&entry).Error
+			if err == nil {
+				if entry.Amount != amount {
+					return ErrWalletReferenceUsed
+				}
+				return nil
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+
+		if err := expireWalletCredit(tx, wallet); err != nil {
+			return err
+		}
+
+		if wallet.Balance+amount < 0 {
+			return ErrInsufficientFunds
+		}
+
+		entry, err = appendWalletEntry(tx, wallet, entryType, amount, reference, description)
+		if err != nil {
+			return err
+		}
+
+		if entryType == models.WalletEntryTopUp {
+			if validity := walletCreditValidity(); validity > 0 {
+				expiresAt := time.Now().Add(validity)
+				wallet.ExpiresAt = &expiresAt
+			}
+		}
+
+		return tx.Save(wallet).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// lockWallet returns the user's wallet, creating it if needed, locked until
+// the end of the transaction.
+func lockWallet(tx *gorm.DB, userID uuid.UUID) (*models.Wallet, error) {
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Wallet{UserID: userID}).Error; err != nil {
+		return nil, err
+	}
+
+	var wallet models.Wallet
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&wallet, "user_id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	return &wallet, nil
+}
+
+func appendWalletEntry(tx *gorm.DB, wallet *models.Wallet, entryType string, amount int64, reference string, description string) (models.WalletEntry, error) {
+	wallet.Balance += amount
+
+	entry := models.WalletEntry{
+		UserID:       wallet.UserID,
+		Type:         entryType,
+		Amount:       amount,
+		BalanceAfter: wallet.Balance,
+		Reference:    reference,
+		Description:  description,
+	}
+
+	return entry, tx.Create(&entry).Error
+}
+
+// expireWalletCredit writes off the remaining balance of a locked wallet whose
+// credit has expired.
+func expireWalletCredit(tx *gorm.DB, wallet *models.Wallet) error {
+	if wallet.ExpiresAt == nil || wallet.ExpiresAt.After(time.Now()) || wallet.Balance <= 0 {
+		return nil
+	}
+
+	if _, err := appendWalletEntry(tx, wallet, models.WalletEntryExpiry, -wallet.Balance, "", "Credit expired"); err != nil {
+		return err
+	}
+	wallet.ExpiresAt = nil
+
+	return tx.Save(wallet).Error
+}
+
+// ExpireWallets writes off the balance of every wallet whose credit expired.
+func ExpireWallets(db *gorm.DB) error {
+	var userIDs []uuid.UUID
+	if err := db.Model(&models.Wallet{}).Where("expires_at < ? AND balance > 0", time.Now()).Pluck("user_id", &userIDs).Error; err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			wallet, err := lockWallet(tx, userID)
+			if err != nil {
+				return err
+			}
+			return expireWalletCredit(tx, wallet)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetWallet(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var wallet models.Wallet
+		err := db.Transaction(func(tx *gorm.DB) error {
+			locked, err := lockWallet(tx, id)
+			if err != nil {
+				return err
+			}
+			if err := expireWalletCredit(tx, locked); err != nil {
+				return err
+			}
+			wallet = *locked
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wallet"})
+			return
+		}
+
+		var entries []models.WalletEntry
+		if err := db.Where("user_id = ?", id).Order("created_at DESC").Limit(50).Find(&entries).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wallet entries"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"balance":    wallet.Balance,
+			"currency":   string(stripe.CurrencyUSD),
+			"expires_at": wallet.ExpiresAt,
+			"entries":    entries,
+		})
+	}
+}
+
+func SpendWallet(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("user_id")
+		id, ok := userID.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		var spendRequest struct {
+			Amount      int64  `json:"amount" binding:"required,min=1"` // In cents
+			Reference   string `json:"reference" binding:"max=255"`
+			Description string `json:"description"`
+		}
+
+		if err := c.ShouldBindJSON(&spendRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		entry, err := ApplyWalletEntry(db, id, models.WalletEntrySpend, -spendRequest.Amount, spendRequest.Reference, spendRequest.Description)
+		switch {
+		case errors.Is(err, ErrInsufficientFunds):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient wallet balance"})
+			return
+		case errors.Is(err, ErrWalletReferenceUsed):
+			c.JSON(http.StatusConflict, gin.H{"error": "Reference already used for a different amount"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to spend from wallet"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Wallet charged successfully",
+			"entry":   entry,
+		})
+	}
+}
+
+// RefundWallet credits a user's wallet back, for example after a failed
+// consumption. Admin only.
+func RefundWallet(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var refundRequest struct {
+			UserID      uuid.UUID `json:"user_id" binding:"required"`
+			Amount      int64     `json:"amount" binding:"required,min=1"` // In cents
+			Reference   string    `json:"reference" binding:"max=255"`
+			Description string    `json:"description"`
+		}
+
+		if err := c.ShouldBindJSON(&refundRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var user models.CustomUser
+		if err := db.First(&user, refundRequest.UserID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		entry, err := ApplyWalletEntry(db, user.ID, models.WalletEntryRefund, refundRequest.Amount, refundRequest.Reference, refundRequest.Description)
+		if errors.Is(err, ErrWalletReferenceUsed) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Reference already used for a different amount"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund wallet"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Wallet refunded successfully",
+			"entry":   entry,
+		})
+	}
+}
+
+func CreateWalletTopUp(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+		userID, _ := c.Get("user_id")
+
+		var topUpRequest struct {
+			Amount     int64  `json:"amount" binding:"required"` // In cents
+			SuccessURL string `json:"success_url" binding:"required,url"`
+			CancelURL  string `json:"cancel_url" binding:"required,url"`
+		}
+
+		if err := c.ShouldBindJSON(&topUpRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if topUpRequest.Amount < minWalletTopUp || topUpRequest.Amount > maxWalletTopUp {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Top-up amount must be between %d and %d cents", minWalletTopUp, maxWalletTopUp)})
+			return
+		}
+
+		var user models.CustomUser
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		topUp := models.WalletTopUp{
+			UserID: user.ID,
+			Amount: topUpRequest.Amount,
+			Status: models.PurchaseStatusPending,
+		}
+
+		if err := db.Create(&topUp).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create top-up"})
+			return
+		}
+
+		params := &stripe.CheckoutSessionParams{
+			Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
+			CustomerEmail:     stripe.String(user.Email),
+			ClientReferenceID: stripe.String(topUp.ID.String()),
+			SuccessURL:        stripe.String(topUpRequest.SuccessURL),
+			CancelURL:         stripe.String(topUpRequest.CancelURL),
+			LineItems: []*stripe.CheckoutSessionLineItemParams{
+				{
+					PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+						Currency:   stripe.String(string(stripe.CurrencyUSD)),
+						UnitAmount: stripe.Int64(topUp.Amount),
+						ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+							Name: stripe.String("Wallet top-up"),
+						},
+					},
+					Quantity: stripe.Int64(1),
+				},
+			},
+			Metadata: map[string]string{
+				"wallet_top_up_id": topUp.ID.String(),
+			},
+		}
+		if key := stripeIdempotencyKey(c, "wallet-checkout-session"); key != "" {
+			params.SetIdempotencyKey(key)
+		}
+		params.Context = c.Request.Context()
+		checkoutSession, err := session.New(params)
+		if err != nil {
+			db.Delete(&topUp)
+			respondStripeError(c, err, "Failed to create Stripe checkout session")
+			return
+		}
+
+		topUp.StripeCheckoutSessionID = checkoutSession.ID
+		if err := db.Save(&topUp).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update top-up"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":      "Checkout session created successfully",
+			"top_up":       topUp,
+			"checkout_url": checkoutSession.URL,
+		})
+	}
+}
+
+// completeWalletTopUp credits the wallet for a paid top-up. The ledger entry is
+// keyed by the top-up so that a redelivered webhook credits it only once.
+func completeWalletTopUp(db *gorm.DB, checkoutSession *stripe.CheckoutSession) error {
+	var topUp models.WalletTopUp
+	if err := db.Where("stripe_checkout_session_id = ?", checkoutSession.ID).First(&topUp).Error; err != nil {
+		return err
+	}
+
+	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		return nil
+	}
+
+	if _, err := ApplyWalletEntry(db, topUp.UserID, models.WalletEntryTopUp, topUp.Amount, "top_up:"+topUp.ID.String(), "Wallet top-up"); err != nil {
+		return err
+	}
+
+	topUp.Status = models.PurchaseStatusPaid
+	if checkoutSession.PaymentIntent != nil {
+		topUp.StripePaymentIntentID = checkoutSession.PaymentIntent.ID
+	}
+
+	return db.Save(&topUp).Error
+}
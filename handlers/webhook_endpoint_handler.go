@@ -0,0 +1,237 @@
+// handlers/webhook_endpoint_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/webhooks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// validWebhookEndpoint checks the URL and event types of an endpoint.
+func validWebhookEndpoint(rawURL string, eventTypes []string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return "URL must be an absolute http or https URL"
+	}
+	if len(eventTypes) == 0 {
+		return "At least one event type is required"
+	}
+	for _, eventType := range eventTypes {
+		if !webhooks.IsEventType(eventType) {
+			return "Unknown event type: " + eventType
+		}
+	}
+	return ""
+}
+
+// CreateWebhookEndpoint registers an endpoint. The signing secret is only
+// returned here; one is generated unless given. Admin only.
+func CreateWebhookEndpoint(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var input struct {
+			URL         string   `json:"url" binding:"required"`
+			Description string   `json:"description"`
+			EventTypes  []string `json:"event_types" binding:"required"`
+			Secret      string   `json:"secret" binding:"omitempty,min=16,max=100"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if message := validWebhookEndpoint(input.URL, input.EventTypes); message != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": message})
+			return
+		}
+
+		secret := input.Secret
+		if secret == "" {
+			var err error
+			if secret, err = webhooks.GenerateSecret(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+				return
+			}
+		}
+
+		endpoint := models.WebhookEndpoint{
+			URL:         input.URL,
+			Description: input.Description,
+			EventTypes:  input.EventTypes,
+			Secret:      secret,
+			Active:      true,
+			CreatedByID: userID.(uuid.UUID),
+		}
+
+		if err := db.Create(&endpoint).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook endpoint"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"endpoint": endpoint, "secret": secret})
+	}
+}
+
+// GetWebhookEndpoints lists the registered endpoints. Admin only.
+func GetWebhookEndpoints(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var endpoints []models.WebhookEndpoint
+		if err := db.Order("created_at").Find(&endpoints).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook endpoints"})
+			return
+		}
+
+		c.JSON(http.StatusOK, endpoints)
+	}
+}
+
+// UpdateWebhookEndpoint changes an endpoint's URL, description, event types or
+// whether it is active. Admin only.
+func UpdateWebhookEndpoint(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var endpoint models.WebhookEndpoint
+		if err := db.First(&endpoint, "id = ?", c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook endpoint not found"})
+			return
+		}
+
+		var input struct {
+			URL         *string  `json:"url"`
+			Description *string  `json:"description"`
+			EventTypes  []string `json:"event_types"`
+			Active      *bool    `json:"active"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if input.URL != nil {
+			endpoint.URL = *input.URL
+		}
+		if input.Description != nil {
+			endpoint.Description = *input.Description
+		}
+		if input.EventTypes != nil {
+			endpoint.EventTypes = input.EventTypes
+		}
+		if input.Active != nil {
+			endpoint.Active = *input.Active
+		}
+		if message := validWebhookEndpoint(endpoint.URL, endpoint.EventTypes); message != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": message})
+			return
+		}
+
+		if err := db.Save(&endpoint).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook endpoint"})
+			return
+		}
+
+		c.JSON(http.StatusOK, endpoint)
+	}
+}
+
+// DeleteWebhookEndpoint removes an endpoint. Queued deliveries to it are
+// dropped. Admin only.
+func DeleteWebhookEndpoint(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		result := db.Delete(&models.WebhookEndpoint{}, "id = ?", c.Param("id"))
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook endpoint"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook endpoint not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook endpoint deleted successfully"})
+	}
+}
+
+// GetWebhookDeliveries lists the delivery attempts to an endpoint, newest
+// first, optionally only the failed ones. Admin only.
+func GetWebhookDeliveries(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		query := db.Where("endpoint_id = ?", c.Param("id")).Order("created_at DESC").Limit(100)
+		if c.Query("failed") == "true" {
+			query = query.Where("succeeded = ?", false)
+		}
+
+		var deliveries []models.WebhookDelivery
+		if err := query.Find(&deliveries).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook deliveries"})
+			return
+		}
+
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// ReplayWebhookDelivery sends the event of a logged delivery to its endpoint
+// again. Admin only.
+func ReplayWebhookDelivery(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists || !isUserAdmin(db, userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+
+		var delivery models.WebhookDelivery
+		if err := db.First(&delivery, "id = ?", c.Param("delivery_id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook delivery not found"})
+			return
+		}
+
+		err := webhooks.Replay(db, delivery.EndpointID, delivery.EventID)
+		if errors.Is(err, jobs.ErrDuplicateJob) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A delivery of this event is already queued"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replay webhook delivery"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "Webhook delivery queued"})
+	}
+}
@@ -0,0 +1,316 @@
+// handlers/webhook_handler.go
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/notify"
+	"github.com/yeboahd24/subscription-stripe/utils"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/webhook"
+)
+
+// StripeWebhook receives events from Stripe. The payload is verified with the
+// STRIPE_WEBHOOK_SECRET signing secret before anything is processed.
+func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		payload, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		event, err := webhook.ConstructEventWithOptions(payload, c.GetHeader("Stripe-Signature"), os.Getenv("STRIPE_WEBHOOK_SECRET"), webhook.ConstructEventOptions{
+			// The account's API version may differ from the one this SDK pins
+			IgnoreAPIVersionMismatch: true,
+		})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook signature"})
+			return
+		}
+
+		if err := handleStripeEvent(db, event); err != nil {
+			utils.Log("Error handling Stripe event", event.Type, event.ID, ":", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle webhook event"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"received": true})
+	}
+}
+
+func handleStripeEvent(db *gorm.DB, event stripe.Event) error {
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		var checkoutSession stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &checkoutSession); err != nil {
+			return err
+		}
+		if checkoutSession.Mode != stripe.CheckoutSessionModePayment {
+			return nil
+		}
+		switch {
+		case checkoutSession.Metadata["gift_id"] != "":
+			return completeGiftPayment(db, &checkoutSession)
+		case checkoutSession.Metadata["wallet_top_up_id"] != "":
+			return completeWalletTopUp(db, &checkoutSession)
+		}
+		return completePurchase(db, &checkoutSession)
+
+	case "checkout.session.expired":
+		var checkoutSession stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &checkoutSession); err != nil {
+			return err
+		}
+		switch {
+		case checkoutSession.Metadata["gift_id"] != "":
+			return db.Model(&models.Gift{}).
+				Where("id = ? AND status = ?", checkoutSession.Metadata["gift_id"], models.GiftStatusPending).
+				Where("stripe_checkout_session_id IN ?", []string{checkoutSession.ID, ""}).
+				Update("status", models.GiftStatusExpired).Error
+		case checkoutSession.Metadata["wallet_top_up_id"] != "":
+			return db.Model(&models.WalletTopUp{}).
+				Where("stripe_checkout_session_id = ? AND status = ?", checkoutSession.ID, models.PurchaseStatusPending).
+				Update("status", models.PurchaseStatusExpired).Error
+		}
+		return db.Model(&models.Purchase{}).
+			Where("stripe_checkout_session_id = ? AND status = ?", checkoutSession.ID, models.PurchaseStatusPending).
+			Update("status", models.PurchaseStatusExpired).Error
+
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return err
+		}
+		if charge.PaymentIntent == nil || !charge.Refunded {
+			return nil
+		}
+		// A refunded gift can no longer be redeemed
+		if err := db.Model(&models.Gift{}).
+			Where("stripe_payment_intent_id = ? AND status = ?", charge.PaymentIntent.ID, models.GiftStatusPaid).
+			Update("status", models.GiftStatusCancelled).Error; err != nil {
+			return err
+		}
+		return db.Model(&models.Purchase{}).
+			Where("stripe_payment_intent_id = ?", charge.PaymentIntent.ID).
+			Update("status", models.PurchaseStatusRefunded).Error
+
+	case "invoice.payment_failed", "invoice.paid":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		if event.Type == "invoice.payment_failed" {
+			if invoice.Subscription == nil {
+				return nil
+			}
+			return updateSubscriptionStatus(db, invoice.Subscription.ID, models.SubscriptionStatusPastDue, models.EventSourceWebhook)
+		}
+		if invoice.Subscription != nil {
+			if err := recoverSubscriptionPayment(db, invoice.Subscription.ID); err != nil {
+				return err
+			}
+			// Trials are invoiced at zero; a referral converts on the first payment
+			if invoice.AmountPaid > 0 {
+				if err := convertInvoiceReferral(context.Background(), db, invoice.Subscription.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return sendReceipt(db, &invoice)
+
+	case "customer.subscription.updated":
+		var stripeSub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &stripeSub); err != nil {
+			return err
+		}
+		if err := syncSubscriptionPlan(db, &stripeSub); err != nil {
+			return err
+		}
+		if err := syncBilledPrices(db, stripeSub.ID, billedPricesFromEvent(&stripeSub)); err != nil {
+			return err
+		}
+		return updateSubscriptionStatus(db, stripeSub.ID, models.SubscriptionStatusFromStripe(string(stripeSub.Status)), models.EventSourceWebhook)
+
+	case "customer.subscription.deleted":
+		var stripeSub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &stripeSub); err != nil {
+			return err
+		}
+		return updateSubscriptionStatus(db, stripeSub.ID, models.SubscriptionStatusCanceled, models.EventSourceWebhook)
+	}
+
+	return nil
+}
+
+// updateSubscriptionStatus moves the subscription behind a Stripe subscription
+// to the given status, on behalf of the webhook or a job. Subscriptions already in that status are left alone so
+// that redelivered events are not recorded twice, and moves the lifecycle does
+// not allow, such as from out-of-order events, are logged and skipped.
+func updateSubscriptionStatus(db *gorm.DB, stripeSubscriptionID string, status models.SubscriptionStatus, source string) error {
+	var subscription models.Subscription
+	if err := db.Preload("Items").Where("stripe_id = ?", stripeSubscriptionID).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if subscription.Status == status {
+		return nil
+	}
+	// The trial Stripe reports for billing deferred by an admin is not one
+	if status == models.SubscriptionStatusTrialing && subscription.BillingDeferred() {
+		return nil
+	}
+
+	before := subscription.Snapshot()
+	if status == models.SubscriptionStatusCanceled {
+		subscription.EndDate = time.Now()
+	}
+
+	err := transitionSubscription(db, &subscription, before, status, nil, source)
+	var invalidTransition *models.InvalidTransitionError
+	if errors.As(err, &invalidTransition) {
+		utils.Log("Skipping Stripe status change for subscription", subscription.ID, ":", err)
+		return nil
+	}
+	return err
+}
+
+// recoverSubscriptionPayment reactivates a past due subscription once an
+// invoice is paid.
+func recoverSubscriptionPayment(db *gorm.DB, stripeSubscriptionID string) error {
+	var subscription models.Subscription
+	if err := db.Where("stripe_id = ? AND status IN ?", stripeSubscriptionID, []models.SubscriptionStatus{models.SubscriptionStatusPastDue, models.SubscriptionStatusUnpaid}).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	return updateSubscriptionStatus(db, stripeSubscriptionID, models.SubscriptionStatusActive, models.EventSourceWebhook)
+}
+
+// billedPricesFromEvent returns what Stripe bills for the subscription of a
+// webhook event. Coupons that only apply to one invoice are not recurring
+// discounts and are left out.
+func billedPricesFromEvent(stripeSub *stripe.Subscription) billedPrices {
+	var prices billedPrices
+	if stripeSub.Items != nil {
+		for _, stripeItem := range stripeSub.Items.Data {
+			billed := billedItem{StripeItemID: stripeItem.ID, Quantity: stripeItem.Quantity}
+			if stripeItem.Price != nil {
+				billed.StripePriceID = stripeItem.Price.ID
+				billed.UnitAmount = stripeItem.Price.UnitAmount
+				if stripeItem.Price.Recurring != nil {
+					billed.Interval = string(stripeItem.Price.Recurring.Interval)
+					billed.IntervalCount = stripeItem.Price.Recurring.IntervalCount
+				}
+			}
+			prices.Items = append(prices.Items, billed)
+		}
+	}
+	if stripeSub.Discount != nil && stripeSub.Discount.Coupon != nil && stripeSub.Discount.Coupon.Duration != stripe.CouponDurationOnce {
+		prices.PercentOff = stripeSub.Discount.Coupon.PercentOff
+		prices.AmountOff = stripeSub.Discount.Coupon.AmountOff
+	}
+	return prices
+}
+
+// syncSubscriptionPlan applies a change of the base plan's price made in
+// Stripe, for example from the customer portal, to the local subscription.
+func syncSubscriptionPlan(db *gorm.DB, stripeSub *stripe.Subscription) error {
+	if stripeSub.Items == nil {
+		return nil
+	}
+
+	var subscription models.Subscription
+	if err := db.Preload("Items").Where("stripe_id = ?", stripeSub.ID).First(&subscription).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	for i, item := range subscription.Items {
+		if item.Kind != models.ProductKindBase {
+			continue
+		}
+		for _, stripeItem := range stripeSub.Items.Data {
+			if stripeItem.ID != item.StripeItemID || stripeItem.Price == nil || stripeItem.Price.ID == item.StripePriceID {
+				continue
+			}
+
+			var product models.Product
+			if err := db.Where("stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?", stripeItem.Price.ID, stripeItem.Price.ID).First(&product).Error; err != nil {
+				utils.Log("No product found for Stripe price", stripeItem.Price.ID)
+				return nil
+			}
+
+			before := subscription.Snapshot()
+			plan := "monthly"
+			if product.StripeYearlyPriceID == stripeItem.Price.ID {
+				plan = "yearly"
+			}
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&subscription.Items[i]).Updates(map[string]interface{}{
+					"product_id":      product.ID,
+					"stripe_price_id": stripeItem.Price.ID,
+					"quantity":        stripeItem.Quantity,
+				}).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&subscription).Updates(map[string]interface{}{
+					"product_id": product.ID,
+					"plan":       plan,
+				}).Error; err != nil {
+					return err
+				}
+				subscription.ProductID = product.ID
+				subscription.Plan = plan
+				subscription.Items[i].ProductID = product.ID
+				subscription.Items[i].StripePriceID = stripeItem.Price.ID
+				subscription.Items[i].Quantity = stripeItem.Quantity
+
+				return recordSubscriptionEvent(tx, models.SubscriptionEventPlanChanged, &before, subscription, nil, models.EventSourceWebhook)
+			})
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendReceipt emails a receipt for a paid invoice to the customer's billing
+// email.
+func sendReceipt(db *gorm.DB, invoice *stripe.Invoice) error {
+	if invoice.CustomerEmail == "" || invoice.AmountPaid == 0 {
+		return nil
+	}
+
+	paidAt := time.Now()
+	if invoice.StatusTransitions != nil && invoice.StatusTransitions.PaidAt > 0 {
+		paidAt = time.Unix(invoice.StatusTransitions.PaidAt, 0)
+	}
+
+	return notify.Enqueue(db, invoice.CustomerEmail, notify.TemplateReceipt, map[string]interface{}{
+		"Amount":        fmt.Sprintf("%.2f %s", float64(invoice.AmountPaid)/100, strings.ToUpper(string(invoice.Currency))),
+		"InvoiceNumber": invoice.Number,
+		"InvoiceURL":    invoice.HostedInvoiceURL,
+		"PaidAt":        formatEmailDate(paidAt),
+	}, "receipt:"+invoice.ID)
+}
@@ -0,0 +1,355 @@
+// File: jobs/queue.go
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Task is a typed job payload. Kind names the handler that processes it and
+// must not depend on the task's fields, as it is called on the zero value.
+type Task interface {
+	Kind() string
+}
+
+// EnqueueOptions tune a single job. The zero value runs the job as soon as a
+// worker is free, with the default number of attempts.
+type EnqueueOptions struct {
+	// UniqueKey deduplicates jobs: while a job with the key is pending or
+	// running, enqueueing another one with it is a no-op
+	UniqueKey   string
+	RunAt       time.Time
+	MaxAttempts int // Default 5
+}
+
+var (
+	ErrDuplicateJob = errors.New("an unfinished job with this unique key already exists")
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobRunning   = errors.New("job is running")
+	ErrJobNotFailed = errors.New("only dead or discarded jobs can be retried")
+)
+
+const defaultMaxAttempts = 5
+
+// Enqueue stores a task on the queue. Pass a transaction as db to enqueue the
+// job only if the transaction commits. It returns ErrDuplicateJob if the
+// task's unique key is already taken.
+func Enqueue(db *gorm.DB, task Task, opts EnqueueOptions) (*models.QueuedJob, error) {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s task: %w", task.Kind(), err)
+	}
+
+	job := models.QueuedJob{
+		Kind:        task.Kind(),
+		Payload:     payload,
+		Status:      models.QueuedJobStatusPending,
+		RunAt:       opts.RunAt,
+		MaxAttempts: opts.MaxAttempts,
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.UniqueKey != "" {
+		job.UniqueKey = &opts.UniqueKey
+	}
+
+	result := db.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "unique_key"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "finished_at IS NULL"}}},
+		DoNothing:   true,
+	}).Create(&job)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrDuplicateJob
+	}
+
+	return &job, nil
+}
+
+// Retry puts a dead or discarded job back on the queue to run now with a
+// fresh set of attempts. Pending, running and succeeded jobs cannot be
+// retried.
+func Retry(db *gorm.DB, id uuid.UUID) (*models.QueuedJob, error) {
+	var job models.QueuedJob
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&job, "id = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrJobNotFound
+			}
+			return err
+		}
+		switch job.Status {
+		case models.QueuedJobStatusDead, models.QueuedJobStatusDiscarded:
+		case models.QueuedJobStatusRunning:
+			return ErrJobRunning
+		default:
+			return ErrJobNotFailed
+		}
+
+		if job.UniqueKey != nil {
+			var count int64
+			if err := tx.Model(&models.QueuedJob{}).
+				Where("unique_key = ? AND finished_at IS NULL AND id != ?", *job.UniqueKey, job.ID).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrDuplicateJob
+			}
+		}
+
+		job.Status = models.QueuedJobStatusPending
+		job.RunAt = time.Now()
+		job.Attempts = 0
+		job.FinishedAt = nil
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// Discard takes a job off the queue without running it. The job is kept for
+// inspection.
+func Discard(db *gorm.DB, id uuid.UUID) (*models.QueuedJob, error) {
+	var job models.QueuedJob
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&job, "id = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrJobNotFound
+			}
+			return err
+		}
+		if job.Status == models.QueuedJobStatusRunning {
+			return ErrJobRunning
+		}
+
+		now := time.Now()
+		job.Status = models.QueuedJobStatusDiscarded
+		job.FinishedAt = &now
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a handler error as not worth retrying; the job goes
+// straight to the dead letters.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+type handlerFunc func(ctx context.Context, payload json.RawMessage) error
+
+// Queue processes queued jobs with a pool of workers. Workers on every
+// replica claim jobs with FOR UPDATE SKIP LOCKED, so each job is handed to
+// one worker at a time.
+type Queue struct {
+	db          *gorm.DB
+	host        string
+	concurrency int
+	handlers    map[string]handlerFunc
+
+	// PollInterval is how long an idle worker waits before looking for jobs
+	// again, RetryDelay the backoff after the first failed attempt (doubling
+	// up to an hour), and LockTimeout how long a job may run before it is
+	// cancelled and another worker may claim it.
+	PollInterval time.Duration
+	RetryDelay   time.Duration
+	LockTimeout  time.Duration
+}
+
+func NewQueue(db *gorm.DB, concurrency int) *Queue {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Queue{
+		db:           db,
+		host:         fmt.Sprintf("%s:%d", host, os.Getpid()),
+		concurrency:  concurrency,
+		handlers:     make(map[string]handlerFunc),
+		PollInterval: time.Second,
+		RetryDelay:   10 * time.Second,
+		LockTimeout:  15 * time.Minute,
+	}
+}
+
+// Handle registers fn to process tasks of type T. It must be called before
+// Start.
+func Handle[T Task](q *Queue, fn func(ctx context.Context, task T) error) {
+	var zero T
+	q.handlers[zero.Kind()] = func(ctx context.Context, payload json.RawMessage) error {
+		var task T
+		if err := json.Unmarshal(payload, &task); err != nil {
+			return Permanent(fmt.Errorf("decoding payload: %w", err))
+		}
+		return fn(ctx, task)
+	}
+}
+
+// Start runs the workers until ctx is cancelled and waits for them to finish
+// their current jobs.
+func (q *Queue) Start(ctx context.Context) {
+	kinds := make([]string, 0, len(q.handlers))
+	for kind := range q.handlers {
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.concurrency; i++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			q.work(ctx, worker, kinds)
+		}(fmt.Sprintf("%s:%d", q.host, i))
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context, worker string, kinds []string) {
+	for ctx.Err() == nil {
+		job, err := q.claim(ctx, worker, kinds)
+		if err != nil && ctx.Err() == nil {
+			utils.Log("Error claiming job:", err)
+		}
+		if job == nil {
+			if !sleep(ctx, q.PollInterval) {
+				return
+			}
+			continue
+		}
+
+		q.process(ctx, worker, job)
+	}
+}
+
+// claim locks the next due job this queue can handle and marks it running.
+// Running jobs whose lock timed out, for example because their worker
+// crashed, are claimed again.
+func (q *Queue) claim(ctx context.Context, worker string, kinds []string) (*models.QueuedJob, error) {
+	var job models.QueuedJob
+	claimed := false
+
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("kind IN ?", kinds).
+			Where("(status = ? AND run_at <= ?) OR (status = ? AND locked_at < ?)",
+				models.QueuedJobStatusPending, now, models.QueuedJobStatusRunning, now.Add(-q.LockTimeout)).
+			Order("run_at").
+			Limit(1).
+			Find(&job)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		job.Status = models.QueuedJobStatusRunning
+		job.Attempts++
+		job.LockedBy = worker
+		job.LockedAt = &now
+		claimed = true
+		return tx.Save(&job).Error
+	})
+	if err != nil || !claimed {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (q *Queue) process(ctx context.Context, worker string, job *models.QueuedJob) {
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// Claimed again after its worker stopped during the last attempt
+		err = Permanent(errors.New("worker stopped while running the job"))
+	} else {
+		runCtx, cancel := context.WithTimeout(ctx, q.LockTimeout)
+		err = q.call(runCtx, job)
+		cancel()
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"locked_by": "", "locked_at": nil}
+	var permanent permanentError
+	switch {
+	case err == nil:
+		updates["status"] = models.QueuedJobStatusSucceeded
+		updates["finished_at"] = now
+	case errors.As(err, &permanent) || job.Attempts >= job.MaxAttempts:
+		utils.Log("Job", job.ID, job.Kind, "failed permanently:", err)
+		updates["status"] = models.QueuedJobStatusDead
+		updates["finished_at"] = now
+		updates["last_error"] = err.Error()
+	default:
+		utils.Log("Job", job.ID, job.Kind, "attempt", job.Attempts, "failed:", err)
+		updates["status"] = models.QueuedJobStatusPending
+		updates["run_at"] = now.Add(q.backoff(job.Attempts))
+		updates["last_error"] = err.Error()
+	}
+
+	// Record the outcome even when shutting down, unless another worker has
+	// claimed the job since
+	result := q.db.WithContext(context.Background()).Model(&models.QueuedJob{}).
+		Where("id = ? AND status = ? AND locked_by = ?", job.ID, models.QueuedJobStatusRunning, worker).
+		Updates(updates)
+	if result.Error != nil {
+		utils.Log("Error saving job", job.ID, ":", result.Error)
+	}
+}
+
+// call runs the job's handler, turning a panic into an error.
+func (q *Queue) call(ctx context.Context, job *models.QueuedJob) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return q.handlers[job.Kind](ctx, job.Payload)
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.RetryDelay
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
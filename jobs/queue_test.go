@@ -0,0 +1,31 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueBackoff(t *testing.T) {
+	tests := []struct {
+		retryDelay time.Duration
+		attempts   int
+		want       time.Duration
+	}{
+		{10 * time.Second, 0, 10 * time.Second},
+		{10 * time.Second, 1, 10 * time.Second},
+		{10 * time.Second, 2, 20 * time.Second},
+		{10 * time.Second, 3, 40 * time.Second},
+		{10 * time.Second, 9, 2560 * time.Second},
+		{10 * time.Second, 10, time.Hour},
+		{10 * time.Second, 1000, time.Hour},
+		{45 * time.Minute, 2, time.Hour},
+		{2 * time.Hour, 1, time.Hour},
+	}
+
+	for _, tt := range tests {
+		q := &Queue{RetryDelay: tt.retryDelay}
+		if got := q.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) with RetryDelay %v = %v, want %v", tt.attempts, tt.retryDelay, got, tt.want)
+		}
+	}
+}
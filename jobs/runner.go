@@ -0,0 +1,204 @@
+// File: jobs/runner.go
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Job is a task run on a schedule by the Runner.
+type Job struct {
+	Name     string
+	Schedule string // Cron expression; see ParseSchedule
+	// Attempts is how many times a failing run is tried (default 3). Retries
+	// wait RetryDelay (default 30s), doubling after every attempt.
+	Attempts   int
+	RetryDelay time.Duration
+	Run        func(ctx context.Context) error
+}
+
+type scheduledJob struct {
+	Job
+	schedule Schedule
+}
+
+// Runner runs registered jobs on their schedules. Every replica of the
+// application can run one: a Postgres advisory lock elects a single leader
+// for each run, and job_runs makes sure a scheduled time is only run once.
+type Runner struct {
+	db   *gorm.DB
+	host string
+	jobs []scheduledJob
+}
+
+func NewRunner(db *gorm.DB) *Runner {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &Runner{db: db, host: host}
+}
+
+// Register adds a job to the runner. It must be called before Start.
+func (r *Runner) Register(job Job) error {
+	schedule, err := ParseSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", job.Name, err)
+	}
+	if job.Attempts < 1 {
+		job.Attempts = 3
+	}
+	if job.RetryDelay <= 0 {
+		job.RetryDelay = 30 * time.Second
+	}
+
+	r.jobs = append(r.jobs, scheduledJob{Job: job, schedule: schedule})
+	return nil
+}
+
+// Start runs every registered job on its schedule until ctx is cancelled.
+func (r *Runner) Start(ctx context.Context) {
+	for _, job := range r.jobs {
+		go r.loop(ctx, job)
+	}
+	<-ctx.Done()
+}
+
+func (r *Runner) loop(ctx context.Context, job scheduledJob) {
+	for {
+		next := job.schedule.Next(time.Now())
+		if next.IsZero() {
+			utils.Log("Job", job.Name, "has no next run and is stopped")
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := r.runOnce(ctx, job, next); err != nil {
+			utils.Log("Job", job.Name, "failed:", err)
+		}
+	}
+}
+
+var errNotLeader = errors.New("another replica holds the job lock")
+
+// runOnce runs the job for the given scheduled time if this replica wins the
+// job's advisory lock and the run has not been recorded yet.
+func (r *Runner) runOnce(ctx context.Context, job scheduledJob, scheduledAt time.Time) error {
+	err := r.db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		// Session-level advisory locks belong to the connection, so they are
+		// taken and released on the same one
+		key := lockKey(job.Name)
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?)", key).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return errNotLeader
+		}
+		// Unlock even when ctx was cancelled, or the pooled connection would
+		// keep the lock
+		defer conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(?)", key)
+
+		return r.execute(ctx, job, scheduledAt)
+	})
+
+	if errors.Is(err, errNotLeader) {
+		return nil
+	}
+	return err
+}
+
+func (r *Runner) execute(ctx context.Context, job scheduledJob, scheduledAt time.Time) error {
+	run := models.JobRun{
+		Job:         job.Name,
+		ScheduledAt: scheduledAt,
+		Status:      models.JobRunStatusRunning,
+		Host:        r.host,
+		StartedAt:   time.Now(),
+	}
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&run)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Another replica already ran this scheduled time
+		return nil
+	}
+
+	delay := job.RetryDelay
+	var err error
+	for {
+		run.Attempts++
+		err = r.call(ctx, job)
+		if err == nil || run.Attempts >= job.Attempts {
+			break
+		}
+		utils.Log("Job", job.Name, "attempt", run.Attempts, "failed:", err)
+
+		if !sleep(ctx, delay) {
+			err = ctx.Err()
+			break
+		}
+		delay *= 2
+	}
+
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.Status = models.JobRunStatusSucceeded
+	if err != nil {
+		run.Status = models.JobRunStatusFailed
+		run.Error = err.Error()
+	}
+	if saveErr := r.db.Save(&run).Error; saveErr != nil {
+		utils.Log("Error saving job run:", saveErr)
+	}
+
+	return err
+}
+
+// call runs the job, turning a panic into an error so that one broken job
+// cannot take down the process.
+func (r *Runner) call(ctx context.Context, job scheduledJob) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+// sleep waits for d, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// lockKey derives the advisory lock key for a job from its name.
+func lockKey(name string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte("jobs:" + name))
+	return int64(hash.Sum64())
+}
@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, minute, second int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"step", "*/15 * * * *", at(2024, 6, 7, 10, 7, 0), at(2024, 6, 7, 10, 15, 0)},
+		{"strictly after", "*/15 * * * *", at(2024, 6, 7, 10, 15, 0), at(2024, 6, 7, 10, 30, 0)},
+		{"seconds are dropped", "*/15 * * * *", at(2024, 6, 7, 10, 14, 59), at(2024, 6, 7, 10, 15, 0)},
+		{"list and range", "5,10-12 * * * *", at(2024, 6, 7, 10, 5, 0), at(2024, 6, 7, 10, 10, 0)},
+		{"stepped range", "0 8-17/4 * * *", at(2024, 6, 7, 12, 0, 0), at(2024, 6, 7, 16, 0, 0)},
+		{"next hour", "30 * * * *", at(2024, 6, 7, 10, 45, 0), at(2024, 6, 7, 11, 30, 0)},
+		{"weekdays skip the weekend", "0 9 * * 1-5", at(2024, 6, 7, 10, 0, 0), at(2024, 6, 10, 9, 0, 0)},
+		{"day of month or day of week", "0 0 13 * 5", at(2024, 6, 8, 0, 0, 0), at(2024, 6, 13, 0, 0, 0)},
+		{"day of week or day of month", "0 0 13 * 5", at(2024, 6, 13, 0, 0, 0), at(2024, 6, 14, 0, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(2024, 3, 1, 0, 0, 0), at(2028, 2, 29, 0, 0, 0)},
+		{"end of year", "0 0 1 1 *", at(2024, 12, 31, 23, 59, 0), at(2025, 1, 1, 0, 0, 0)},
+		{"hourly", "@hourly", at(2024, 6, 7, 10, 0, 0), at(2024, 6, 7, 11, 0, 0)},
+		{"daily", "@daily", at(2024, 6, 7, 0, 0, 0), at(2024, 6, 8, 0, 0, 0)},
+		{"weekly", "@weekly", at(2024, 6, 7, 10, 0, 0), at(2024, 6, 9, 0, 0, 0)},
+		{"monthly", "@monthly", at(2024, 1, 31, 12, 0, 0), at(2024, 2, 1, 0, 0, 0)},
+		{"every", "@every 5m", at(2024, 6, 7, 10, 7, 30), at(2024, 6, 7, 10, 10, 0)},
+		{"every from a multiple", "@every 1h", at(2024, 6, 7, 10, 0, 0), at(2024, 6, 7, 11, 0, 0)},
+		{"other time zones", "30 * * * *", time.Date(2024, 6, 7, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60)), at(2024, 6, 7, 8, 30, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseSchedule(%q): %v", tt.spec, err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@yearly",
+		"@every 10ms",
+		"@every x",
+		"0 0 31 2 *",
+		"0 0 30,31 2 *",
+		"0 0 31 4,6,9,11 *",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// File: metrics/cohorts.go
+package metrics
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// Kinds of signup a cohort report can be limited to
+const (
+	SignupTrial  = "trial"  // Subscriptions that started with a trial
+	SignupDirect = "direct" // Subscriptions that started paying straight away
+)
+
+// CohortQuery selects the signup months a cohort report covers, both
+// inclusive, and the subscriptions it includes.
+type CohortQuery struct {
+	From      time.Time // Any time in the first month
+	To        time.Time // Any time in the last month
+	ProductID *uuid.UUID
+	Plan      string
+	Signup    string // Empty, SignupTrial or SignupDirect
+}
+
+// Cohort is the subscribers who first subscribed in one month. Retained[n] is
+// how many of them were subscribed at the end of the n-th month after it, or
+// now for the current month; Retention[n] is the same as a share of Size.
+type Cohort struct {
+	Month     string    `json:"month"`
+	Size      int       `json:"size"`
+	Retained  []int     `json:"retained"`
+	Retention []float64 `json:"retention"`
+}
+
+// CohortReport is the retention of every monthly cohort in a range.
+type CohortReport struct {
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	ProductID *uuid.UUID `json:"product_id,omitempty"`
+	Plan      string     `json:"plan,omitempty"`
+	Signup    string     `json:"signup,omitempty"`
+	Cohorts   []Cohort   `json:"cohorts"`
+}
+
+// Month returns the first instant of the UTC month t falls in.
+func Month(t time.Time) time.Time {
+	year, month, _ := t.UTC().Date()
+	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Cohorts builds the cohort report for q from the subscriptions and their
+// history. Subscribers are counted rather than subscriptions: users for their
+// personal subscriptions and organizations for theirs. A subscriber belongs to
+// the month of their first start date, and each of their subscriptions is
+// live while its events leave it in a status that grants access: from its
+// start date until it is paused, unpaid or canceled, and again once it is
+// resumed or paid. Canceling and subscribing again is neither churn nor a new
+// signup once the new subscription has started. Subscriptions that never
+// started, such as ones whose creation failed, have no created or
+// trial_started event and are left out.
+func Cohorts(db *gorm.DB, q CohortQuery) (*CohortReport, error) {
+	from, to := Month(q.From), Month(q.To)
+	if from.After(to) {
+		return nil, ErrInvalidRange
+	}
+	now := time.Now().UTC()
+
+	report := &CohortReport{
+		From:      from.Format("2006-01"),
+		To:        to.Format("2006-01"),
+		ProductID: q.ProductID,
+		Plan:      q.Plan,
+		Signup:    q.Signup,
+		Cohorts:   []Cohort{},
+	}
+	for month := from; !month.After(to) && !month.After(now); month = month.AddDate(0, 1, 0) {
+		// Offset 0 is the signup month itself, the last offset the current month
+		offsets := monthsBetween(month, Month(now)) + 1
+		report.Cohorts = append(report.Cohorts, Cohort{
+			Month:     month.Format("2006-01"),
+			Retained:  make([]int, offsets),
+			Retention: make([]float64, offsets),
+		})
+	}
+
+	started := []string{models.SubscriptionEventCreated, models.SubscriptionEventTrialStarted}
+	subscriptions := db.Table("subscriptions AS s").
+		Select(`COALESCE(s.organization_id, s.user_id) AS subscriber,
+			s.id, s.start_date, s.end_date, s.status, s.updated_at,
+			EXISTS (SELECT 1 FROM subscription_events e WHERE e.subscription_id = s.id AND e.type IN ? AND e.after->>'status' = ?) AS trial`,
+			started, models.SubscriptionStatusTrialing).
+		Where("s.start_date <= ?", now).
+		Where("EXISTS (SELECT 1 FROM subscription_events e WHERE e.subscription_id = s.id AND e.type IN ?)", started)
+	if q.ProductID != nil {
+		subscriptions = subscriptions.Where("s.product_id = ?", *q.ProductID)
+	}
+	if q.Plan != "" {
+		subscriptions = subscriptions.Where("s.plan = ?", q.Plan)
+	}
+	firstStarts := db.Table("(?) AS subscriptions", subscriptions).
+		Select("*, MIN(start_date) OVER (PARTITION BY subscriber) AS first_start")
+	inRange := db.Table("(?) AS subscribers", firstStarts).
+		Where("first_start >= ? AND first_start < ?", from, to.AddDate(0, 1, 0))
+
+	changes, err := statusChanges(db, inRange)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := inRange.Order("subscriber, start_date").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []subscriber
+	var last uuid.UUID
+	for rows.Next() {
+		var row struct {
+			Subscriber uuid.UUID
+			ID         uuid.UUID
+			StartDate  time.Time
+			EndDate    time.Time
+			Status     models.SubscriptionStatus
+			UpdatedAt  time.Time
+			Trial      bool
+		}
+		if err := db.ScanRows(rows, &row); err != nil {
+			return nil, err
+		}
+
+		if len(subscribers) == 0 || row.Subscriber != last {
+			subscribers = append(subscribers, subscriber{Trial: row.Trial})
+			last = row.Subscriber
+		}
+		// Without an event for its last change, a subscription that no longer
+		// grants access ended when it was last updated, or for legacy
+		// cancellations on its end date
+		ended := row.UpdatedAt
+		if row.Status == models.SubscriptionStatusCanceled && !row.EndDate.IsZero() {
+			ended = row.EndDate
+		}
+		current := &subscribers[len(subscribers)-1]
+		current.Spans = append(current.Spans, subscriptionSpans(row.StartDate, changes[row.ID], row.Status, ended)...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range subscribers {
+		spans := subscribers[i].Spans
+		sort.SliceStable(spans, func(a, b int) bool { return spans[a].Start.Before(spans[b].Start) })
+	}
+
+	// Signups are told apart by the subscriber's first subscription
+	included := subscribers[:0]
+	for _, subscriber := range subscribers {
+		if (q.Signup == SignupTrial && !subscriber.Trial) || (q.Signup == SignupDirect && subscriber.Trial) {
+			continue
+		}
+		included = append(included, subscriber)
+	}
+
+	countRetention(report.Cohorts, from, now, included)
+	return report, nil
+}
+
+// statusChange is the status a subscription event left a subscription in.
+type statusChange struct {
+	At     time.Time
+	Status models.SubscriptionStatus
+}
+
+// statusChanges loads the status every event left the subscriptions in
+// subscriptions in, oldest first, by subscription.
+func statusChanges(db *gorm.DB, subscriptions *gorm.DB) (map[uuid.UUID][]statusChange, error) {
+	rows, err := db.Table("subscription_events").
+		Select("subscription_id, created_at AS at, after->>'status' AS status").
+		Where("subscription_id IN (?)", db.Table("(?) AS included", subscriptions).Select("id")).
+		Order("subscription_id, created_at").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := map[uuid.UUID][]statusChange{}
+	for rows.Next() {
+		var row struct {
+			SubscriptionID uuid.UUID
+			At             time.Time
+			Status         models.SubscriptionStatus
+		}
+		if err := db.ScanRows(rows, &row); err != nil {
+			return nil, err
+		}
+		changes[row.SubscriptionID] = append(changes[row.SubscriptionID], statusChange{At: row.At, Status: row.Status})
+	}
+	return changes, rows.Err()
+}
+
+// grantsAccess reports whether a subscription in the status counts as
+// subscribed.
+func grantsAccess(status models.SubscriptionStatus) bool {
+	for _, granting := range models.GrantingSubscriptionStatuses {
+		if status == granting {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionSpans returns the times a subscription was live, given its
+// start date, the statuses its events left it in, oldest first, and its
+// current status. The first span starts on the start date. A subscription
+// that no longer grants access after its last event ended at ended.
+func subscriptionSpans(start time.Time, changes []statusChange, current models.SubscriptionStatus, ended time.Time) []subscriberSpan {
+	var spans []subscriberSpan
+	var open *subscriberSpan
+	for _, change := range changes {
+		switch granting := grantsAccess(change.Status); {
+		case granting && open == nil:
+			open = &subscriberSpan{Start: change.At}
+			if len(spans) == 0 {
+				open.Start = start
+			}
+		case !granting && open != nil:
+			end := change.At
+			open.End = &end
+			spans = append(spans, *open)
+			open = nil
+		}
+	}
+	if open != nil {
+		if !grantsAccess(current) {
+			open.End = &ended
+		}
+		spans = append(spans, *open)
+	}
+	return spans
+}
+
+// subscriberSpan is one stretch of time a subscription was live: from when it
+// started granting access until it stopped, if it did.
+type subscriberSpan struct {
+	Start time.Time
+	End   *time.Time
+}
+
+// subscriber is a user subscribed personally or an organization, with the
+// spans of their subscriptions, earliest first.
+type subscriber struct {
+	Trial bool // Whether their first subscription started with a trial
+	Spans []subscriberSpan
+}
+
+// activeAt reports whether any of the subscriber's subscriptions was live at t.
+func (s subscriber) activeAt(t time.Time) bool {
+	for _, span := range s.Spans {
+		if !span.Start.After(t) && (span.End == nil || span.End.After(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRetention adds every subscriber to the cohort of the month they first
+// subscribed in, counts them as retained at the end of each month since that
+// they were subscribed at, or now for the current month, and works out the
+// retention of every cohort. cohorts must have one cohort for every month
+// from from, with an offset for every month until now.
+func countRetention(cohorts []Cohort, from, now time.Time, subscribers []subscriber) {
+	for _, subscriber := range subscribers {
+		if len(subscriber.Spans) == 0 {
+			continue // None of their subscriptions ever granted access
+		}
+		first := Month(subscriber.Spans[0].Start)
+		index := monthsBetween(from, first)
+		if index < 0 || index >= len(cohorts) {
+			continue
+		}
+		cohort := &cohorts[index]
+		cohort.Size++
+		for offset := range cohort.Retained {
+			at := first.AddDate(0, offset+1, 0)
+			if at.After(now) {
+				at = now
+			}
+			if subscriber.activeAt(at) {
+				cohort.Retained[offset]++
+			}
+		}
+	}
+
+	for i := range cohorts {
+		cohort := &cohorts[i]
+		for offset, retained := range cohort.Retained {
+			if cohort.Size > 0 {
+				cohort.Retention[offset] = float64(retained) / float64(cohort.Size)
+			}
+		}
+	}
+}
+
+// monthsBetween returns the number of months from the month of a to the
+// month of b.
+func monthsBetween(a, b time.Time) int {
+	return (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+}
+
+// WriteCSV writes the report as a table with one row per cohort: its month,
+// its size and its retention for every month since, as a share of its size.
+func (report *CohortReport) WriteCSV(w io.Writer) error {
+	columns := 0
+	for _, cohort := range report.Cohorts {
+		if len(cohort.Retention) > columns {
+			columns = len(cohort.Retention)
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	header := []string{"cohort", "size"}
+	for offset := 0; offset < columns; offset++ {
+		header = append(header, fmt.Sprintf("month_%d", offset))
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, cohort := range report.Cohorts {
+		record := []string{cohort.Month, strconv.Itoa(cohort.Size)}
+		for offset := 0; offset < columns; offset++ {
+			value := ""
+			if offset < len(cohort.Retention) {
+				value = strconv.FormatFloat(cohort.Retention[offset], 'f', 4, 64)
+			}
+			record = append(record, value)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
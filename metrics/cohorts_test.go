@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/models"
+)
+
+func TestCountRetention(t *testing.T) {
+	at := func(month time.Month, day int) time.Time {
+		return time.Date(2024, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	ended := func(month time.Month, day int) *time.Time {
+		t := at(month, day)
+		return &t
+	}
+	from, now := at(4, 1), at(6, 15)
+
+	tests := []struct {
+		name        string
+		subscribers []subscriber
+		want        []Cohort
+	}{
+		{
+			name: "retained",
+			subscribers: []subscriber{
+				{Spans: []subscriberSpan{{Start: at(4, 10)}}},
+			},
+			want: []Cohort{
+				{Month: "2024-04", Size: 1, Retained: []int{1, 1, 1}, Retention: []float64{1, 1, 1}},
+				{Month: "2024-05", Retained: []int{0, 0}, Retention: []float64{0, 0}},
+				{Month: "2024-06", Retained: []int{0}, Retention: []float64{0}},
+			},
+		},
+		{
+			name: "churned",
+			subscribers: []subscriber{
+				{Spans: []subscriberSpan{{Start: at(4, 10), End: ended(5, 20)}}},
+				{Spans: []subscriberSpan{{Start: at(4, 12)}}},
+			},
+			want: []Cohort{
+				{Month: "2024-04", Size: 2, Retained: []int{2, 1, 1}, Retention: []float64{1, 0.5, 0.5}},
+				{Month: "2024-05", Retained: []int{0, 0}, Retention: []float64{0, 0}},
+				{Month: "2024-06", Retained: []int{0}, Retention: []float64{0}},
+			},
+		},
+		{
+			name: "canceled and subscribed again the same month",
+			subscribers: []subscriber{
+				{Spans: []subscriberSpan{{Start: at(4, 10), End: ended(5, 3)}, {Start: at(5, 8)}}},
+			},
+			want: []Cohort{
+				{Month: "2024-04", Size: 1, Retained: []int{1, 1, 1}, Retention: []float64{1, 1, 1}},
+				{Month: "2024-05", Retained: []int{0, 0}, Retention: []float64{0, 0}},
+				{Month: "2024-06", Retained: []int{0}, Retention: []float64{0}},
+			},
+		},
+		{
+			name: "back after a month away",
+			subscribers: []subscriber{
+				{Spans: []subscriberSpan{{Start: at(4, 10), End: ended(4, 25)}, {Start: at(6, 2)}}},
+			},
+			want: []Cohort{
+				{Month: "2024-04", Size: 1, Retained: []int{0, 0, 1}, Retention: []float64{0, 0, 1}},
+				{Month: "2024-05", Retained: []int{0, 0}, Retention: []float64{0, 0}},
+				{Month: "2024-06", Retained: []int{0}, Retention: []float64{0}},
+			},
+		},
+		{
+			name: "several subscriptions at once",
+			subscribers: []subscriber{
+				{Spans: []subscriberSpan{{Start: at(5, 1), End: ended(6, 10)}, {Start: at(5, 15)}}},
+				{Spans: []subscriberSpan{{Start: at(5, 2), End: ended(6, 1)}, {Start: at(5, 3), End: ended(6, 5)}}},
+				{Spans: []subscriberSpan{{Start: at(6, 1), End: ended(6, 15)}}},
+			},
+			want: []Cohort{
+				{Month: "2024-04", Retained: []int{0, 0, 0}, Retention: []float64{0, 0, 0}},
+				{Month: "2024-05", Size: 2, Retained: []int{2, 1}, Retention: []float64{1, 0.5}},
+				{Month: "2024-06", Size: 1, Retained: []int{0}, Retention: []float64{0}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		cohorts := []Cohort{
+			{Month: "2024-04", Retained: make([]int, 3), Retention: make([]float64, 3)},
+			{Month: "2024-05", Retained: make([]int, 2), Retention: make([]float64, 2)},
+			{Month: "2024-06", Retained: make([]int, 1), Retention: make([]float64, 1)},
+		}
+		countRetention(cohorts, from, now, tt.subscribers)
+		if !reflect.DeepEqual(cohorts, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, cohorts, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionSpans(t *testing.T) {
+	at := func(month time.Month, day int) time.Time {
+		return time.Date(2024, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	ended := func(month time.Month, day int) *time.Time {
+		t := at(month, day)
+		return &t
+	}
+	change := func(month time.Month, day int, status models.SubscriptionStatus) statusChange {
+		return statusChange{At: at(month, day), Status: status}
+	}
+	start := at(4, 10)
+
+	tests := []struct {
+		name    string
+		changes []statusChange
+		current models.SubscriptionStatus
+		want    []subscriberSpan
+	}{
+		{
+			name:    "live",
+			changes: []statusChange{change(4, 10, models.SubscriptionStatusActive)},
+			current: models.SubscriptionStatusActive,
+			want:    []subscriberSpan{{Start: start}},
+		},
+		{
+			name:    "canceled",
+			changes: []statusChange{change(4, 10, models.SubscriptionStatusActive), change(5, 20, models.SubscriptionStatusCanceled)},
+			current: models.SubscriptionStatusCanceled,
+			want:    []subscriberSpan{{Start: start, End: ended(5, 20)}},
+		},
+		{
+			name:    "lapsed trial",
+			changes: []statusChange{change(4, 10, models.SubscriptionStatusTrialing), change(5, 10, models.SubscriptionStatusPaused)},
+			current: models.SubscriptionStatusPaused,
+			want:    []subscriberSpan{{Start: start, End: ended(5, 10)}},
+		},
+		{
+			name: "unpaid, then paid",
+			changes: []statusChange{
+				change(4, 10, models.SubscriptionStatusActive),
+				change(5, 10, models.SubscriptionStatusPastDue),
+				change(5, 20, models.SubscriptionStatusUnpaid),
+				change(6, 2, models.SubscriptionStatusActive),
+			},
+			current: models.SubscriptionStatusActive,
+			want:    []subscriberSpan{{Start: start, End: ended(5, 20)}, {Start: at(6, 2)}},
+		},
+		{
+			name:    "scheduled",
+			changes: []statusChange{change(4, 1, models.SubscriptionStatusScheduled), change(4, 10, models.SubscriptionStatusActive)},
+			current: models.SubscriptionStatusActive,
+			want:    []subscriberSpan{{Start: start}},
+		},
+		{
+			name:    "canceled without an event",
+			changes: []statusChange{change(4, 10, models.SubscriptionStatusActive)},
+			current: models.SubscriptionStatusCanceled,
+			want:    []subscriberSpan{{Start: start, End: ended(6, 1)}},
+		},
+		{
+			name:    "never granted access",
+			changes: []statusChange{change(4, 1, models.SubscriptionStatusScheduled), change(4, 5, models.SubscriptionStatusCanceled)},
+			current: models.SubscriptionStatusCanceled,
+		},
+	}
+
+	for _, tt := range tests {
+		got := subscriptionSpans(start, tt.changes, tt.current, at(6, 1))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMonthsBetween(t *testing.T) {
+	tests := []struct {
+		a, b time.Time
+		want int
+	}{
+		{time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), 1},
+		{time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), 3},
+	}
+
+	for _, tt := range tests {
+		if got := monthsBetween(tt.a, tt.b); got != tt.want {
+			t.Errorf("monthsBetween(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// File: metrics/metrics.go
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// Ways of grouping a report
+const (
+	GroupByProduct = "product"
+	GroupByPlan    = "plan"
+)
+
+var ErrInvalidRange = errors.New("from must not be after to")
+
+// Query selects the days a report covers, both inclusive, and how its
+// figures are grouped.
+type Query struct {
+	From    time.Time
+	To      time.Time
+	GroupBy string // Empty, GroupByProduct or GroupByPlan
+}
+
+// Figures are the revenue metrics of all subscriptions or of one group.
+// Amounts are in dollars. MRR, ARR and the subscriber counts are as of the
+// last day of the report; the rest add up over its days.
+type Figures struct {
+	Key                 string  `json:"key,omitempty"`  // Product ID or plan
+	Name                string  `json:"name,omitempty"` // Product name
+	MRR                 float64 `json:"mrr"`
+	ARR                 float64 `json:"arr"`
+	ActiveSubscribers   int     `json:"active_subscribers"` // Subscriptions paying MRR
+	TrialingSubscribers int     `json:"trialing_subscribers"`
+	NewMRR              float64 `json:"new_mrr"`         // From subscriptions that were paying nothing the day before
+	ExpansionMRR        float64 `json:"expansion_mrr"`   // From subscriptions paying more than the day before
+	ContractionMRR      float64 `json:"contraction_mrr"` // From subscriptions paying less, but still paying
+	ChurnedMRR          float64 `json:"churned_mrr"`     // From subscriptions that stopped paying
+	NetNewMRR           float64 `json:"net_new_mrr"`
+	TrialsEnded         int     `json:"trials_ended"`
+	TrialsConverted     int     `json:"trials_converted"`      // Trials that ended in a paying subscription
+	TrialConversionRate float64 `json:"trial_conversion_rate"` // TrialsConverted / TrialsEnded
+}
+
+// Point is the MRR and paying subscriptions at the end of one day.
+type Point struct {
+	Date              string  `json:"date"`
+	MRR               float64 `json:"mrr"`
+	ActiveSubscribers int     `json:"active_subscribers"`
+}
+
+// Report is the revenue metrics for a range of days.
+type Report struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	GroupBy string    `json:"group_by,omitempty"`
+	Total   Figures   `json:"total"`
+	Groups  []Figures `json:"groups,omitempty"`
+	Series  []Point   `json:"series"`
+}
+
+// tally accumulates figures in cents.
+type tally struct {
+	mrr, active, trialing                   int64
+	newMRR, expansion, contraction, churned int64
+	trialsEnded, trialsConverted            int
+}
+
+func (t *tally) figures(key string, name string) Figures {
+	figures := Figures{
+		Key:                 key,
+		Name:                name,
+		MRR:                 dollars(t.mrr),
+		ARR:                 dollars(t.mrr * 12),
+		ActiveSubscribers:   int(t.active),
+		TrialingSubscribers: int(t.trialing),
+		NewMRR:              dollars(t.newMRR),
+		ExpansionMRR:        dollars(t.expansion),
+		ContractionMRR:      dollars(t.contraction),
+		ChurnedMRR:          dollars(t.churned),
+		NetNewMRR:           dollars(t.newMRR + t.expansion - t.contraction - t.churned),
+		TrialsEnded:         t.trialsEnded,
+		TrialsConverted:     t.trialsConverted,
+	}
+	if t.trialsEnded > 0 {
+		figures.TrialConversionRate = float64(t.trialsConverted) / float64(t.trialsEnded)
+	}
+	return figures
+}
+
+func dollars(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+// report builds a Report, keeping a tally for the total and every group.
+type report struct {
+	query  Query
+	total  tally
+	groups map[string]*tally
+	series []Point
+}
+
+func (r *report) group(key string) *tally {
+	if r.query.GroupBy == "" {
+		return nil
+	}
+	if r.groups[key] == nil {
+		r.groups[key] = &tally{}
+	}
+	return r.groups[key]
+}
+
+// add applies fn to the total and to the group of key.
+func (r *report) add(key string, fn func(t *tally)) {
+	fn(&r.total)
+	if group := r.group(key); group != nil {
+		fn(group)
+	}
+}
+
+func (r *report) key(productID uuid.UUID, plan string) string {
+	switch r.query.GroupBy {
+	case GroupByProduct:
+		return productID.String()
+	case GroupByPlan:
+		return plan
+	}
+	return ""
+}
+
+// Compute reports the revenue metrics for q from the daily snapshots. Today,
+// which has no snapshot yet, is computed from the current subscriptions.
+// Movements between MRR figures are counted between consecutive snapshots,
+// starting from the day before q.From.
+func Compute(db *gorm.DB, q Query) (*Report, error) {
+	q.From, q.To = Day(q.From), Day(q.To)
+	if q.From.After(q.To) {
+		return nil, ErrInvalidRange
+	}
+
+	r := &report{query: q, groups: map[string]*tally{}, series: []Point{}}
+	today := Day(time.Now())
+
+	// Days are streamed one at a time, each compared with the one before
+	var previous, current map[uuid.UUID]models.RevenueSnapshot
+	var currentDay time.Time
+	finishDay := func() {
+		if current != nil {
+			r.day(currentDay, previous, current)
+		}
+		previous, current = current, nil
+	}
+
+	rows, err := db.Model(&models.RevenueSnapshot{}).
+		Where("date >= ? AND date <= ? AND date < ?", q.From.AddDate(0, 0, -1), q.To, today).
+		Order("date, subscription_id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var snapshot models.RevenueSnapshot
+		if err := db.ScanRows(rows, &snapshot); err != nil {
+			return nil, err
+		}
+		if current == nil || !Day(snapshot.Date).Equal(currentDay) {
+			finishDay()
+			current = map[uuid.UUID]models.RevenueSnapshot{}
+			currentDay = Day(snapshot.Date)
+		}
+		current[snapshot.SubscriptionID] = snapshot
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	finishDay()
+
+	if !q.To.Before(today) {
+		live, err := Snapshots(db, today)
+		if err != nil {
+			return nil, err
+		}
+		current = make(map[uuid.UUID]models.RevenueSnapshot, len(live))
+		for _, snapshot := range live {
+			current[snapshot.SubscriptionID] = snapshot
+		}
+		currentDay = today
+		finishDay()
+	}
+
+	// The figures as of the last day
+	for _, snapshot := range previous {
+		r.add(r.key(snapshot.ProductID, snapshot.Plan), func(t *tally) {
+			t.mrr += snapshot.MRR
+			if snapshot.MRR > 0 {
+				t.active++
+			}
+			if snapshot.Status == models.SubscriptionStatusTrialing {
+				t.trialing++
+			}
+		})
+	}
+
+	if err := r.trials(db); err != nil {
+		return nil, err
+	}
+
+	return r.build(db)
+}
+
+// day counts the movements between two consecutive snapshots, and adds the
+// day to the series if it is in the report. The first snapshot only serves
+// as the baseline.
+func (r *report) day(date time.Time, previous, current map[uuid.UUID]models.RevenueSnapshot) {
+	if date.Before(r.query.From) {
+		return
+	}
+
+	point := Point{Date: date.Format("2006-01-02")}
+	var mrr int64
+	for _, snapshot := range current {
+		mrr += snapshot.MRR
+		if snapshot.MRR > 0 {
+			point.ActiveSubscribers++
+		}
+	}
+	point.MRR = dollars(mrr)
+	r.series = append(r.series, point)
+
+	if previous == nil {
+		return
+	}
+
+	for id, now := range current {
+		before := previous[id].MRR
+		key := r.key(now.ProductID, now.Plan)
+		switch {
+		case before == 0 && now.MRR > 0:
+			r.add(key, func(t *tally) { t.newMRR += now.MRR })
+		case before > 0 && now.MRR > before:
+			r.add(key, func(t *tally) { t.expansion += now.MRR - before })
+		case now.MRR > 0 && now.MRR < before:
+			r.add(key, func(t *tally) { t.contraction += before - now.MRR })
+		case now.MRR == 0 && before > 0:
+			r.add(key, func(t *tally) { t.churned += before })
+		}
+	}
+	// Subscriptions canceled since the day before have no snapshot
+	for id, then := range previous {
+		if _, ok := current[id]; !ok && then.MRR > 0 {
+			r.add(r.key(then.ProductID, then.Plan), func(t *tally) { t.churned += then.MRR })
+		}
+	}
+}
+
+// trials counts the trials that ended during the report, and those that
+// ended in a paying subscription, from the subscription history.
+func (r *report) trials(db *gorm.DB) error {
+	var events []models.SubscriptionEvent
+	err := db.Where("created_at >= ? AND created_at < ?", r.query.From, r.query.To.AddDate(0, 0, 1)).
+		Where("before->>'status' = ? AND after->>'status' != ?", models.SubscriptionStatusTrialing, models.SubscriptionStatusTrialing).
+		Find(&events).Error
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		var after models.SubscriptionSnapshot
+		if err := json.Unmarshal(event.After, &after); err != nil {
+			return err
+		}
+		converted := payingStatuses[after.Status]
+		r.add(r.key(after.ProductID, after.Plan), func(t *tally) {
+			t.trialsEnded++
+			if converted {
+				t.trialsConverted++
+			}
+		})
+	}
+	return nil
+}
+
+func (r *report) build(db *gorm.DB) (*Report, error) {
+	result := &Report{
+		From:    r.query.From.Format("2006-01-02"),
+		To:      r.query.To.Format("2006-01-02"),
+		GroupBy: r.query.GroupBy,
+		Total:   r.total.figures("", ""),
+		Series:  r.series,
+	}
+	if r.query.GroupBy == "" {
+		return result, nil
+	}
+
+	names := map[string]string{}
+	if r.query.GroupBy == GroupByProduct {
+		var products []models.Product
+		if err := db.Select("id, name").Find(&products).Error; err != nil {
+			return nil, err
+		}
+		for _, product := range products {
+			names[product.ID.String()] = product.Name
+		}
+	}
+
+	result.Groups = []Figures{}
+	for key, group := range r.groups {
+		result.Groups = append(result.Groups, group.figures(key, names[key]))
+	}
+	sort.Slice(result.Groups, func(i, j int) bool {
+		if result.Groups[i].MRR != result.Groups[j].MRR {
+			return result.Groups[i].MRR > result.Groups[j].MRR
+		}
+		return result.Groups[i].Key < result.Groups[j].Key
+	})
+	return result, nil
+}
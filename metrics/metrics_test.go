@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+)
+
+func TestReportDay(t *testing.T) {
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	monthly, yearly := uuid.New(), uuid.New()
+	snapshot := func(id uuid.UUID, plan string, mrr int64) models.RevenueSnapshot {
+		return models.RevenueSnapshot{SubscriptionID: id, Plan: plan, MRR: mrr}
+	}
+	days := func(snapshots ...models.RevenueSnapshot) map[uuid.UUID]models.RevenueSnapshot {
+		day := map[uuid.UUID]models.RevenueSnapshot{}
+		for _, s := range snapshots {
+			day[s.SubscriptionID] = s
+		}
+		return day
+	}
+
+	tests := []struct {
+		name     string
+		date     time.Time
+		previous map[uuid.UUID]models.RevenueSnapshot
+		current  map[uuid.UUID]models.RevenueSnapshot
+		want     tally
+		wantPlan tally // The monthly plan's group
+		wantDays int
+	}{
+		{
+			name:    "baseline before the report",
+			date:    from.AddDate(0, 0, -1),
+			current: days(snapshot(monthly, "monthly", 1000)),
+		},
+		{
+			name:     "first day without a baseline",
+			date:     from,
+			current:  days(snapshot(monthly, "monthly", 1000)),
+			wantDays: 1,
+		},
+		{
+			name:     "new",
+			date:     from,
+			previous: days(snapshot(monthly, "monthly", 0)),
+			current:  days(snapshot(monthly, "monthly", 1000), snapshot(yearly, "yearly", 500)),
+			want:     tally{newMRR: 1500},
+			wantPlan: tally{newMRR: 1000},
+			wantDays: 1,
+		},
+		{
+			name:     "expansion and contraction",
+			date:     from,
+			previous: days(snapshot(monthly, "monthly", 1000), snapshot(yearly, "yearly", 500)),
+			current:  days(snapshot(monthly, "monthly", 1500), snapshot(yearly, "yearly", 400)),
+			want:     tally{expansion: 500, contraction: 100},
+			wantPlan: tally{expansion: 500},
+			wantDays: 1,
+		},
+		{
+			name:     "churned by stopping payment",
+			date:     from,
+			previous: days(snapshot(monthly, "monthly", 1000)),
+			current:  days(snapshot(monthly, "monthly", 0)),
+			want:     tally{churned: 1000},
+			wantPlan: tally{churned: 1000},
+			wantDays: 1,
+		},
+		{
+			name:     "churned by cancellation",
+			date:     from,
+			previous: days(snapshot(monthly, "monthly", 1000), snapshot(yearly, "yearly", 500)),
+			current:  days(snapshot(yearly, "yearly", 500)),
+			want:     tally{churned: 1000},
+			wantPlan: tally{churned: 1000},
+			wantDays: 1,
+		},
+		{
+			name:     "unchanged",
+			date:     from,
+			previous: days(snapshot(monthly, "monthly", 1000)),
+			current:  days(snapshot(monthly, "monthly", 1000)),
+			wantDays: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		r := &report{query: Query{From: from, To: from, GroupBy: GroupByPlan}, groups: map[string]*tally{}}
+		r.day(tt.date, tt.previous, tt.current)
+
+		if r.total != tt.want {
+			t.Errorf("%s: total %+v, want %+v", tt.name, r.total, tt.want)
+		}
+		var plan tally
+		if group := r.groups["monthly"]; group != nil {
+			plan = *group
+		}
+		if plan != tt.wantPlan {
+			t.Errorf("%s: monthly group %+v, want %+v", tt.name, plan, tt.wantPlan)
+		}
+		if len(r.series) != tt.wantDays {
+			t.Errorf("%s: %d days in the series, want %d", tt.name, len(r.series), tt.wantDays)
+		}
+	}
+}
+
+func TestTallyFigures(t *testing.T) {
+	figures := (&tally{mrr: 123456, active: 3, newMRR: 1000, expansion: 250, contraction: 50, churned: 700, trialsEnded: 4, trialsConverted: 1}).figures("monthly", "")
+
+	want := Figures{
+		Key:                 "monthly",
+		MRR:                 1234.56,
+		ARR:                 14814.72,
+		ActiveSubscribers:   3,
+		NewMRR:              10,
+		ExpansionMRR:        2.5,
+		ContractionMRR:      0.5,
+		ChurnedMRR:          7,
+		NetNewMRR:           5,
+		TrialsEnded:         4,
+		TrialsConverted:     1,
+		TrialConversionRate: 0.25,
+	}
+	if figures != want {
+		t.Errorf("figures() = %+v, want %+v", figures, want)
+	}
+}
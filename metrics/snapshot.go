@@ -0,0 +1,174 @@
+// File: metrics/snapshot.go
+package metrics
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// payingStatuses are the statuses in which a subscription counts towards
+// MRR. Past due subscriptions are still being billed; unpaid and paused ones
+// are not.
+var payingStatuses = map[models.SubscriptionStatus]bool{
+	models.SubscriptionStatusActive:  true,
+	models.SubscriptionStatusPastDue: true,
+}
+
+// cents converts a product price to cents.
+func cents(price float64) int64 {
+	return int64(math.Round(price * 100))
+}
+
+// planPrice returns the monthly price of a product on a plan in cents, with
+// yearly prices divided by 12. Trials, gifts and other plans are not
+// recurring revenue.
+func planPrice(product models.Product, plan string) int64 {
+	switch plan {
+	case "monthly":
+		return cents(product.MonthlyPrice)
+	case "yearly":
+		return int64(math.Round(float64(cents(product.YearlyPrice)) / 12))
+	}
+	return 0
+}
+
+// intervalMonths is the share of a month each Stripe billing interval covers.
+var intervalMonths = map[string]float64{
+	"day":   12.0 / 365,
+	"week":  12.0 / 52,
+	"month": 1,
+	"year":  12,
+}
+
+// monthly returns an amount in cents billed every count intervals as a
+// monthly amount. Unknown intervals are not recurring revenue.
+func monthly(amount int64, interval string, count int64) int64 {
+	months, ok := intervalMonths[interval]
+	if !ok {
+		return 0
+	}
+	if count < 1 {
+		count = 1
+	}
+	return int64(math.Round(float64(amount) / (months * float64(count))))
+}
+
+// itemPrice returns the monthly price of one unit of an item in cents, at the
+// Stripe price it is billed at. Items recorded before prices were stored are
+// priced at their product's price on the plan.
+func itemPrice(item models.SubscriptionItem, product models.Product, plan string) int64 {
+	if item.Interval == "" {
+		return planPrice(product, plan)
+	}
+	return monthly(item.UnitAmount, item.Interval, item.IntervalCount)
+}
+
+// MonthlyRevenue returns a subscription's monthly recurring revenue in cents:
+// its base product for every seat plus its add-ons, at the prices they are
+// billed at, less the discount of its coupon. Items must be loaded.
+func MonthlyRevenue(subscription models.Subscription, products map[uuid.UUID]models.Product) int64 {
+	if !payingStatuses[subscription.Status] {
+		return 0
+	}
+
+	base := models.SubscriptionItem{ProductID: subscription.ProductID}
+	quantity := int64(1)
+	if subscription.Seats > 0 {
+		quantity = subscription.Seats
+	}
+	var addons int64
+	for _, item := range subscription.Items {
+		switch item.Kind {
+		case models.ProductKindBase:
+			base = item
+			if item.Quantity > 0 {
+				quantity = item.Quantity
+			}
+		case models.ProductKindAddon:
+			addons += itemPrice(item, products[item.ProductID], subscription.Plan) * item.Quantity
+		}
+	}
+	revenue := itemPrice(base, products[subscription.ProductID], subscription.Plan)*quantity + addons
+
+	// Percentage coupons discount every invoice by a share; fixed ones by an
+	// amount per invoice, which is billed on the base item's interval
+	if subscription.DiscountPercentOff > 0 {
+		revenue = int64(math.Round(float64(revenue) * (1 - subscription.DiscountPercentOff/100)))
+	}
+	if subscription.DiscountAmountOff > 0 {
+		interval, count := base.Interval, base.IntervalCount
+		if interval == "" {
+			interval, count = "month", 1
+			if subscription.Plan == "yearly" {
+				interval = "year"
+			}
+		}
+		revenue -= monthly(subscription.DiscountAmountOff, interval, count)
+	}
+	if revenue < 0 {
+		return 0
+	}
+	return revenue
+}
+
+// Day returns the UTC day t falls on.
+func Day(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Snapshots returns the current state of every subscription that is not
+// canceled, as snapshots for date.
+func Snapshots(db *gorm.DB, date time.Time) ([]models.RevenueSnapshot, error) {
+	var products []models.Product
+	if err := db.Find(&products).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uuid.UUID]models.Product, len(products))
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+
+	snapshots := []models.RevenueSnapshot{}
+	var subscriptions []models.Subscription
+	err := db.Preload("Items").Where("status != ?", models.SubscriptionStatusCanceled).
+		FindInBatches(&subscriptions, 500, func(tx *gorm.DB, batch int) error {
+			for _, subscription := range subscriptions {
+				snapshots = append(snapshots, models.RevenueSnapshot{
+					Date:           Day(date),
+					SubscriptionID: subscription.ID,
+					UserID:         subscription.UserID,
+					OrganizationID: subscription.OrganizationID,
+					ProductID:      subscription.ProductID,
+					Plan:           subscription.Plan,
+					Status:         subscription.Status,
+					MRR:            MonthlyRevenue(subscription, byID),
+				})
+			}
+			return nil
+		}).Error
+	return snapshots, err
+}
+
+// TakeSnapshot stores the current state of every subscription as the
+// snapshots for date, replacing any taken for it before.
+func TakeSnapshot(db *gorm.DB, date time.Time) error {
+	snapshots, err := Snapshots(db, date)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("date = ?", Day(date)).Delete(&models.RevenueSnapshot{}).Error; err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&snapshots, 500).Error
+	})
+}
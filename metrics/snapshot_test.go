@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+)
+
+func TestMonthlyRevenue(t *testing.T) {
+	base := models.Product{ID: uuid.New(), MonthlyPrice: 20, YearlyPrice: 200}
+	addon := models.Product{ID: uuid.New(), MonthlyPrice: 5, YearlyPrice: 50, Kind: models.ProductKindAddon}
+	products := map[uuid.UUID]models.Product{base.ID: base, addon.ID: addon}
+
+	billed := func(kind string, productID uuid.UUID, quantity, amount int64, interval string, count int64) models.SubscriptionItem {
+		return models.SubscriptionItem{ProductID: productID, Kind: kind, Quantity: quantity, UnitAmount: amount, Interval: interval, IntervalCount: count}
+	}
+	listed := func(kind string, productID uuid.UUID, quantity int64) models.SubscriptionItem {
+		return models.SubscriptionItem{ProductID: productID, Kind: kind, Quantity: quantity}
+	}
+
+	tests := []struct {
+		name         string
+		subscription models.Subscription
+		want         int64
+	}{
+		{
+			name:         "not paying",
+			subscription: models.Subscription{Status: models.SubscriptionStatusTrialing, Plan: "monthly", Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 2000, "month", 1)}},
+			want:         0,
+		},
+		{
+			name:         "billed monthly",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 1500, "month", 1)}},
+			want:         1500,
+		},
+		{
+			name:         "billed yearly",
+			subscription: models.Subscription{Status: models.SubscriptionStatusPastDue, Plan: "yearly", Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 12000, "year", 1)}},
+			want:         1000,
+		},
+		{
+			name:         "billed every three months",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 3000, "month", 3)}},
+			want:         1000,
+		},
+		{
+			name:         "billed weekly",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 300, "week", 1)}},
+			want:         1300,
+		},
+		{
+			name: "seats and add-ons",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", Items: []models.SubscriptionItem{
+				billed(models.ProductKindBase, base.ID, 3, 1500, "month", 1),
+				billed(models.ProductKindAddon, addon.ID, 2, 400, "month", 1),
+			}},
+			want: 3*1500 + 2*400,
+		},
+		{
+			name:         "list price without a billed price",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "yearly", Items: []models.SubscriptionItem{listed(models.ProductKindBase, base.ID, 1), listed(models.ProductKindAddon, addon.ID, 1)}},
+			want:         1667 + 417,
+		},
+		{
+			name:         "list price without items",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", Seats: 4},
+			want:         4 * 2000,
+		},
+		{
+			name:         "gift plan without items",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "gift"},
+			want:         0,
+		},
+		{
+			name:         "percentage coupon",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", DiscountPercentOff: 25, Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 2000, "month", 1)}},
+			want:         1500,
+		},
+		{
+			name:         "amount coupon on a yearly price",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "yearly", DiscountAmountOff: 2400, Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 12000, "year", 1)}},
+			want:         800,
+		},
+		{
+			name:         "amount coupon larger than the price",
+			subscription: models.Subscription{Status: models.SubscriptionStatusActive, Plan: "monthly", DiscountAmountOff: 5000, Items: []models.SubscriptionItem{billed(models.ProductKindBase, base.ID, 1, 2000, "month", 1)}},
+			want:         0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt.subscription.ProductID = base.ID
+		if got := MonthlyRevenue(tt.subscription, products); got != tt.want {
+			t.Errorf("%s: MonthlyRevenue() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
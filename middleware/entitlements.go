@@ -0,0 +1,69 @@
+// File: middleware/entitlements.go
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/entitlements"
+	"gorm.io/gorm"
+)
+
+const (
+	entitlementsDBKey = "entitlements_db"
+	entitlementsKey   = "entitlements"
+)
+
+// Entitlements makes the database available to RequireEntitlement. The
+// user's entitlements are only resolved when a route asks for them. It must
+// run after AuthMiddleware.
+func Entitlements(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(entitlementsDBKey, db)
+		c.Next()
+	}
+}
+
+// UserEntitlements resolves the current user's entitlements once per request.
+func UserEntitlements(c *gin.Context) (map[string]entitlements.Grant, error) {
+	if grants, exists := c.Get(entitlementsKey); exists {
+		return grants.(map[string]entitlements.Grant), nil
+	}
+
+	db := c.MustGet(entitlementsDBKey).(*gorm.DB)
+	userID, _ := c.Get("user_id")
+	id, _ := userID.(uuid.UUID)
+
+	grants, err := entitlements.ForUser(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set(entitlementsKey, grants)
+	return grants, nil
+}
+
+// RequireEntitlement only lets the request through when the user's plan
+// grants the feature. The grant is stored in the context under
+// "entitlement" for the handler to check limits against.
+func RequireEntitlement(feature string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		grants, err := UserEntitlements(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve entitlements"})
+			c.Abort()
+			return
+		}
+
+		grant, ok := grants[feature]
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Your plan does not include this feature", "feature": feature})
+			c.Abort()
+			return
+		}
+
+		c.Set("entitlement", grant)
+		c.Next()
+	}
+}
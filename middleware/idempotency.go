@@ -0,0 +1,205 @@
+// File: middleware/idempotency.go
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+const (
+	IdempotencyHeader = "Idempotency-Key"
+
+	// Keys older than this are forgotten and the request is processed again.
+	idempotencyKeyTTL = 24 * time.Hour
+
+	// How long a request may hold a key before a retry can take it over. It
+	// only expires if the request died without storing or releasing the key.
+	idempotencyLease = 2 * time.Minute
+)
+
+type responseRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency honours the Idempotency-Key header on mutating requests. The
+// first request with a key is processed and its response stored; retries with
+// the same key, organization and body get the stored response replayed. It must run after
+// AuthMiddleware because keys are scoped to the user.
+func Idempotency(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyHeader)
+		if key == "" || !isMutatingMethod(c.Request.Method) {
+			c.Next()
+			return
+		}
+
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		value, _ := c.Get("user_id")
+		userID, ok := value.(uuid.UUID)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		// The organization header picks the account the request acts for, so
+		// it is part of the request like the path and body
+		request := c.Request.Method + " " + c.Request.URL.Path + "\n"
+		if organization := c.GetHeader(OrganizationHeader); organization != "" {
+			request += OrganizationHeader + ": " + organization + "\n"
+		}
+		sum := sha256.Sum256(append([]byte(request), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		var stored models.IdempotencyKey
+		err = db.Where("user_id = ? AND key = ?", userID, key).First(&stored).Error
+		switch {
+		case err == nil && time.Since(stored.CreatedAt) > idempotencyKeyTTL:
+			if err := db.Delete(&stored).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process idempotency key"})
+				c.Abort()
+				return
+			}
+		case err == nil:
+			if stored.RequestHash != requestHash {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+				c.Abort()
+				return
+			}
+			if stored.StatusCode == 0 {
+				if !takeOverIdempotencyKey(db, &stored) {
+					c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+					c.Abort()
+					return
+				}
+				// The original request died holding the key; this retry
+				// processes it instead
+				runIdempotent(c, db, stored, key)
+				return
+			}
+			contentType := stored.ContentType
+			if contentType == "" {
+				contentType = "application/json; charset=utf-8"
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(stored.StatusCode, contentType, stored.ResponseBody)
+			c.Abort()
+			return
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process idempotency key"})
+			c.Abort()
+			return
+		}
+
+		// Reserve the key. The unique index makes a concurrent retry fail here
+		// instead of running the handler twice.
+		lockedUntil := time.Now().Add(idempotencyLease)
+		record := models.IdempotencyKey{
+			UserID:      userID,
+			Key:         key,
+			Method:      c.Request.Method,
+			Path:        c.Request.URL.Path,
+			RequestHash: requestHash,
+			LockedUntil: &lockedUntil,
+		}
+		if err := db.Create(&record).Error; err != nil {
+			if isUniqueViolation(err) {
+				c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process idempotency key"})
+			}
+			c.Abort()
+			return
+		}
+
+		runIdempotent(c, db, record, key)
+	}
+}
+
+// takeOverIdempotencyKey renews the lease of an in-flight key whose lease has
+// expired. Only one of several concurrent retries succeeds.
+func takeOverIdempotencyKey(db *gorm.DB, record *models.IdempotencyKey) bool {
+	now := time.Now()
+	lockedUntil := now.Add(idempotencyLease)
+	result := db.Model(&models.IdempotencyKey{}).
+		Where("id = ? AND status_code = 0 AND (locked_until IS NULL OR locked_until < ?)", record.ID, now).
+		Update("locked_until", lockedUntil)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+	record.LockedUntil = &lockedUntil
+	return true
+}
+
+// runIdempotent runs the rest of the chain holding record, then stores the
+// response, or releases the key if the request failed with a server error.
+func runIdempotent(c *gin.Context, db *gorm.DB, record models.IdempotencyKey, key string) {
+	recorder := &responseRecorder{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+	c.Writer = recorder
+	c.Set("idempotency_key", key)
+
+	c.Next()
+
+	// Server errors are not stored so the client can retry them.
+	status := c.Writer.Status()
+	if status >= http.StatusInternalServerError {
+		db.Delete(&record)
+		return
+	}
+
+	record.StatusCode = status
+	record.ContentType = c.Writer.Header().Get("Content-Type")
+	record.ResponseBody = recorder.body.Bytes()
+	record.LockedUntil = nil
+	db.Save(&record)
+}
+
+// isUniqueViolation reports whether err is a Postgres unique violation, here
+// a concurrent request reserving the same key first.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// File: middleware/organization.go
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// OrganizationHeader selects the organization a request acts for. Without it
+// requests act for the user's personal account.
+const OrganizationHeader = "X-Organization-ID"
+
+// Organization resolves the organization context from the X-Organization-ID
+// header and stores the caller's membership under "organization_member". It
+// must run after AuthMiddleware.
+func Organization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader(OrganizationHeader)
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		organizationID, err := uuid.Parse(header)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + OrganizationHeader + " header"})
+			c.Abort()
+			return
+		}
+
+		userID, _ := c.Get("user_id")
+
+		var member models.OrganizationMember
+		if err := db.Where("organization_id = ? AND user_id = ?", organizationID, userID).First(&member).Error; err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this organization"})
+			c.Abort()
+			return
+		}
+
+		c.Set("organization_member", member)
+		c.Next()
+	}
+}
+
+// OrganizationMember returns the caller's membership of the organization the
+// request acts for, if any.
+func OrganizationMember(c *gin.Context) (models.OrganizationMember, bool) {
+	value, exists := c.Get("organization_member")
+	if !exists {
+		return models.OrganizationMember{}, false
+	}
+	member, ok := value.(models.OrganizationMember)
+	return member, ok
+}
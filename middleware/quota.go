@@ -0,0 +1,76 @@
+// File: middleware/quota.go
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/quota"
+	"gorm.io/gorm"
+)
+
+// EnforceQuota consumes cost units of the feature's quota before the handler
+// runs. Requests are rejected with 402 when the plan does not include the
+// feature, and with 429 once the quota for the current period is used up. The
+// units are given back when the handler fails. It must run after Entitlements.
+func EnforceQuota(feature string, cost int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		grants, err := UserEntitlements(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve entitlements"})
+			c.Abort()
+			return
+		}
+
+		grant, ok := grants[feature]
+		if !ok {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Your plan does not include this feature", "feature": feature})
+			c.Abort()
+			return
+		}
+
+		db := c.MustGet(entitlementsDBKey).(*gorm.DB)
+		userID, _ := c.Get("user_id")
+		id, _ := userID.(uuid.UUID)
+
+		usage, err := quota.Increment(db, id, grant, cost)
+		if errors.Is(err, quota.ErrQuotaExceeded) {
+			QuotaExceeded(c, usage)
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update usage"})
+			c.Abort()
+			return
+		}
+
+		c.Set("quota_usage", usage)
+		c.Next()
+
+		if c.Writer.Status() >= http.StatusBadRequest {
+			quota.Release(db, id, grant, cost)
+		}
+	}
+}
+
+// QuotaExceeded writes the 429 response for an exhausted quota, telling the
+// client when the quota resets.
+func QuotaExceeded(c *gin.Context, usage quota.Usage) {
+	retryAfter := int(time.Until(usage.PeriodEnd).Seconds())
+	if retryAfter < 0 {
+		retryAfter = 0
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":     "Quota exceeded for this billing period",
+		"feature":   usage.Feature,
+		"limit":     usage.Limit,
+		"used":      usage.Used,
+		"resets_at": usage.PeriodEnd,
+	})
+}
@@ -0,0 +1,48 @@
+// models/billing_operation.go
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Billing operation statuses. A failed operation is compensating while the
+// steps it completed are undone, and compensated once they all are.
+const (
+	BillingOperationStatusPending      = "pending"
+	BillingOperationStatusRunning      = "running"
+	BillingOperationStatusCompleted    = "completed"
+	BillingOperationStatusCompensating = "compensating"
+	BillingOperationStatusCompensated  = "compensated"
+)
+
+// BillingOperation is a multi-step billing operation run as a saga. It is
+// recorded together with the local changes that start it, and a worker runs
+// its steps, keeping their results in State so that an interrupted operation
+// can be resumed or undone.
+type BillingOperation struct {
+	ID             uuid.UUID         `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Kind           string            `gorm:"type:varchar(50);not null;index" json:"kind"`
+	UserID         uuid.UUID         `gorm:"type:uuid;index" json:"user_id"`
+	OrganizationID *uuid.UUID        `gorm:"type:uuid" json:"organization_id,omitempty"`
+	SubscriptionID *uuid.UUID        `gorm:"type:uuid;index" json:"subscription_id,omitempty"`
+	Status         string            `gorm:"type:varchar(20);not null;index" json:"status"`
+	Step           string            `gorm:"type:varchar(50)" json:"step"`            // The step running, or last run
+	StepIndex      int               `json:"-"`                                       // Position of Step in the saga
+	Attempts       int               `json:"attempts"`                                // Runs so far
+	MaxAttempts    int               `json:"max_attempts"`                            // Runs before a failing step is given up
+	Input          json.RawMessage   `gorm:"type:jsonb" json:"input"`                 // What was requested
+	State          map[string]string `gorm:"type:jsonb;serializer:json" json:"state"` // Results of the steps so far, e.g. Stripe IDs
+	Error          string            `json:"error,omitempty"`                         // The last step error
+	CompletedAt    *time.Time        `json:"completed_at,omitempty"`                  // When it completed or was compensated
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+func (operation *BillingOperation) BeforeCreate(tx *gorm.DB) error {
+	operation.ID = uuid.New()
+	return nil
+}
@@ -0,0 +1,42 @@
+// models/export.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Export statuses
+const (
+	ExportStatusPending   = "pending"
+	ExportStatusRunning   = "running"
+	ExportStatusCompleted = "completed"
+	ExportStatusFailed    = "failed"  // The last attempt failed; the job may still retry
+	ExportStatusExpired   = "expired" // The file was deleted after the retention period
+)
+
+// Export is an export of subscriptions or users written to a file by a queue
+// worker, for exports too large to stream in one request. The file is stored
+// in ExportChunks until ExpiresAt.
+type Export struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	RequestedByID uuid.UUID  `gorm:"type:uuid;index" json:"requested_by_id"`
+	Resource      string     `gorm:"type:varchar(20);not null" json:"resource"` // "subscriptions" or "users"
+	Format        string     `gorm:"type:varchar(10);not null" json:"format"`   // "csv" or "ndjson"
+	Filters       string     `json:"filters"`                                   // The list filters, as a query string
+	Status        string     `gorm:"type:varchar(20);not null;index" json:"status"`
+	Rows          int64      `json:"rows"`
+	Size          int64      `json:"size"` // Bytes in the file
+	Error         string     `json:"error,omitempty"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt     *time.Time `gorm:"index" json:"expires_at,omitempty"` // When the file is deleted
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func (export *Export) BeforeCreate(tx *gorm.DB) error {
+	export.ID = uuid.New()
+	return nil
+}
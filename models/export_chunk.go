@@ -0,0 +1,18 @@
+// models/export_chunk.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExportChunk is one piece of the file of an asynchronous export. Files are
+// kept in the database so that any instance can serve a download, whichever
+// worker wrote it, and are read back in Seq order.
+type ExportChunk struct {
+	ExportID  uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Seq       int       `gorm:"primaryKey;autoIncrement:false"`
+	Data      []byte    `gorm:"not null"`
+	CreatedAt time.Time
+}
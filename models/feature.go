@@ -0,0 +1,35 @@
+// models/feature.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Feature is a named capability, such as "api_access" or "projects", that
+// products can grant.
+type Feature struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Key         string    `gorm:"type:varchar(100);uniqueIndex;not null" json:"key"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (feature *Feature) BeforeCreate(tx *gorm.DB) error {
+	feature.ID = uuid.New()
+	return nil
+}
+
+// Entitlement grants a feature to everyone with access to the product. Limit
+// is the numeric allowance, such as the number of projects; nil means
+// unlimited.
+type Entitlement struct {
+	ProductID uuid.UUID `gorm:"type:uuid;primaryKey" json:"product_id"`
+	FeatureID uuid.UUID `gorm:"type:uuid;primaryKey" json:"feature_id"`
+	Feature   Feature   `gorm:"foreignKey:FeatureID" json:"feature"`
+	Limit     *int64    `gorm:"column:limit_value" json:"limit"`
+}
@@ -0,0 +1,62 @@
+// models/gift.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Gift statuses
+const (
+	GiftStatusPending   = "pending"   // Waiting for the buyer's payment
+	GiftStatusPaid      = "paid"      // Paid and ready to be redeemed
+	GiftStatusRedeemed  = "redeemed"  // Turned into a subscription
+	GiftStatusExpired   = "expired"   // Checkout expired or the code was not redeemed in time
+	GiftStatusCancelled = "cancelled" // Payment refunded
+)
+
+// Gift is a prepaid subscription bought for someone else. Once paid, its code
+// can be redeemed once, before ExpiresAt, for a subscription of Months months.
+type Gift struct {
+	ID                      uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	PurchaserID             uuid.UUID `gorm:"type:uuid;index"`
+	ProductID               uuid.UUID `gorm:"type:uuid;"`
+	Months                  int
+	Amount                  float64
+	RecipientEmail          string
+	Message                 string
+	Code                    string `gorm:"type:varchar(32);uniqueIndex;not null"`
+	Status                  string `gorm:"type:varchar(20);index"`
+	ExpiresAt               *time.Time
+	RedeemedByID            *uuid.UUID `gorm:"type:uuid"`
+	RedeemedAt              *time.Time
+	SubscriptionID          *uuid.UUID `gorm:"type:uuid"`
+	StripeCheckoutSessionID string     `gorm:"type:varchar(255);index" json:"stripe_checkout_session_id"`
+	StripePaymentIntentID   string     `gorm:"type:varchar(255)" json:"stripe_payment_intent_id"`
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+}
+
+func (gift *Gift) BeforeCreate(tx *gorm.DB) error {
+	gift.ID = uuid.New()
+	return nil
+}
+
+// GiftAuditEntry records everything that happens to a gift, including failed
+// redemption attempts, so that codes can be audited.
+type GiftAuditEntry struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	GiftID    *uuid.UUID `gorm:"type:uuid;index"` // Empty for attempts with an unknown code
+	ActorID   *uuid.UUID `gorm:"type:uuid"`       // Empty for actions taken by Stripe
+	Action    string     `gorm:"type:varchar(50)"`
+	Detail    string
+	IPAddress string `gorm:"type:varchar(64)"`
+	CreatedAt time.Time
+}
+
+func (entry *GiftAuditEntry) BeforeCreate(tx *gorm.DB) error {
+	entry.ID = uuid.New()
+	return nil
+}
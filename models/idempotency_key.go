@@ -0,0 +1,34 @@
+// models/idempotency_key.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// IdempotencyKey stores the response of a mutating request so that a retry
+// carrying the same Idempotency-Key header can be answered without repeating
+// the side effects. A StatusCode of zero means the original request is still
+// in flight, until LockedUntil; after that it is presumed to have died and a
+// retry may take the key over.
+type IdempotencyKey struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID       uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_idempotency_user_key"`
+	Key          string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_idempotency_user_key"`
+	Method       string    `gorm:"type:varchar(10)"`
+	Path         string
+	RequestHash  string `gorm:"type:varchar(64)"`
+	StatusCode   int
+	ContentType  string
+	ResponseBody []byte
+	LockedUntil  *time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (key *IdempotencyKey) BeforeCreate(tx *gorm.DB) error {
+	key.ID = uuid.New()
+	return nil
+}
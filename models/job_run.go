@@ -0,0 +1,35 @@
+// models/job_run.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Job run statuses
+const (
+	JobRunStatusRunning   = "running"
+	JobRunStatusSucceeded = "succeeded"
+	JobRunStatusFailed    = "failed"
+)
+
+// JobRun records one scheduled run of a background job. A job runs at most
+// once per scheduled time, whichever replica picks it up.
+type JobRun struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Job         string     `gorm:"type:varchar(100);not null;uniqueIndex:idx_job_run_schedule" json:"job"`
+	ScheduledAt time.Time  `gorm:"not null;uniqueIndex:idx_job_run_schedule" json:"scheduled_at"`
+	Status      string     `gorm:"type:varchar(20);index" json:"status"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	Host        string     `gorm:"type:varchar(255)" json:"host"` // The replica that ran the job
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
+
+func (run *JobRun) BeforeCreate(tx *gorm.DB) error {
+	run.ID = uuid.New()
+	return nil
+}
@@ -0,0 +1,82 @@
+// models/organization.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Organization member roles
+const (
+	OrganizationRoleOwner  = "owner"  // Created the organization; cannot be removed
+	OrganizationRoleAdmin  = "admin"  // Manages members, seats and billing
+	OrganizationRoleMember = "member" // Uses the organization's plan when given a seat
+)
+
+// Invitation statuses
+const (
+	InvitationStatusPending  = "pending"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusRevoked  = "revoked"
+)
+
+// Organization is a team account that can own subscriptions on behalf of its
+// members.
+type Organization struct {
+	ID               uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name             string    `gorm:"not null" json:"name"`
+	OwnerID          uuid.UUID `gorm:"type:uuid;index" json:"owner_id"`
+	StripeCustomerID string    `gorm:"type:varchar(255)" json:"stripe_customer_id"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func (organization *Organization) BeforeCreate(tx *gorm.DB) error {
+	organization.ID = uuid.New()
+	return nil
+}
+
+// OrganizationMember links a user to an organization. Only members with a
+// seat inherit the entitlements of the organization's subscriptions.
+type OrganizationMember struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_organization_member" json:"organization_id"`
+	UserID         uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_organization_member;index" json:"user_id"`
+	Role           string    `gorm:"type:varchar(20);not null" json:"role"`
+	HasSeat        bool      `gorm:"not null;default:false" json:"has_seat"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (member *OrganizationMember) BeforeCreate(tx *gorm.DB) error {
+	member.ID = uuid.New()
+	return nil
+}
+
+// CanManage reports whether the member may manage the organization's members
+// and billing.
+func (member OrganizationMember) CanManage() bool {
+	return member.Role == OrganizationRoleOwner || member.Role == OrganizationRoleAdmin
+}
+
+// OrganizationInvitation invites an email address to join an organization.
+// It is accepted by the user registered with that email.
+type OrganizationInvitation struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	OrganizationID uuid.UUID  `gorm:"type:uuid;index" json:"organization_id"`
+	Email          string     `gorm:"not null;index" json:"email"`
+	Role           string     `gorm:"type:varchar(20);not null" json:"role"`
+	InvitedByID    uuid.UUID  `gorm:"type:uuid" json:"invited_by_id"`
+	Status         string     `gorm:"type:varchar(20);index" json:"status"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	AcceptedAt     *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (invitation *OrganizationInvitation) BeforeCreate(tx *gorm.DB) error {
+	invitation.ID = uuid.New()
+	return nil
+}
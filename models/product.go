@@ -5,12 +5,45 @@ import (
 	"github.com/google/uuid"
 )
 
+// Product kinds. A base product is a plan a user subscribes to; an add-on can
+// only be attached to an existing subscription to a compatible base product.
+const (
+	ProductKindBase  = "base"
+	ProductKindAddon = "addon"
+)
+
 type Product struct {
 	ID                   uuid.UUID `gorm:"type:uuid;primary_key;"`
 	Name                 string    `gorm:"not null"`
 	Description          string
+	Kind                 string `gorm:"type:varchar(20);not null;default:'base'"`
 	MonthlyPrice         float64
 	YearlyPrice          float64
-	StripeMonthlyPriceID string `gorm:"type:varchar(255)"`
-	StripeYearlyPriceID  string `gorm:"type:varchar(255)"`
+	OneTimePrice         float64 // Price of a one-time purchase, zero when not sold once
+	LifetimeAccess       bool    // A one-time purchase grants permanent access to the product
+	StripeProductID      string  `gorm:"type:varchar(255);index"`
+	StripeMonthlyPriceID string  `gorm:"type:varchar(255)"`
+	StripeYearlyPriceID  string  `gorm:"type:varchar(255)"`
+	StripeOneTimePriceID string  `gorm:"type:varchar(255)"`
+}
+
+func (p *Product) IsAddon() bool {
+	return p.Kind == ProductKindAddon
+}
+
+// IsRecurring reports whether the product can be subscribed to.
+func (p *Product) IsRecurring() bool {
+	return p.StripeMonthlyPriceID != "" || p.StripeYearlyPriceID != ""
+}
+
+// IsOneTime reports whether the product can be bought with a one-time payment.
+func (p *Product) IsOneTime() bool {
+	return p.StripeOneTimePriceID != ""
+}
+
+// AddonCompatibility lists the base products an add-on may be attached to.
+// An add-on without any rows is compatible with every base product.
+type AddonCompatibility struct {
+	AddonProductID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	BaseProductID  uuid.UUID `gorm:"type:uuid;primaryKey"`
 }
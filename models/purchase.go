@@ -0,0 +1,38 @@
+// models/purchase.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Purchase statuses
+const (
+	PurchaseStatusPending  = "pending"
+	PurchaseStatusPaid     = "paid"
+	PurchaseStatusExpired  = "expired"
+	PurchaseStatusRefunded = "refunded"
+)
+
+// Purchase is a one-time payment for a product, paid through Stripe Checkout.
+type Purchase struct {
+	ID                      uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID                  uuid.UUID `gorm:"type:uuid;index"`
+	ProductID               uuid.UUID `gorm:"type:uuid;"`
+	Amount                  float64
+	Currency                string `gorm:"type:varchar(3)"`
+	Status                  string `gorm:"type:varchar(20);index"` // "pending", "paid", "expired" or "refunded"
+	Lifetime                bool   `json:"lifetime"`               // Grants the same access as an active subscription
+	StripeCheckoutSessionID string `gorm:"type:varchar(255);index" json:"stripe_checkout_session_id"`
+	StripePaymentIntentID   string `gorm:"type:varchar(255)" json:"stripe_payment_intent_id"`
+	PaidAt                  *time.Time
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+}
+
+func (purchase *Purchase) BeforeCreate(tx *gorm.DB) error {
+	purchase.ID = uuid.New()
+	return nil
+}
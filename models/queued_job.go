@@ -0,0 +1,44 @@
+// models/queued_job.go
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Queued job statuses. Dead jobs failed every attempt and wait for an admin
+// to retry or discard them.
+const (
+	QueuedJobStatusPending   = "pending"
+	QueuedJobStatusRunning   = "running"
+	QueuedJobStatusSucceeded = "succeeded"
+	QueuedJobStatusDead      = "dead"
+	QueuedJobStatusDiscarded = "discarded"
+)
+
+// QueuedJob is a unit of work in the Postgres job queue. Jobs with a
+// UniqueKey are deduplicated: only one unfinished job may hold a key.
+type QueuedJob struct {
+	ID          uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Kind        string          `gorm:"type:varchar(100);not null;index" json:"kind"`
+	Payload     json.RawMessage `gorm:"type:jsonb;not null" json:"payload"`
+	UniqueKey   *string         `gorm:"type:varchar(255);uniqueIndex:idx_queued_job_unique_key,where:finished_at IS NULL" json:"unique_key,omitempty"`
+	Status      string          `gorm:"type:varchar(20);not null;index:idx_queued_job_claim,priority:1" json:"status"`
+	RunAt       time.Time       `gorm:"not null;index:idx_queued_job_claim,priority:2" json:"run_at"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	LockedBy    string          `gorm:"type:varchar(255)" json:"locked_by,omitempty"`
+	LockedAt    *time.Time      `json:"locked_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+func (job *QueuedJob) BeforeCreate(tx *gorm.DB) error {
+	job.ID = uuid.New()
+	return nil
+}
@@ -0,0 +1,19 @@
+// models/quota_usage.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// QuotaUsage counts how much of a feature's limit a user consumed in one
+// billing period. A new row starts with every period.
+type QuotaUsage struct {
+	UserID      uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Feature     string    `gorm:"type:varchar(100);primaryKey" json:"feature"`
+	PeriodStart time.Time `gorm:"primaryKey" json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Used        int64     `gorm:"not null;default:0;check:used >= 0" json:"used"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
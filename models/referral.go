@@ -0,0 +1,39 @@
+// models/referral.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Referral statuses
+const (
+	ReferralStatusPending   = "pending"   // The referred user has not paid yet
+	ReferralStatusConverted = "converted" // The referred user paid and the referrer was credited
+	ReferralStatusCapped    = "capped"    // Converted, but the referrer already reached the credit cap
+	ReferralStatusRejected  = "rejected"  // Not eligible, e.g. a self-referral
+)
+
+// Referral tracks a user who signed up with someone else's referral code.
+type Referral struct {
+	ID              uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ReferrerID      uuid.UUID  `gorm:"type:uuid;index"`
+	ReferredUserID  uuid.UUID  `gorm:"type:uuid;uniqueIndex"`
+	Code            string     `gorm:"type:varchar(32)"`
+	Status          string     `gorm:"type:varchar(20);index"`
+	RejectReason    string     `json:"reject_reason,omitempty"`
+	SubscriptionID  *uuid.UUID `gorm:"type:uuid" json:"subscription_id,omitempty"`
+	RewardType      string     `gorm:"type:varchar(20)" json:"reward_type,omitempty"` // "balance" or "coupon"
+	RewardAmount    int64      `json:"reward_amount,omitempty"`                       // Credit in cents for balance rewards
+	StripeReference string     `json:"stripe_reference,omitempty"`                    // Balance transaction or coupon ID
+	ConvertedAt     *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (referral *Referral) BeforeCreate(tx *gorm.DB) error {
+	referral.ID = uuid.New()
+	return nil
+}
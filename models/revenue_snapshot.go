@@ -0,0 +1,30 @@
+// models/revenue_snapshot.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RevenueSnapshot is the state of one subscription at the end of a day, kept
+// so that revenue metrics for past days do not change when subscriptions do.
+// Only subscriptions that were not canceled are snapshotted.
+type RevenueSnapshot struct {
+	ID             uuid.UUID          `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Date           time.Time          `gorm:"type:date;not null;uniqueIndex:idx_revenue_snapshot_day_subscription" json:"date"`
+	SubscriptionID uuid.UUID          `gorm:"type:uuid;not null;uniqueIndex:idx_revenue_snapshot_day_subscription" json:"subscription_id"`
+	UserID         uuid.UUID          `gorm:"type:uuid" json:"user_id"`
+	OrganizationID *uuid.UUID         `gorm:"type:uuid" json:"organization_id,omitempty"`
+	ProductID      uuid.UUID          `gorm:"type:uuid" json:"product_id"`
+	Plan           string             `gorm:"type:varchar(20)" json:"plan"`
+	Status         SubscriptionStatus `gorm:"type:varchar(20)" json:"status"`
+	MRR            int64              `json:"mrr"` // Monthly recurring revenue in cents, yearly plans divided by 12
+	CreatedAt      time.Time          `json:"created_at"`
+}
+
+func (snapshot *RevenueSnapshot) BeforeCreate(tx *gorm.DB) error {
+	snapshot.ID = uuid.New()
+	return nil
+}
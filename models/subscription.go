@@ -20,21 +20,47 @@ import (
 
 // }
 
+// Personal and organization subscriptions are unique per product until they
+// are canceled. The indexes back the duplicate checks made when subscribing,
+// which alone can race. They are partial indexes over statuses, so they are
+// created by the database package once legacy statuses are migrated rather
+// than by AutoMigrate.
+const (
+	LiveUserSubscriptionIndex         = "idx_subscription_live_user_product"
+	LiveOrganizationSubscriptionIndex = "idx_subscription_live_organization_product"
+)
+
 type Subscription struct {
 	ID           uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	UserID       uuid.UUID  `gorm:"type:uuid;"`
+	UserID       uuid.UUID  `gorm:"type:uuid"`
 	User         CustomUser `gorm:"foreignKey:UserID"`
-	ProductID    uuid.UUID  `gorm:"type:uuid;"`
+	ProductID    uuid.UUID  `gorm:"type:uuid"`
 	StartDate    time.Time
 	EndDate      time.Time
 	TrialEndDate time.Time
-	Status       string // e.g., "active", "cancelled", "trial"
-	Plan         string // "monthly" or "yearly"
-	StripeID     string `json:"stripe_id"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
-	IsInTrial    bool `json:"is_in_trial"` // New field to track trial status
-
+	Status       SubscriptionStatus `gorm:"type:varchar(20);index"` // Only change through TransitionTo
+	Plan         string             // "monthly" or "yearly"
+	StripeID     string             `json:"stripe_id"`
+	// Set for subscriptions created from a Stripe subscription schedule
+	StripeScheduleID string `json:"stripe_schedule_id"`
+	// Set for subscriptions owned by an organization instead of UserID alone;
+	// UserID is then the member who bought it
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"`
+	Seats          int64      `json:"seats,omitempty"` // Seats bought for an organization
+	// When the reminder for the renewal on EndDate was sent
+	RenewalReminderSentAt *time.Time `json:"renewal_reminder_sent_at,omitempty"`
+	// When the warning that the trial ends on TrialEndDate was sent
+	TrialReminderSentAt *time.Time `json:"trial_reminder_sent_at,omitempty"`
+	// Set when an admin moved the end date of a Stripe subscription: Stripe
+	// bills nothing until then and reports it as trialing, but it stays
+	// active here (see BillingDeferred)
+	BillingDeferredUntil *time.Time `json:"billing_deferred_until,omitempty"`
+	// The discount of the Stripe coupon on the subscription, if any
+	DiscountPercentOff float64 `json:"discount_percent_off,omitempty"`
+	DiscountAmountOff  int64   `json:"discount_amount_off,omitempty"` // Cents off each invoice
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	Items              []SubscriptionItem `gorm:"foreignKey:SubscriptionID" json:"items,omitempty"`
 }
 
 func (sub *Subscription) BeforeCreate(tx *gorm.DB) error {
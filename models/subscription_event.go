@@ -0,0 +1,98 @@
+// models/subscription_event.go
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Subscription event types
+const (
+	SubscriptionEventCreated          = "created"
+	SubscriptionEventTrialStarted     = "trial_started"
+	SubscriptionEventTrialEnded       = "trial_ended"
+	SubscriptionEventActivated        = "activated" // A scheduled subscription started
+	SubscriptionEventPlanChanged      = "plan_changed"
+	SubscriptionEventAddonAdded       = "addon_added"
+	SubscriptionEventAddonRemoved     = "addon_removed"
+	SubscriptionEventPaymentFailed    = "payment_failed"
+	SubscriptionEventPaymentRecovered = "payment_recovered" // A past due subscription was paid
+	SubscriptionEventPaused           = "paused"
+	SubscriptionEventResumed          = "resumed"
+	SubscriptionEventCancelled        = "cancelled"
+	SubscriptionEventTrialExtended    = "trial_extended"   // An admin moved the trial end
+	SubscriptionEventEndDateChanged   = "end_date_changed" // An admin moved the end date, or reconciling found Stripe's
+)
+
+// Sources of subscription events
+const (
+	EventSourceAPI     = "api"
+	EventSourceWebhook = "webhook"
+	EventSourceJob     = "job"
+	EventSourceAdmin   = "admin" // An admin override, with a reason
+)
+
+// SubscriptionEvent records one transition of a subscription, with the state
+// before and after it. Events are append-only.
+type SubscriptionEvent struct {
+	ID             uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	SubscriptionID uuid.UUID       `gorm:"type:uuid;index" json:"subscription_id"`
+	Type           string          `gorm:"type:varchar(50);not null" json:"type"`
+	ActorID        *uuid.UUID      `gorm:"type:uuid" json:"actor_id"` // Empty for events from Stripe or jobs
+	Source         string          `gorm:"type:varchar(20);not null" json:"source"`
+	Before         json.RawMessage `gorm:"type:jsonb" json:"before"` // Empty for created events
+	After          json.RawMessage `gorm:"type:jsonb" json:"after"`
+	Reason         string          `json:"reason,omitempty"` // Why an admin made the change; only shown to admins
+	CreatedAt      time.Time       `gorm:"index" json:"created_at"`
+}
+
+var ErrSubscriptionEventImmutable = errors.New("subscription events are append-only")
+
+func (event *SubscriptionEvent) BeforeCreate(tx *gorm.DB) error {
+	event.ID = uuid.New()
+	return nil
+}
+
+func (event *SubscriptionEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrSubscriptionEventImmutable
+}
+
+func (event *SubscriptionEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrSubscriptionEventImmutable
+}
+
+// SubscriptionSnapshot is the state of a subscription stored with its events.
+type SubscriptionSnapshot struct {
+	Status         SubscriptionStatus `json:"status"`
+	Plan           string             `json:"plan"`
+	ProductID      uuid.UUID          `json:"product_id"`
+	StartDate      time.Time          `json:"start_date"`
+	EndDate        time.Time          `json:"end_date"`
+	TrialEndDate   time.Time          `json:"trial_end_date"`
+	IsInTrial      bool               `json:"is_in_trial"`
+	StripeID       string             `json:"stripe_id,omitempty"`
+	OrganizationID *uuid.UUID         `json:"organization_id,omitempty"`
+	Seats          int64              `json:"seats,omitempty"`
+	Items          []SubscriptionItem `json:"items,omitempty"`
+}
+
+// Snapshot captures the subscription's current state.
+func (sub Subscription) Snapshot() SubscriptionSnapshot {
+	return SubscriptionSnapshot{
+		Status:         sub.Status,
+		Plan:           sub.Plan,
+		ProductID:      sub.ProductID,
+		StartDate:      sub.StartDate,
+		EndDate:        sub.EndDate,
+		TrialEndDate:   sub.TrialEndDate,
+		IsInTrial:      sub.IsInTrial(),
+		StripeID:       sub.StripeID,
+		OrganizationID: sub.OrganizationID,
+		Seats:          sub.Seats,
+		Items:          append([]SubscriptionItem(nil), sub.Items...), // Copied so later changes do not alter the snapshot
+	}
+}
@@ -0,0 +1,33 @@
+// models/subscription_item.go
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SubscriptionItem is one billed line of a subscription: the base plan or an
+// add-on product. It mirrors an item of the Stripe subscription.
+type SubscriptionItem struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	SubscriptionID uuid.UUID `gorm:"type:uuid;index"`
+	ProductID      uuid.UUID `gorm:"type:uuid;"`
+	Kind           string    `gorm:"type:varchar(20)"` // "base" or "addon"
+	Quantity       int64
+	StripeItemID   string `json:"stripe_item_id"`
+	StripePriceID  string `json:"stripe_price_id"`
+	// What the Stripe price bills per unit, as subscribed. Revenue metrics use
+	// these rather than the product's current price
+	UnitAmount    int64  `json:"unit_amount,omitempty"`                      // Cents per billing interval
+	Interval      string `gorm:"type:varchar(10)" json:"interval,omitempty"` // "day", "week", "month" or "year"
+	IntervalCount int64  `json:"interval_count,omitempty"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (item *SubscriptionItem) BeforeCreate(tx *gorm.DB) error {
+	item.ID = uuid.New()
+	return nil
+}
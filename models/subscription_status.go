@@ -0,0 +1,109 @@
+// models/subscription_status.go
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// SubscriptionStatus is the lifecycle state of a subscription. It mirrors
+// Stripe's subscription statuses, plus "scheduled" for subscriptions waiting
+// for their Stripe subscription schedule to start.
+type SubscriptionStatus string
+
+const (
+	SubscriptionStatusScheduled  SubscriptionStatus = "scheduled"
+	SubscriptionStatusIncomplete SubscriptionStatus = "incomplete" // Being set up in Stripe, or the first payment has not succeeded yet
+	SubscriptionStatusTrialing   SubscriptionStatus = "trialing"
+	SubscriptionStatusActive     SubscriptionStatus = "active"
+	SubscriptionStatusPastDue    SubscriptionStatus = "past_due" // A renewal payment failed and is being retried
+	SubscriptionStatusUnpaid     SubscriptionStatus = "unpaid"   // Retries are exhausted; invoices stay open
+	SubscriptionStatusPaused     SubscriptionStatus = "paused"   // A trial ended without a payment method
+	SubscriptionStatusCanceled   SubscriptionStatus = "canceled"
+)
+
+// GrantingSubscriptionStatuses are the statuses in which a subscription gives
+// access to its products.
+var GrantingSubscriptionStatuses = []SubscriptionStatus{
+	SubscriptionStatusTrialing,
+	SubscriptionStatusActive,
+	SubscriptionStatusPastDue,
+}
+
+// subscriptionTransitions lists the statuses each status may move to.
+// Canceled is final.
+var subscriptionTransitions = map[SubscriptionStatus][]SubscriptionStatus{
+	SubscriptionStatusScheduled:  {SubscriptionStatusIncomplete, SubscriptionStatusTrialing, SubscriptionStatusActive, SubscriptionStatusCanceled},
+	SubscriptionStatusIncomplete: {SubscriptionStatusScheduled, SubscriptionStatusTrialing, SubscriptionStatusActive, SubscriptionStatusCanceled},
+	SubscriptionStatusTrialing:   {SubscriptionStatusActive, SubscriptionStatusPastDue, SubscriptionStatusUnpaid, SubscriptionStatusPaused, SubscriptionStatusCanceled},
+	SubscriptionStatusActive:     {SubscriptionStatusTrialing, SubscriptionStatusPastDue, SubscriptionStatusUnpaid, SubscriptionStatusPaused, SubscriptionStatusCanceled},
+	SubscriptionStatusPastDue:    {SubscriptionStatusActive, SubscriptionStatusUnpaid, SubscriptionStatusPaused, SubscriptionStatusCanceled},
+	SubscriptionStatusUnpaid:     {SubscriptionStatusActive, SubscriptionStatusPastDue, SubscriptionStatusCanceled},
+	SubscriptionStatusPaused:     {SubscriptionStatusTrialing, SubscriptionStatusActive, SubscriptionStatusCanceled},
+	SubscriptionStatusCanceled:   {},
+}
+
+// CanTransitionTo reports whether a subscription in this status may move to
+// next.
+func (status SubscriptionStatus) CanTransitionTo(next SubscriptionStatus) bool {
+	for _, allowed := range subscriptionTransitions[status] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid reports whether the status is one of the known statuses.
+func (status SubscriptionStatus) IsValid() bool {
+	_, ok := subscriptionTransitions[status]
+	return ok
+}
+
+// SubscriptionStatusFromStripe maps a Stripe subscription status to ours.
+// Stripe's incomplete_expired ends the subscription like a cancellation.
+func SubscriptionStatusFromStripe(status string) SubscriptionStatus {
+	if status == "incomplete_expired" {
+		return SubscriptionStatusCanceled
+	}
+	return SubscriptionStatus(status)
+}
+
+// InvalidTransitionError is returned for a status change the lifecycle does
+// not allow.
+type InvalidTransitionError struct {
+	From SubscriptionStatus
+	To   SubscriptionStatus
+}
+
+func (err *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("subscription cannot move from %q to %q", err.From, err.To)
+}
+
+// TransitionTo moves the subscription to the next status, rejecting moves the
+// lifecycle does not allow. It does not save the subscription.
+func (sub *Subscription) TransitionTo(next SubscriptionStatus) error {
+	if !sub.Status.CanTransitionTo(next) {
+		return &InvalidTransitionError{From: sub.Status, To: next}
+	}
+	sub.Status = next
+	return nil
+}
+
+// IsInTrial reports whether the subscription is in its trial period.
+func (sub Subscription) IsInTrial() bool {
+	return sub.Status == SubscriptionStatusTrialing
+}
+
+// IsLapsedTrial reports whether the subscription is a free trial that ended
+// without being paid for. It has no Stripe billing and does not stop its
+// account from subscribing again.
+func (sub Subscription) IsLapsedTrial() bool {
+	return sub.Status == SubscriptionStatusPaused && sub.StripeID == ""
+}
+
+// BillingDeferred reports whether an admin has deferred the subscription's
+// Stripe billing past now. Stripe's "trialing" status is then not a trial.
+func (sub Subscription) BillingDeferred() bool {
+	return sub.BillingDeferredUntil != nil && sub.BillingDeferredUntil.After(time.Now())
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to SubscriptionStatus
+		want     bool
+	}{
+		{SubscriptionStatusScheduled, SubscriptionStatusActive, true},
+		{SubscriptionStatusScheduled, SubscriptionStatusPastDue, false},
+		{SubscriptionStatusIncomplete, SubscriptionStatusActive, true},
+		{SubscriptionStatusIncomplete, SubscriptionStatusScheduled, true},
+		{SubscriptionStatusIncomplete, SubscriptionStatusPaused, false},
+		{SubscriptionStatusTrialing, SubscriptionStatusActive, true},
+		{SubscriptionStatusTrialing, SubscriptionStatusPaused, true},
+		{SubscriptionStatusTrialing, SubscriptionStatusScheduled, false},
+		{SubscriptionStatusActive, SubscriptionStatusTrialing, true},
+		{SubscriptionStatusActive, SubscriptionStatusPastDue, true},
+		{SubscriptionStatusActive, SubscriptionStatusIncomplete, false},
+		{SubscriptionStatusPastDue, SubscriptionStatusActive, true},
+		{SubscriptionStatusPastDue, SubscriptionStatusTrialing, false},
+		{SubscriptionStatusUnpaid, SubscriptionStatusActive, true},
+		{SubscriptionStatusUnpaid, SubscriptionStatusPaused, false},
+		{SubscriptionStatusPaused, SubscriptionStatusActive, true},
+		{SubscriptionStatusPaused, SubscriptionStatusPastDue, false},
+		{SubscriptionStatusCanceled, SubscriptionStatusActive, false},
+		{SubscriptionStatusCanceled, SubscriptionStatusCanceled, false},
+		{SubscriptionStatusActive, SubscriptionStatusActive, false},
+		{SubscriptionStatus("expired"), SubscriptionStatusActive, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%q.CanTransitionTo(%q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionStatusesCanBeCanceled(t *testing.T) {
+	for status := range subscriptionTransitions {
+		if status != SubscriptionStatusCanceled && !status.CanTransitionTo(SubscriptionStatusCanceled) {
+			t.Errorf("%q cannot be canceled", status)
+		}
+		for _, next := range subscriptionTransitions[status] {
+			if !next.IsValid() {
+				t.Errorf("%q moves to unknown status %q", status, next)
+			}
+		}
+	}
+}
+
+func TestSubscriptionTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to SubscriptionStatus
+		wantErr  bool
+	}{
+		{SubscriptionStatusTrialing, SubscriptionStatusActive, false},
+		{SubscriptionStatusActive, SubscriptionStatusCanceled, false},
+		{SubscriptionStatusCanceled, SubscriptionStatusActive, true},
+		{SubscriptionStatusPaused, SubscriptionStatusUnpaid, true},
+	}
+
+	for _, tt := range tests {
+		sub := Subscription{Status: tt.from}
+		err := sub.TransitionTo(tt.to)
+
+		var invalid *InvalidTransitionError
+		switch {
+		case tt.wantErr && !errors.As(err, &invalid):
+			t.Errorf("%q to %q: got %v, want an InvalidTransitionError", tt.from, tt.to, err)
+		case tt.wantErr && sub.Status != tt.from:
+			t.Errorf("%q to %q: status changed to %q on error", tt.from, tt.to, sub.Status)
+		case !tt.wantErr && err != nil:
+			t.Errorf("%q to %q: %v", tt.from, tt.to, err)
+		case !tt.wantErr && sub.Status != tt.to:
+			t.Errorf("%q to %q: status is %q", tt.from, tt.to, sub.Status)
+		}
+	}
+}
+
+func TestSubscriptionStatusFromStripe(t *testing.T) {
+	tests := []struct {
+		stripe string
+		want   SubscriptionStatus
+	}{
+		{"active", SubscriptionStatusActive},
+		{"trialing", SubscriptionStatusTrialing},
+		{"past_due", SubscriptionStatusPastDue},
+		{"incomplete", SubscriptionStatusIncomplete},
+		{"incomplete_expired", SubscriptionStatusCanceled},
+		{"canceled", SubscriptionStatusCanceled},
+	}
+
+	for _, tt := range tests {
+		if got := SubscriptionStatusFromStripe(tt.stripe); got != tt.want {
+			t.Errorf("SubscriptionStatusFromStripe(%q) = %q, want %q", tt.stripe, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionIsLapsedTrial(t *testing.T) {
+	tests := []struct {
+		name string
+		sub  Subscription
+		want bool
+	}{
+		{"paused free trial", Subscription{Status: SubscriptionStatusPaused}, true},
+		{"paused Stripe trial", Subscription{Status: SubscriptionStatusPaused, StripeID: "sub_123"}, false},
+		{"running free trial", Subscription{Status: SubscriptionStatusTrialing}, false},
+		{"canceled free trial", Subscription{Status: SubscriptionStatusCanceled}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sub.IsLapsedTrial(); got != tt.want {
+			t.Errorf("%s: IsLapsedTrial() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionBillingDeferred(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		until *time.Time
+		want  bool
+	}{
+		{"not deferred", nil, false},
+		{"deferred until later", &future, true},
+		{"deferral over", &past, false},
+	}
+
+	for _, tt := range tests {
+		sub := Subscription{Status: SubscriptionStatusActive, BillingDeferredUntil: tt.until}
+		if got := sub.BillingDeferred(); got != tt.want {
+			t.Errorf("%s: BillingDeferred() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
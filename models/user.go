@@ -19,13 +19,16 @@ import (
 // }
 
 type CustomUser struct {
-	ID            uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	Email         string    `gorm:"unique;not null"`
-	Password      string
-	Subscriptions []Subscription `gorm:"foreignKey:UserID"`
-	IsAdmin       bool
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	ID               uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Email            string         `gorm:"unique;not null"`
+	Password         string         `json:"-"` // bcrypt hash, never serialized
+	Subscriptions    []Subscription `gorm:"foreignKey:UserID"`
+	IsAdmin          bool
+	StripeCustomerID string     `gorm:"type:varchar(255)" json:"stripe_customer_id"`
+	ReferralCode     *string    `gorm:"type:varchar(32);uniqueIndex" json:"referral_code"` // The user's own code to share
+	ReferredByID     *uuid.UUID `gorm:"type:uuid" json:"referred_by_id"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
 }
 
 func (user *CustomUser) BeforeCreate(tx *gorm.DB) error {
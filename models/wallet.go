@@ -0,0 +1,75 @@
+// models/wallet.go
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Wallet entry types
+const (
+	WalletEntryTopUp  = "top_up"
+	WalletEntrySpend  = "spend"
+	WalletEntryRefund = "refund"
+	WalletEntryExpiry = "expiry"
+)
+
+// Wallet holds a user's prepaid balance in cents. The balance is the sum of
+// the user's wallet entries and is kept on this row so that spends can lock it;
+// the check constraint guarantees it never goes negative.
+type Wallet struct {
+	UserID    uuid.UUID  `gorm:"type:uuid;primary_key"`
+	Balance   int64      `gorm:"not null;default:0;check:balance >= 0"`
+	ExpiresAt *time.Time // Remaining credit expires after this, extended by every top-up
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// WalletEntry is one append-only line of a wallet's ledger. Credits (top-ups
+// and refunds) are positive, debits (spends and expiry) are negative.
+type WalletEntry struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID       uuid.UUID `gorm:"type:uuid;index;uniqueIndex:idx_wallet_entry_type_reference,where:reference <> ''"`
+	Type         string    `gorm:"type:varchar(20);uniqueIndex:idx_wallet_entry_type_reference,where:reference <> ''"`
+	Amount       int64
+	BalanceAfter int64
+	Reference    string `gorm:"type:varchar(255);uniqueIndex:idx_wallet_entry_type_reference,where:reference <> ''"` // Caller supplied key, makes the entry idempotent per type
+	Description  string
+	CreatedAt    time.Time
+}
+
+var ErrWalletEntryImmutable = errors.New("wallet entries are append-only")
+
+func (entry *WalletEntry) BeforeCreate(tx *gorm.DB) error {
+	entry.ID = uuid.New()
+	return nil
+}
+
+func (entry *WalletEntry) BeforeUpdate(tx *gorm.DB) error {
+	return ErrWalletEntryImmutable
+}
+
+func (entry *WalletEntry) BeforeDelete(tx *gorm.DB) error {
+	return ErrWalletEntryImmutable
+}
+
+// WalletTopUp is a pending or completed purchase of wallet credit through
+// Stripe Checkout.
+type WalletTopUp struct {
+	ID                      uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	UserID                  uuid.UUID `gorm:"type:uuid;index"`
+	Amount                  int64     // In cents
+	Status                  string    `gorm:"type:varchar(20)"` // "pending", "paid" or "expired"
+	StripeCheckoutSessionID string    `gorm:"type:varchar(255);index" json:"stripe_checkout_session_id"`
+	StripePaymentIntentID   string    `gorm:"type:varchar(255)" json:"stripe_payment_intent_id"`
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+}
+
+func (topUp *WalletTopUp) BeforeCreate(tx *gorm.DB) error {
+	topUp.ID = uuid.New()
+	return nil
+}
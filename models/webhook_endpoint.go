@@ -0,0 +1,73 @@
+// models/webhook_endpoint.go
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// WebhookEndpoint is a URL of one of our own systems that receives events.
+// Deliveries are signed with Secret.
+type WebhookEndpoint struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	URL         string    `gorm:"type:varchar(2048);not null" json:"url"`
+	Description string    `json:"description"`
+	EventTypes  []string  `gorm:"type:jsonb;serializer:json;not null" json:"event_types"` // "*" subscribes to every event
+	Secret      string    `gorm:"type:varchar(100);not null" json:"-"`
+	Active      bool      `gorm:"not null;default:true" json:"active"`
+	CreatedByID uuid.UUID `gorm:"type:uuid" json:"created_by_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (endpoint *WebhookEndpoint) BeforeCreate(tx *gorm.DB) error {
+	endpoint.ID = uuid.New()
+	return nil
+}
+
+// Subscribes reports whether the endpoint receives events of the given type.
+func (endpoint WebhookEndpoint) Subscribes(eventType string) bool {
+	for _, subscribed := range endpoint.EventTypes {
+		if subscribed == "*" || subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is an event emitted to webhook endpoints. Data is the payload's
+// data object.
+type WebhookEvent struct {
+	ID        uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Type      string          `gorm:"type:varchar(100);not null;index" json:"type"`
+	Data      json.RawMessage `gorm:"type:jsonb;not null" json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (event *WebhookEvent) BeforeCreate(tx *gorm.DB) error {
+	event.ID = uuid.New()
+	return nil
+}
+
+// WebhookDelivery logs one attempt to deliver an event to an endpoint.
+type WebhookDelivery struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	EndpointID   uuid.UUID `gorm:"type:uuid;not null;index" json:"endpoint_id"`
+	EventID      uuid.UUID `gorm:"type:uuid;not null;index" json:"event_id"`
+	EventType    string    `gorm:"type:varchar(100)" json:"event_type"`
+	Attempt      int       `json:"attempt"`
+	Succeeded    bool      `json:"succeeded"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"` // Truncated
+	Error        string    `json:"error,omitempty"`
+	DurationMs   int64     `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (delivery *WebhookDelivery) BeforeCreate(tx *gorm.DB) error {
+	delivery.ID = uuid.New()
+	return nil
+}
@@ -0,0 +1,145 @@
+// File: notify/notify.go
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"gorm.io/gorm"
+)
+
+// Email templates. Each has a subject, a text and an HTML part; see
+// Templates.
+const (
+	TemplateWelcome                = "welcome"
+	TemplateTrialStarted           = "trial_started"
+	TemplateTrialEnding            = "trial_ending"
+	TemplateSubscriptionStarted    = "subscription_started"
+	TemplateReceipt                = "receipt"
+	TemplatePaymentFailed          = "payment_failed"
+	TemplateSubscriptionCancelled  = "subscription_cancelled"
+	TemplateRenewalReminder        = "renewal_reminder"
+	TemplateOrganizationInvitation = "organization_invitation"
+)
+
+// Message is a rendered email.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Transport delivers rendered emails.
+type Transport interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Notifier renders templated emails and hands them to a transport.
+type Notifier struct {
+	transport Transport
+	templates *Templates
+	appName   string
+}
+
+func New(transport Transport, templates *Templates, appName string) *Notifier {
+	return &Notifier{transport: transport, templates: templates, appName: appName}
+}
+
+// FromEnv configures a notifier from the environment. Emails go through SMTP
+// when SMTP_HOST is set, and are otherwise written to NOTIFY_OUTBOX_DIR
+// (default "outbox") for development. NOTIFY_TEMPLATE_DIR overrides the
+// built-in templates.
+func FromEnv() (*Notifier, error) {
+	templates, err := LoadTemplates(os.Getenv("NOTIFY_TEMPLATE_DIR"))
+	if err != nil {
+		return nil, err
+	}
+
+	from := os.Getenv("NOTIFY_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	var transport Transport
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		transport = &SMTPTransport{Addr: host + ":" + port, Auth: auth, From: from}
+	} else {
+		dir := os.Getenv("NOTIFY_OUTBOX_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		transport = &FileTransport{Dir: dir, From: from}
+	}
+
+	appName := os.Getenv("APP_NAME")
+	if appName == "" {
+		appName = "Subscriptions"
+	}
+
+	return New(transport, templates, appName), nil
+}
+
+// Send renders the template with data and delivers it to the recipient right
+// away. Handlers should use Enqueue instead.
+func (n *Notifier) Send(ctx context.Context, to string, template string, data map[string]interface{}) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+
+	withDefaults := map[string]interface{}{"AppName": n.appName}
+	for key, value := range data {
+		withDefaults[key] = value
+	}
+
+	msg, err := n.templates.Render(template, withDefaults)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+
+	return n.transport.Send(ctx, msg)
+}
+
+// EmailTask is a queued email.
+type EmailTask struct {
+	To       string                 `json:"to"`
+	Template string                 `json:"template"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+func (EmailTask) Kind() string { return "email" }
+
+// Enqueue queues an email to be rendered and sent by a queue worker, retrying
+// if the transport fails. Pass a transaction as db to send the email only if
+// it commits. Emails with a uniqueKey are not queued twice while one is
+// waiting to be sent.
+func Enqueue(db *gorm.DB, to string, template string, data map[string]interface{}, uniqueKey string) error {
+	_, err := jobs.Enqueue(db, EmailTask{To: to, Template: template, Data: data}, jobs.EnqueueOptions{UniqueKey: uniqueKey})
+	if errors.Is(err, jobs.ErrDuplicateJob) {
+		return nil
+	}
+	return err
+}
+
+// Deliver sends a queued email. Register it with jobs.Handle.
+func (n *Notifier) Deliver(ctx context.Context, task EmailTask) error {
+	err := n.Send(ctx, task.To, task.Template, task.Data)
+	if errors.Is(err, ErrUnknownTemplate) {
+		return jobs.Permanent(err)
+	}
+	return err
+}
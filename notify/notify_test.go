@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNotifierSend(t *testing.T) {
+	templates, err := LoadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		to          string
+		template    string
+		data        map[string]interface{}
+		wantErr     error
+		wantSubject string
+		wantText    string
+		wantHTML    string
+	}{
+		{
+			name:        "rendered",
+			to:          "ada@example.com",
+			template:    TemplateWelcome,
+			data:        map[string]interface{}{"Email": "ada@example.com"},
+			wantSubject: "Welcome to Acme",
+			wantText:    "Your Acme account for ada@example.com is ready.",
+			wantHTML:    "<strong>ada@example.com</strong>",
+		},
+		{
+			name:     "HTML escaped",
+			to:       "ada@example.com",
+			template: TemplateWelcome,
+			data:     map[string]interface{}{"Email": "<b>ada</b>"},
+			wantText: "account for <b>ada</b> is ready",
+			wantHTML: "<strong>&lt;b&gt;ada&lt;/b&gt;</strong>",
+		},
+		{
+			name:        "app name overridden",
+			to:          "ada@example.com",
+			template:    TemplateWelcome,
+			data:        map[string]interface{}{"AppName": "Other"},
+			wantSubject: "Welcome to Other",
+		},
+		{
+			name:     "unknown template",
+			to:       "ada@example.com",
+			template: "missing",
+			wantErr:  ErrUnknownTemplate,
+		},
+		{
+			name:     "header injection",
+			to:       "ada@example.com\r\nBcc: eve@example.com",
+			template: TemplateWelcome,
+			wantErr:  errors.New("invalid recipient"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &MemoryTransport{}
+			err := New(transport, templates, "Acme").Send(context.Background(), tt.to, tt.template, tt.data)
+
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error())) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if sent := transport.Messages(); len(sent) != 0 {
+					t.Errorf("sent %d emails after an error", len(sent))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sent := transport.Messages()
+			if len(sent) != 1 {
+				t.Fatalf("sent %d emails, want 1", len(sent))
+			}
+			msg := sent[0]
+			if msg.To != tt.to {
+				t.Errorf("sent to %q, want %q", msg.To, tt.to)
+			}
+			if tt.wantSubject != "" && msg.Subject != tt.wantSubject {
+				t.Errorf("subject %q, want %q", msg.Subject, tt.wantSubject)
+			}
+			if !strings.Contains(msg.Text, tt.wantText) {
+				t.Errorf("text %q does not contain %q", msg.Text, tt.wantText)
+			}
+			if !strings.Contains(msg.HTML, tt.wantHTML) {
+				t.Errorf("HTML %q does not contain %q", msg.HTML, tt.wantHTML)
+			}
+		})
+	}
+}
+
+func TestTemplatesComplete(t *testing.T) {
+	templates, err := LoadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		TemplateWelcome,
+		TemplateTrialStarted,
+		TemplateTrialEnding,
+		TemplateSubscriptionStarted,
+		TemplateReceipt,
+		TemplatePaymentFailed,
+		TemplateSubscriptionCancelled,
+		TemplateRenewalReminder,
+		TemplateOrganizationInvitation,
+	} {
+		msg, err := templates.Render(name, map[string]interface{}{"AppName": "Acme"})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if msg.Subject == "" || strings.ContainsAny(msg.Subject, "\r\n") {
+			t.Errorf("%s: invalid subject %q", name, msg.Subject)
+		}
+	}
+}
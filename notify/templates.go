@@ -0,0 +1,128 @@
+// File: notify/templates.go
+package notify
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+var ErrUnknownTemplate = errors.New("unknown email template")
+
+// Templates holds the email templates. A template named "welcome" consists of
+// welcome.subject.tmpl, welcome.txt.tmpl and welcome.html.tmpl. Files in the
+// override directory replace the built-in file of the same name, and new
+// templates can be added there.
+type Templates struct {
+	subject map[string]*texttemplate.Template
+	text    map[string]*texttemplate.Template
+	html    map[string]*htmltemplate.Template
+}
+
+// LoadTemplates parses the built-in templates and the overrides in dir, if
+// dir is not empty. Every template must have all three parts.
+func LoadTemplates(dir string) (*Templates, error) {
+	sources := map[string]string{}
+	if err := readTemplates(mustSub(builtinTemplates, "templates"), sources); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := readTemplates(os.DirFS(dir), sources); err != nil {
+			return nil, fmt.Errorf("reading templates from %s: %w", dir, err)
+		}
+	}
+
+	templates := &Templates{
+		subject: map[string]*texttemplate.Template{},
+		text:    map[string]*texttemplate.Template{},
+		html:    map[string]*htmltemplate.Template{},
+	}
+
+	for file, source := range sources {
+		var err error
+		switch name := strings.TrimSuffix(file, ".tmpl"); {
+		case strings.HasSuffix(name, ".subject"):
+			templates.subject[strings.TrimSuffix(name, ".subject")], err = texttemplate.New(file).Option("missingkey=zero").Parse(source)
+		case strings.HasSuffix(name, ".txt"):
+			templates.text[strings.TrimSuffix(name, ".txt")], err = texttemplate.New(file).Option("missingkey=zero").Parse(source)
+		case strings.HasSuffix(name, ".html"):
+			templates.html[strings.TrimSuffix(name, ".html")], err = htmltemplate.New(file).Option("missingkey=zero").Parse(source)
+		default:
+			err = errors.New("name must end in .subject.tmpl, .txt.tmpl or .html.tmpl")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", file, err)
+		}
+	}
+
+	for name := range templates.subject {
+		if templates.text[name] == nil || templates.html[name] == nil {
+			return nil, fmt.Errorf("template %s must have subject, txt and html parts", name)
+		}
+	}
+
+	return templates, nil
+}
+
+func readTemplates(fsys fs.FS, sources map[string]string) error {
+	files, err := fs.Glob(fsys, "*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		source, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		sources[path.Base(file)] = string(source)
+	}
+	return nil
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Render executes all three parts of the named template.
+func (t *Templates) Render(name string, data map[string]interface{}) (Message, error) {
+	subject, ok := t.subject[name]
+	if !ok {
+		return Message{}, fmt.Errorf("%w: %s", ErrUnknownTemplate, name)
+	}
+
+	var msg Message
+	var buf bytes.Buffer
+	if err := subject.Execute(&buf, data); err != nil {
+		return Message{}, err
+	}
+	// Subjects are a single header line
+	msg.Subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := t.text[name].Execute(&buf, data); err != nil {
+		return Message{}, err
+	}
+	msg.Text = buf.String()
+
+	buf.Reset()
+	if err := t.html[name].Execute(&buf, data); err != nil {
+		return Message{}, err
+	}
+	msg.HTML = buf.String()
+
+	return msg, nil
+}
@@ -0,0 +1,196 @@
+// File: quota/quota.go
+package quota
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/entitlements"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage is a user's consumption of a feature in the current period.
+type Usage struct {
+	Feature     string    `json:"feature"`
+	Limit       *int64    `json:"limit"` // nil means unlimited
+	Used        int64     `json:"used"`
+	Remaining   *int64    `json:"remaining"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+func newUsage(grant entitlements.Grant, used int64, start, end time.Time) Usage {
+	usage := Usage{
+		Feature:     grant.Feature,
+		Limit:       grant.Limit,
+		Used:        used,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+	if grant.Limit != nil {
+		remaining := *grant.Limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.Remaining = &remaining
+	}
+	return usage
+}
+
+// CurrentPeriod returns the quota period the user is in for the grant. It is
+// aligned to the billing period of the subscription granting the feature, and
+// falls back to the calendar month for lifetime purchases.
+func CurrentPeriod(db *gorm.DB, userID uuid.UUID, grant entitlements.Grant) (time.Time, time.Time, error) {
+	now := time.Now()
+
+	subscriptions, err := entitlements.GrantingSubscriptions(db, userID)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	for _, subscription := range subscriptions {
+		if !grantsFeature(grant, subscription) {
+			continue
+		}
+		months := 1
+		if subscription.Plan == "yearly" {
+			months = 12
+		}
+		start, end := periodContaining(subscription.StartDate, months, now)
+		return start, end, nil
+	}
+
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+func grantsFeature(grant entitlements.Grant, subscription models.Subscription) bool {
+	for _, productID := range grant.ProductIDs {
+		if productID == subscription.ProductID {
+			return true
+		}
+		for _, item := range subscription.Items {
+			if productID == item.ProductID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// periodContaining returns the period of the given length in months, counted
+// from anchor, that contains t. Periods are always computed from the anchor so
+// that short months do not make them drift.
+func periodContaining(anchor time.Time, months int, t time.Time) (time.Time, time.Time) {
+	if t.Before(anchor) {
+		return anchor, addMonths(anchor, months)
+	}
+
+	elapsed := (t.Year()-anchor.Year())*12 + int(t.Month()-anchor.Month())
+	n := elapsed / months
+	start := addMonths(anchor, n*months)
+	if start.After(t) {
+		n--
+		start = addMonths(anchor, n*months)
+	}
+
+	return start, addMonths(anchor, (n+1)*months)
+}
+
+// addMonths moves t forward by the given number of months, keeping its day of
+// the month where the target month has it and using the month's last day
+// otherwise, the way Stripe bills a subscription anchored on the 31st.
+// time.AddDate would overflow into the next month instead.
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// Check returns the user's usage of the feature without consuming any.
+func Check(db *gorm.DB, userID uuid.UUID, grant entitlements.Grant) (Usage, error) {
+	start, end, err := CurrentPeriod(db, userID, grant)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var row models.QuotaUsage
+	err = db.Where("user_id = ? AND feature = ? AND period_start = ?", userID, grant.Feature, start).First(&row).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return Usage{}, err
+	}
+
+	return newUsage(grant, row.Used, start, end), nil
+}
+
+// Increment consumes n units of the feature. The check and the increment are a
+// single upsert, so concurrent requests can never push usage past the limit;
+// when they would, nothing is consumed and ErrQuotaExceeded is returned along
+// with the current usage.
+func Increment(db *gorm.DB, userID uuid.UUID, grant entitlements.Grant, n int64) (Usage, error) {
+	start, end, err := CurrentPeriod(db, userID, grant)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	if grant.Limit != nil && n > *grant.Limit {
+		usage, err := Check(db, userID, grant)
+		if err != nil {
+			return Usage{}, err
+		}
+		return usage, ErrQuotaExceeded
+	}
+
+	query := `INSERT INTO quota_usages (user_id, feature, period_start, period_end, used, updated_at)
+		VALUES (@user_id, @feature, @period_start, @period_end, @n, NOW())
+		ON CONFLICT (user_id, feature, period_start)
+		DO UPDATE SET used = quota_usages.used + EXCLUDED.used, updated_at = NOW()`
+	args := map[string]interface{}{
+		"user_id":      userID,
+		"feature":      grant.Feature,
+		"period_start": start,
+		"period_end":   end,
+		"n":            n,
+	}
+	if grant.Limit != nil {
+		query += ` WHERE quota_usages.used + EXCLUDED.used <= @limit`
+		args["limit"] = *grant.Limit
+	}
+	query += ` RETURNING used`
+
+	var result struct{ Used int64 }
+	tx := db.Raw(query, args).Scan(&result)
+	if tx.Error != nil {
+		return Usage{}, tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		usage, err := Check(db, userID, grant)
+		if err != nil {
+			return Usage{}, err
+		}
+		return usage, ErrQuotaExceeded
+	}
+
+	return newUsage(grant, result.Used, start, end), nil
+}
+
+// Release gives back n units consumed in the current period, for example when
+// the request they were reserved for failed.
+func Release(db *gorm.DB, userID uuid.UUID, grant entitlements.Grant, n int64) error {
+	start, _, err := CurrentPeriod(db, userID, grant)
+	if err != nil {
+		return err
+	}
+
+	return db.Model(&models.QuotaUsage{}).
+		Where("user_id = ? AND feature = ? AND period_start = ?", userID, grant.Feature, start).
+		Update("used", gorm.Expr("GREATEST(used - ?, 0)", n)).Error
+}
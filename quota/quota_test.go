@@ -0,0 +1,38 @@
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodContaining(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		anchor    time.Time
+		months    int
+		t         time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"before the anchor", date(2024, 3, 15), 1, date(2024, 3, 1), date(2024, 3, 15), date(2024, 4, 15)},
+		{"first period", date(2024, 3, 15), 1, date(2024, 3, 20), date(2024, 3, 15), date(2024, 4, 15)},
+		{"before the anchor day", date(2024, 3, 15), 1, date(2024, 5, 10), date(2024, 4, 15), date(2024, 5, 15)},
+		{"on the anchor day", date(2024, 3, 15), 1, date(2024, 5, 15), date(2024, 5, 15), date(2024, 6, 15)},
+		{"31st into February", date(2024, 1, 31), 1, date(2024, 2, 10), date(2024, 1, 31), date(2024, 2, 29)},
+		{"31st after February", date(2024, 1, 31), 1, date(2024, 3, 5), date(2024, 2, 29), date(2024, 3, 31)},
+		{"31st into a 30 day month", date(2024, 1, 31), 1, date(2024, 4, 30), date(2024, 4, 30), date(2024, 5, 31)},
+		{"yearly from a leap day", date(2024, 2, 29), 12, date(2025, 3, 1), date(2025, 2, 28), date(2026, 2, 28)},
+		{"yearly", date(2023, 6, 1), 12, date(2024, 7, 1), date(2024, 6, 1), date(2025, 6, 1)},
+	}
+
+	for _, tt := range tests {
+		start, end := periodContaining(tt.anchor, tt.months, tt.t)
+		if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+			t.Errorf("%s: got %v to %v, want %v to %v", tt.name, start, end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
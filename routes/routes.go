@@ -23,17 +23,80 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB) {
 	// Public routes
 	r.POST("/register", handlers.Register(authHandler))
 	r.POST("/login", handlers.Login(authHandler))
+	r.POST("/stripe/webhook", handlers.StripeWebhook(db))
 
 	// Protected routes
 	protected := r.Group("/")
-	protected.Use(middleware.AuthMiddleware(config.JWTSecret))
+	protected.Use(middleware.AuthMiddleware(config.JWTSecret), middleware.Idempotency(db), middleware.Entitlements(db), middleware.Organization(db))
 	{
 		protected.GET("/products", handlers.GetProducts(db))
 		protected.POST("/subscribe", handlers.Subscribe(db))
 		protected.GET("/subscription", handlers.GetSubscription(db))
 		protected.POST("/cancel-subscription", handlers.CancelSubscription(db))
 		protected.POST("/create-product", handlers.CreateProductHandler(db))
+		protected.POST("/import-products", handlers.ImportProductsHandler(db))
 		protected.POST("/promote-to-admin", handlers.PromoteToAdmin(db))
 		protected.POST("/trial-subscribe", handlers.TrialSubscribe(db))
+		protected.POST("/subscription/:id/addons", handlers.AddSubscriptionAddon(db))
+		protected.DELETE("/subscription/:id/addons/:item_id", handlers.RemoveSubscriptionAddon(db))
+		protected.GET("/subscription/:id/events", handlers.GetSubscriptionEvents(db))
+		protected.POST("/purchase", handlers.PurchaseProduct(db))
+		protected.GET("/purchases", handlers.GetPurchases(db))
+		protected.GET("/products/:id/access", handlers.GetProductAccess(db))
+		protected.POST("/gifts", handlers.CreateGift(db))
+		protected.GET("/gifts", handlers.GetGifts(db))
+		protected.POST("/gifts/redeem", handlers.RedeemGift(db))
+		protected.GET("/gifts/:id/audit", handlers.GetGiftAudit(db))
+		protected.GET("/referrals", handlers.GetReferrals(db))
+		protected.GET("/wallet", handlers.GetWallet(db))
+		protected.POST("/wallet/top-up", handlers.CreateWalletTopUp(db))
+		protected.POST("/wallet/spend", handlers.SpendWallet(db))
+		protected.POST("/wallet/refund", handlers.RefundWallet(db))
+		protected.GET("/entitlements", handlers.GetEntitlements(db))
+		protected.GET("/features", handlers.GetFeatures(db))
+		protected.POST("/features", handlers.CreateFeature(db))
+		protected.POST("/products/:id/entitlements", handlers.SetProductEntitlement(db))
+		protected.DELETE("/products/:id/entitlements/:feature_key", handlers.DeleteProductEntitlement(db))
+		protected.GET("/usage", handlers.GetUsage(db))
+		protected.GET("/usage/:feature", handlers.GetFeatureUsage(db))
+		protected.POST("/usage/:feature", handlers.RecordUsage(db))
+		protected.POST("/organizations", handlers.CreateOrganization(db))
+		protected.GET("/organizations", handlers.GetOrganizations(db))
+		protected.GET("/organizations/:id", handlers.GetOrganization(db))
+		protected.POST("/organizations/:id/invitations", handlers.InviteOrganizationMember(db))
+		protected.DELETE("/organizations/:id/invitations/:invitation_id", handlers.RevokeOrganizationInvitation(db))
+		protected.PUT("/organizations/:id/members/:user_id", handlers.UpdateOrganizationMember(db))
+		protected.DELETE("/organizations/:id/members/:user_id", handlers.RemoveOrganizationMember(db))
+		protected.PUT("/organizations/:id/members/:user_id/seat", handlers.AssignOrganizationSeat(db))
+		protected.GET("/invitations", handlers.GetInvitations(db))
+		protected.POST("/invitations/:id/accept", handlers.AcceptInvitation(db))
+		protected.GET("/admin/job-runs", handlers.GetJobRuns(db))
+		protected.GET("/admin/jobs", handlers.GetQueuedJobs(db))
+		protected.GET("/admin/jobs/:id", handlers.GetQueuedJob(db))
+		protected.POST("/admin/jobs/:id/retry", handlers.RetryQueuedJob(db))
+		protected.POST("/admin/jobs/:id/discard", handlers.DiscardQueuedJob(db))
+		protected.POST("/admin/webhooks", handlers.CreateWebhookEndpoint(db))
+		protected.GET("/admin/webhooks", handlers.GetWebhookEndpoints(db))
+		protected.PUT("/admin/webhooks/:id", handlers.UpdateWebhookEndpoint(db))
+		protected.DELETE("/admin/webhooks/:id", handlers.DeleteWebhookEndpoint(db))
+		protected.GET("/admin/webhooks/:id/deliveries", handlers.GetWebhookDeliveries(db))
+		protected.POST("/admin/webhooks/deliveries/:delivery_id/replay", handlers.ReplayWebhookDelivery(db))
+		protected.GET("/billing-operations/:id", handlers.GetBillingOperation(db))
+		protected.GET("/admin/billing-operations", handlers.GetBillingOperations(db))
+		protected.GET("/admin/metrics", handlers.GetMetrics(db))
+		protected.GET("/admin/metrics/cohorts", handlers.GetCohorts(db))
+		protected.GET("/admin/users", handlers.GetAdminUsers(db))
+		protected.GET("/admin/users/:id", handlers.GetAdminUser(db))
+		protected.GET("/admin/subscriptions", handlers.GetAdminSubscriptions(db))
+		protected.GET("/admin/subscriptions/:id", handlers.GetAdminSubscription(db))
+		protected.POST("/admin/users/:id/comp", handlers.GrantCompSubscription(db))
+		protected.POST("/admin/subscriptions/:id/extend-trial", handlers.ExtendTrial(db))
+		protected.POST("/admin/subscriptions/:id/shift-end-date", handlers.ShiftEndDate(db))
+		protected.GET("/admin/export/subscriptions", handlers.ExportSubscriptions(db))
+		protected.GET("/admin/export/users", handlers.ExportUsers(db))
+		protected.GET("/admin/exports", handlers.GetExports(db))
+		protected.POST("/admin/exports", handlers.CreateExport(db))
+		protected.GET("/admin/exports/:id", handlers.GetExport(db))
+		protected.GET("/admin/exports/:id/download", handlers.DownloadExport(db))
 	}
 }
@@ -0,0 +1,255 @@
+// File: saga/saga.go
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"github.com/yeboahd24/subscription-stripe/utils"
+	"gorm.io/gorm"
+)
+
+// Step is one step of a saga.
+//
+// A step runs again if it fails or its worker stops before its result is
+// saved, so Run must be safe to repeat: external calls use the operation's
+// IdempotencyKey, and results are kept in the operation's State. Compensate
+// undoes the step. It also runs for the step that failed, so it must do
+// nothing when the step left nothing behind, and it may be nil.
+type Step struct {
+	Name       string
+	Run        func(ctx context.Context, op *Operation) error
+	Compensate func(ctx context.Context, op *Operation) error
+}
+
+// Saga is a kind of billing operation.
+type Saga struct {
+	Kind  string
+	Steps []Step
+	// Compensated runs once every step was undone, for example to mark the
+	// local records the operation started with as failed
+	Compensated func(ctx context.Context, op *Operation) error
+}
+
+// Operation is a billing operation being run by a saga.
+type Operation struct {
+	*models.BillingOperation
+	db *gorm.DB
+}
+
+// Get returns a value saved by an earlier step.
+func (op *Operation) Get(key string) string {
+	return op.State[key]
+}
+
+// Set keeps a value for later steps and compensations. It is saved when the
+// step completes, or by Save.
+func (op *Operation) Set(key string, value string) {
+	if op.State == nil {
+		op.State = map[string]string{}
+	}
+	op.State[key] = value
+}
+
+// Save stores the operation. Steps call it before an external call whose
+// effect must be undone even if the step is interrupted.
+func (op *Operation) Save() error {
+	return op.db.Save(op.BillingOperation).Error
+}
+
+// DecodeInput decodes the operation's input into v.
+func (op *Operation) DecodeInput(v interface{}) error {
+	return json.Unmarshal(op.Input, v)
+}
+
+// IdempotencyKey returns the key for an external call made by the current
+// step, the same every time the step runs.
+func (op *Operation) IdempotencyKey() string {
+	return fmt.Sprintf("billing-operation:%s:%s", op.ID, op.Step)
+}
+
+type abortError struct {
+	err error
+}
+
+func (e abortError) Error() string { return e.err.Error() }
+func (e abortError) Unwrap() error { return e.err }
+
+// Abort marks a step error as final: the step is not retried and the
+// operation is compensated straight away. Other errors are retried until the
+// operation's attempts run out.
+func Abort(err error) error {
+	return abortError{err: err}
+}
+
+// Task is the queued job that runs an operation.
+type Task struct {
+	OperationID uuid.UUID `json:"operation_id"`
+}
+
+func (Task) Kind() string { return "billing_operation" }
+
+const (
+	defaultMaxAttempts = 5
+	// The job keeps being retried after the operation's own attempts run
+	// out, so that compensations are retried too
+	jobAttempts = 20
+)
+
+// Start records a new operation and queues it for a worker. Call it in the
+// same transaction as the local changes the operation belongs to; nothing
+// happens outside the database until that transaction commits.
+func Start(tx *gorm.DB, operation *models.BillingOperation, input interface{}) error {
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	operation.Input = encoded
+	operation.Status = models.BillingOperationStatusPending
+	if operation.MaxAttempts < 1 {
+		operation.MaxAttempts = defaultMaxAttempts
+	}
+	if operation.State == nil {
+		operation.State = map[string]string{}
+	}
+	if err := tx.Create(operation).Error; err != nil {
+		return err
+	}
+
+	_, err = jobs.Enqueue(tx, Task{OperationID: operation.ID}, jobs.EnqueueOptions{
+		UniqueKey:   "billing-operation:" + operation.ID.String(),
+		MaxAttempts: jobAttempts,
+	})
+	return err
+}
+
+// Coordinator runs billing operations for the sagas registered with it.
+type Coordinator struct {
+	db    *gorm.DB
+	sagas map[string]Saga
+}
+
+func NewCoordinator(db *gorm.DB) *Coordinator {
+	return &Coordinator{db: db, sagas: map[string]Saga{}}
+}
+
+func (c *Coordinator) Register(s Saga) {
+	c.sagas[s.Kind] = s
+}
+
+// Run runs an operation's remaining steps, or its compensations once a step
+// has failed for good. Register it with jobs.Handle. Errors make the queue
+// run the operation again later, from where it stopped.
+func (c *Coordinator) Run(ctx context.Context, task Task) error {
+	var operation models.BillingOperation
+	if err := c.db.WithContext(ctx).First(&operation, "id = ?", task.OperationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return jobs.Permanent(err)
+		}
+		return err
+	}
+
+	s, ok := c.sagas[operation.Kind]
+	if !ok {
+		return jobs.Permanent(fmt.Errorf("no saga registered for %q", operation.Kind))
+	}
+
+	// Bookkeeping is saved even when ctx is cancelled
+	op := &Operation{BillingOperation: &operation, db: c.db}
+
+	switch operation.Status {
+	case models.BillingOperationStatusPending, models.BillingOperationStatusRunning:
+		if err := c.forward(ctx, s, op); err != nil {
+			return err
+		}
+		if operation.Status != models.BillingOperationStatusCompensating {
+			return nil
+		}
+		return c.backward(ctx, s, op)
+	case models.BillingOperationStatusCompensating:
+		return c.backward(ctx, s, op)
+	}
+
+	return nil
+}
+
+func (c *Coordinator) forward(ctx context.Context, s Saga, op *Operation) error {
+	op.Status = models.BillingOperationStatusRunning
+	op.Attempts++
+	if err := op.Save(); err != nil {
+		return err
+	}
+
+	for op.StepIndex < len(s.Steps) {
+		step := s.Steps[op.StepIndex]
+		op.Step = step.Name
+
+		if err := step.Run(ctx, op); err != nil {
+			op.Error = err.Error()
+			var abort abortError
+			if !errors.As(err, &abort) && op.Attempts < op.MaxAttempts {
+				if saveErr := op.Save(); saveErr != nil {
+					utils.Log("Error saving billing operation", op.ID, ":", saveErr)
+				}
+				return err
+			}
+
+			utils.Log("Billing operation", op.ID, op.Kind, "failed at", step.Name, ", compensating:", err)
+			op.Status = models.BillingOperationStatusCompensating
+			return op.Save()
+		}
+
+		op.StepIndex++
+		if err := op.Save(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	op.Status = models.BillingOperationStatusCompleted
+	op.Error = ""
+	op.CompletedAt = &now
+	return op.Save()
+}
+
+// backward compensates the failed step and every step before it, last first.
+func (c *Coordinator) backward(ctx context.Context, s Saga, op *Operation) error {
+	for op.StepIndex >= 0 {
+		if op.StepIndex < len(s.Steps) {
+			step := s.Steps[op.StepIndex]
+			op.Step = step.Name
+			if step.Compensate != nil {
+				if err := step.Compensate(ctx, op); err != nil {
+					utils.Log("Error compensating billing operation", op.ID, "step", step.Name, ":", err)
+					if saveErr := op.Save(); saveErr != nil {
+						utils.Log("Error saving billing operation", op.ID, ":", saveErr)
+					}
+					return err
+				}
+			}
+		}
+
+		op.StepIndex--
+		if err := op.Save(); err != nil {
+			return err
+		}
+	}
+
+	if s.Compensated != nil {
+		if err := s.Compensated(ctx, op); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	op.Status = models.BillingOperationStatusCompensated
+	op.CompletedAt = &now
+	return op.Save()
+}
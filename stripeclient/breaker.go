@@ -0,0 +1,66 @@
+// File: stripeclient/breaker.go
+package stripeclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yeboahd24/subscription-stripe/utils"
+)
+
+// breaker is a consecutive-failure circuit breaker. It opens after threshold
+// failures in a row. Once cooldown has passed it lets a single request
+// through: success closes it again, failure keeps it open for another
+// cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be sent.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a request allowed through.
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	if !failed {
+		if wasOpen {
+			utils.Log("Stripe circuit breaker closed")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if !wasOpen {
+			utils.Log("Stripe circuit breaker opened after", b.failures, "consecutive failures")
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
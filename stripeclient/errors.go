@@ -0,0 +1,78 @@
+// File: stripeclient/errors.go
+package stripeclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	stripe72 "github.com/stripe/stripe-go/v72"
+	stripe79 "github.com/stripe/stripe-go/v79"
+)
+
+// Stripe error types, the same in both SDK versions.
+const (
+	ErrorTypeAPI            = "api_error"
+	ErrorTypeCard           = "card_error"
+	ErrorTypeIdempotency    = "idempotency_error"
+	ErrorTypeInvalidRequest = "invalid_request_error"
+	ErrorTypeAuthentication = "authentication_error"
+	ErrorTypePermission     = "more_permissions_required"
+	ErrorTypeRateLimit      = "rate_limit_error"
+)
+
+// Error is an error returned by the Stripe API, from either SDK version.
+type Error struct {
+	Type           string
+	Code           string
+	DeclineCode    string
+	Message        string
+	Param          string
+	HTTPStatusCode int
+}
+
+// AsError extracts the Stripe API error from err, if there is one.
+func AsError(err error) (*Error, bool) {
+	var err72 *stripe72.Error
+	if errors.As(err, &err72) {
+		return &Error{
+			Type:           string(err72.Type),
+			Code:           string(err72.Code),
+			DeclineCode:    string(err72.DeclineCode),
+			Message:        err72.Msg,
+			Param:          err72.Param,
+			HTTPStatusCode: err72.HTTPStatusCode,
+		}, true
+	}
+
+	var err79 *stripe79.Error
+	if errors.As(err, &err79) {
+		return &Error{
+			Type:           string(err79.Type),
+			Code:           string(err79.Code),
+			DeclineCode:    string(err79.DeclineCode),
+			Message:        err79.Msg,
+			Param:          err79.Param,
+			HTTPStatusCode: err79.HTTPStatusCode,
+		}, true
+	}
+
+	return nil, false
+}
+
+// IsTemporary reports whether a failed Stripe call may succeed if made again
+// later: Stripe was unreachable, slow, overloaded or failing, or the circuit
+// breaker is open. Errors about the request itself, such as a declined card,
+// are not temporary.
+func IsTemporary(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	stripeErr, ok := AsError(err)
+	if !ok {
+		return err != nil // Connection errors
+	}
+	return stripeErr.Type == ErrorTypeRateLimit || stripeErr.Type == ErrorTypeAPI ||
+		stripeErr.HTTPStatusCode >= 500 ||
+		stripeErr.HTTPStatusCode == http.StatusConflict || stripeErr.HTTPStatusCode == http.StatusTooManyRequests
+}
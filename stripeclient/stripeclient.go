@@ -0,0 +1,81 @@
+// File: stripeclient/stripeclient.go
+package stripeclient
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	stripe72 "github.com/stripe/stripe-go/v72"
+	stripe79 "github.com/stripe/stripe-go/v79"
+)
+
+// Config controls how Stripe API requests are made.
+type Config struct {
+	// Timeout limits each attempt of a request; the caller's context limits
+	// the request as a whole
+	Timeout time.Duration
+	// MaxRetries is how often a failed request is retried. Only reads and
+	// requests with an idempotency key are retried
+	MaxRetries int
+	// RetryDelay is the base of the exponential backoff between retries,
+	// capped at MaxRetryDelay. Each delay is jittered
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// After BreakerThreshold consecutive failures, requests fail with
+	// ErrCircuitOpen without reaching Stripe for BreakerCooldown. Then one
+	// request is let through to test whether Stripe has recovered
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultConfig is used for settings missing from the environment.
+var DefaultConfig = Config{
+	Timeout:          10 * time.Second,
+	MaxRetries:       2,
+	RetryDelay:       500 * time.Millisecond,
+	MaxRetryDelay:    5 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// FromEnv reads the config from STRIPE_TIMEOUT, STRIPE_MAX_RETRIES,
+// STRIPE_RETRY_DELAY, STRIPE_BREAKER_THRESHOLD and STRIPE_BREAKER_COOLDOWN.
+// Durations use Go's syntax, e.g. "10s".
+func FromEnv() Config {
+	cfg := DefaultConfig
+	if timeout, err := time.ParseDuration(os.Getenv("STRIPE_TIMEOUT")); err == nil && timeout > 0 {
+		cfg.Timeout = timeout
+	}
+	if retries, err := strconv.Atoi(os.Getenv("STRIPE_MAX_RETRIES")); err == nil && retries >= 0 {
+		cfg.MaxRetries = retries
+	}
+	if delay, err := time.ParseDuration(os.Getenv("STRIPE_RETRY_DELAY")); err == nil && delay > 0 {
+		cfg.RetryDelay = delay
+	}
+	if threshold, err := strconv.Atoi(os.Getenv("STRIPE_BREAKER_THRESHOLD")); err == nil && threshold > 0 {
+		cfg.BreakerThreshold = threshold
+	}
+	if cooldown, err := time.ParseDuration(os.Getenv("STRIPE_BREAKER_COOLDOWN")); err == nil && cooldown > 0 {
+		cfg.BreakerCooldown = cooldown
+	}
+	return cfg
+}
+
+// Install makes both Stripe SDK versions send their API requests through a
+// transport applying cfg. The SDKs' own retries are turned off so that
+// requests are not retried twice. Call it once on startup, before any Stripe
+// call.
+func Install(cfg Config) {
+	client := &http.Client{Transport: NewTransport(cfg, http.DefaultTransport)}
+
+	stripe72.SetBackend(stripe72.APIBackend, stripe72.GetBackendWithConfig(stripe72.APIBackend, &stripe72.BackendConfig{
+		HTTPClient:        client,
+		MaxNetworkRetries: stripe72.Int64(0),
+	}))
+	stripe79.SetBackend(stripe79.APIBackend, stripe79.GetBackendWithConfig(stripe79.APIBackend, &stripe79.BackendConfig{
+		HTTPClient:        client,
+		MaxNetworkRetries: stripe79.Int64(0),
+	}))
+}
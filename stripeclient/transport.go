@@ -0,0 +1,141 @@
+// File: stripeclient/transport.go
+package stripeclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Stripe while recent requests
+// have kept failing.
+var ErrCircuitOpen = errors.New("stripe circuit breaker is open")
+
+// Transport is an http.RoundTripper for the Stripe API that times out slow
+// attempts, retries failed requests with jittered backoff and fails fast
+// through a circuit breaker while Stripe is degraded.
+type Transport struct {
+	cfg     Config
+	base    http.RoundTripper
+	breaker *breaker
+}
+
+func NewTransport(cfg Config, base http.RoundTripper) *Transport {
+	return &Transport{cfg: cfg, base: base, breaker: newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Retrying a write is only safe with an idempotency key: Stripe then
+	// returns the result of the first attempt instead of acting twice. The
+	// SDKs add one to every write made with params
+	retryable := req.Method == http.MethodGet || req.Header.Get("Idempotency-Key") != ""
+	if req.Body != nil && req.GetBody == nil {
+		retryable = false
+	}
+
+	for attempt := 0; ; attempt++ {
+		if !t.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+
+		response, err := t.attempt(req, attempt)
+		failed, retry := outcome(req, response, err)
+		t.breaker.record(failed)
+
+		if !retry || !retryable || attempt >= t.cfg.MaxRetries {
+			return response, err
+		}
+
+		if response != nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		if !sleep(req.Context(), t.backoff(attempt)) {
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attempt sends the request once, limited to the configured timeout.
+func (t *Transport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.cfg.Timeout)
+	try := req.Clone(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		try.Body = body
+	}
+
+	response, err := t.base.RoundTrip(try)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout also covers reading the body
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// outcome reports whether an attempt counts as a Stripe failure for the
+// circuit breaker, and whether it is worth retrying.
+func outcome(req *http.Request, response *http.Response, err error) (failed bool, retry bool) {
+	if err != nil {
+		// The caller gave up; that says nothing about Stripe
+		if req.Context().Err() != nil {
+			return false, false
+		}
+		// Connection errors and attempts that timed out
+		return true, true
+	}
+
+	failed = response.StatusCode >= 500
+	switch response.Header.Get("Stripe-Should-Retry") {
+	case "true":
+		return failed, true
+	case "false":
+		return failed, false
+	}
+	return failed, failed || response.StatusCode == http.StatusTooManyRequests
+}
+
+// backoff returns the delay before the next attempt: exponential in the
+// number of attempts so far, capped, with jitter so that clients failing
+// together do not retry together.
+func (t *Transport) backoff(attempt int) time.Duration {
+	delay := t.cfg.RetryDelay << attempt
+	if delay > t.cfg.MaxRetryDelay || delay <= 0 {
+		delay = t.cfg.MaxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sleep waits for d or until ctx is done, and reports whether it waited the
+// whole time.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
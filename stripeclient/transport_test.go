@@ -0,0 +1,245 @@
+package stripeclient
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests in a temporary directory, where the breaker's log
+// lines end up in app.log.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "stripeclient")
+	if err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeStripe answers requests with the given responses in turn, repeating
+// the last one, and records the bodies it was sent.
+type fakeStripe struct {
+	responses []fakeResponse
+	bodies    []string
+}
+
+type fakeResponse struct {
+	status      int
+	shouldRetry string // Stripe-Should-Retry header, if set
+	err         error
+}
+
+func (f *fakeStripe) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		data, _ := io.ReadAll(req.Body)
+		body = string(data)
+	}
+	f.bodies = append(f.bodies, body)
+
+	next := f.responses[len(f.responses)-1]
+	if len(f.bodies) <= len(f.responses) {
+		next = f.responses[len(f.bodies)-1]
+	}
+	if next.err != nil {
+		return nil, next.err
+	}
+	header := http.Header{}
+	if next.shouldRetry != "" {
+		header.Set("Stripe-Should-Retry", next.shouldRetry)
+	}
+	return &http.Response{StatusCode: next.status, Header: header, Body: io.NopCloser(strings.NewReader("{}")), Request: req}, nil
+}
+
+// testConfig retries quickly and keeps the breaker out of the way.
+var testConfig = Config{
+	Timeout:          time.Second,
+	MaxRetries:       2,
+	RetryDelay:       time.Millisecond,
+	MaxRetryDelay:    2 * time.Millisecond,
+	BreakerThreshold: 100,
+	BreakerCooldown:  time.Minute,
+}
+
+func TestTransportRetries(t *testing.T) {
+	ok := fakeResponse{status: http.StatusOK}
+	unavailable := fakeResponse{status: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name           string
+		method         string
+		idempotencyKey string
+		responses      []fakeResponse
+		wantAttempts   int
+		wantStatus     int
+		wantErr        bool
+	}{
+		{"success", http.MethodGet, "", []fakeResponse{ok}, 1, http.StatusOK, false},
+		{"read retried after a server error", http.MethodGet, "", []fakeResponse{unavailable, ok}, 2, http.StatusOK, false},
+		{"read retried after a connection error", http.MethodGet, "", []fakeResponse{{err: errors.New("connection reset")}, ok}, 2, http.StatusOK, false},
+		{"read retried when rate limited", http.MethodGet, "", []fakeResponse{{status: http.StatusTooManyRequests}, ok}, 2, http.StatusOK, false},
+		{"retries run out", http.MethodGet, "", []fakeResponse{unavailable}, 3, http.StatusServiceUnavailable, false},
+		{"connection errors run out", http.MethodGet, "", []fakeResponse{{err: errors.New("connection reset")}}, 3, 0, true},
+		{"client error not retried", http.MethodGet, "", []fakeResponse{{status: http.StatusBadRequest}, ok}, 1, http.StatusBadRequest, false},
+		{"Stripe says not to retry", http.MethodGet, "", []fakeResponse{{status: http.StatusInternalServerError, shouldRetry: "false"}, ok}, 1, http.StatusInternalServerError, false},
+		{"Stripe says to retry", http.MethodGet, "", []fakeResponse{{status: http.StatusConflict, shouldRetry: "true"}, ok}, 2, http.StatusOK, false},
+		{"write without a key not retried", http.MethodPost, "", []fakeResponse{unavailable, ok}, 1, http.StatusServiceUnavailable, false},
+		{"write with a key retried", http.MethodPost, "key", []fakeResponse{unavailable, ok}, 2, http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripe := &fakeStripe{responses: tt.responses}
+			client := &http.Client{Transport: NewTransport(testConfig, stripe)}
+
+			req, err := http.NewRequest(tt.method, "https://api.stripe.com/v1/subscriptions", strings.NewReader("quantity=2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.idempotencyKey != "" {
+				req.Header.Set("Idempotency-Key", tt.idempotencyKey)
+			}
+
+			response, err := client.Do(req)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if response != nil {
+				response.Body.Close()
+				if response.StatusCode != tt.wantStatus {
+					t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+				}
+			}
+			if len(stripe.bodies) != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", len(stripe.bodies), tt.wantAttempts)
+			}
+			for i, body := range stripe.bodies {
+				if body != "quantity=2" {
+					t.Errorf("attempt %d sent body %q", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestTransportBreaker(t *testing.T) {
+	cfg := testConfig
+	cfg.MaxRetries = 0
+	cfg.BreakerThreshold = 2
+	cfg.BreakerCooldown = 20 * time.Millisecond
+
+	stripe := &fakeStripe{responses: []fakeResponse{{status: http.StatusInternalServerError}, {status: http.StatusInternalServerError}, {status: http.StatusOK}}}
+	transport := NewTransport(cfg, stripe)
+	get := func() error {
+		req, _ := http.NewRequest(http.MethodGet, "https://api.stripe.com/v1/subscriptions", nil)
+		response, err := transport.RoundTrip(req)
+		if response != nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	steps := []struct {
+		name         string
+		wait         time.Duration
+		wantErr      error
+		wantAttempts int
+	}{
+		{"first failure", 0, nil, 1},
+		{"second failure opens", 0, nil, 2},
+		{"open", 0, ErrCircuitOpen, 2},
+		{"still open", 0, ErrCircuitOpen, 2},
+		{"probe after the cooldown closes", cfg.BreakerCooldown, nil, 3},
+		{"closed", 0, nil, 4},
+	}
+	for _, step := range steps {
+		time.Sleep(step.wait)
+		if err := get(); !errors.Is(err, step.wantErr) {
+			t.Errorf("%s: got error %v, want %v", step.name, err, step.wantErr)
+		}
+		if len(stripe.bodies) != step.wantAttempts {
+			t.Errorf("%s: Stripe got %d requests, want %d", step.name, len(stripe.bodies), step.wantAttempts)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		failures  []bool // Outcomes of the requests let through, in order
+		wantAllow bool
+	}{
+		{"no requests", 3, nil, true},
+		{"below the threshold", 3, []bool{true, true}, true},
+		{"at the threshold", 3, []bool{true, true, true}, false},
+		{"success resets the count", 3, []bool{true, true, false, true, true}, true},
+		{"threshold of one", 1, []bool{true}, false},
+	}
+
+	for _, tt := range tests {
+		b := newBreaker(tt.threshold, time.Minute)
+		for _, failed := range tt.failures {
+			if !b.allow() {
+				t.Fatalf("%s: request refused before the threshold", tt.name)
+			}
+			b.record(failed)
+		}
+		if got := b.allow(); got != tt.wantAllow {
+			t.Errorf("%s: allow() = %v, want %v", tt.name, got, tt.wantAllow)
+		}
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	b := newBreaker(1, 0)
+	b.record(true)
+
+	if !b.allow() {
+		t.Fatal("probe refused after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("second request allowed while probing")
+	}
+	b.record(true)
+	if !b.allow() {
+		t.Fatal("no new probe after a failed probe and the cooldown")
+	}
+	b.record(false)
+	if !b.allow() || !b.allow() {
+		t.Fatal("requests refused after a successful probe")
+	}
+}
+
+func TestTransportBackoff(t *testing.T) {
+	transport := NewTransport(Config{RetryDelay: 100 * time.Millisecond, MaxRetryDelay: time.Second}, nil)
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		{4, 500 * time.Millisecond, time.Second},
+		{70, 500 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := transport.backoff(tt.attempt); got < tt.min || got > tt.max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tt.attempt, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
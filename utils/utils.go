@@ -2,10 +2,12 @@
 package utils
 
 import (
+	"crypto/rand"
 	"fmt"
 	"log"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -44,6 +46,31 @@ func IsValidEmail(email string) bool {
 	return re.MatchString(email)
 }
 
+// NormalizeEmail reduces an address to the mailbox it is delivered to, so that
+// aliases of the same person compare equal. It lowercases the address, drops
+// "+tag" suffixes and ignores dots in Gmail local parts.
+func NormalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+
+	return local + "@" + domain
+}
+
 // Log function to log messages
 func Log(v ...interface{}) {
 	// Create or open a log file
@@ -62,3 +89,26 @@ func Log(v ...interface{}) {
 	// Also print to console
 	fmt.Println(v...)
 }
+
+// Alphabet for generated codes, without characters that are easily confused
+// such as 0/O and 1/I
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GenerateCode returns a random code such as "GIFT-7KQ2-MX9P-3RTA" made of the
+// prefix followed by the given number of four character groups.
+func GenerateCode(prefix string, groups int) (string, error) {
+	buf := make([]byte, groups*4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	code := prefix
+	for i, b := range buf {
+		if i%4 == 0 {
+			code += "-"
+		}
+		code += string(codeAlphabet[int(b)%len(codeAlphabet)])
+	}
+
+	return code, nil
+}
@@ -0,0 +1,129 @@
+// File: webhooks/deliver.go
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// DeliveryTask is a queued delivery of an event to an endpoint.
+type DeliveryTask struct {
+	EndpointID uuid.UUID `json:"endpoint_id"`
+	EventID    uuid.UUID `json:"event_id"`
+}
+
+func (DeliveryTask) Kind() string { return "webhook_delivery" }
+
+// payload is the body POSTed to endpoints.
+type payload struct {
+	ID        uuid.UUID       `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Deliverer POSTs queued events to their endpoints and logs every attempt.
+type Deliverer struct {
+	db     *gorm.DB
+	client *http.Client
+}
+
+func NewDeliverer(db *gorm.DB) *Deliverer {
+	return &Deliverer{db: db, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+var errEndpointFailed = errors.New("endpoint did not return a 2xx response")
+
+// maxLoggedResponse is how much of a response body is kept in the log.
+const maxLoggedResponse = 1024
+
+// Deliver sends one event to one endpoint. Any response other than 2xx is an
+// error, so the queue retries it with backoff. Register it with jobs.Handle.
+func (d *Deliverer) Deliver(ctx context.Context, task DeliveryTask) error {
+	db := d.db.WithContext(ctx)
+
+	var endpoint models.WebhookEndpoint
+	if err := db.First(&endpoint, "id = ?", task.EndpointID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil // Endpoint deleted since
+		}
+		return err
+	}
+	if !endpoint.Active {
+		return nil
+	}
+
+	var event models.WebhookEvent
+	if err := db.First(&event, "id = ?", task.EventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return jobs.Permanent(err)
+		}
+		return err
+	}
+
+	body, err := json.Marshal(payload{ID: event.ID, Type: event.Type, CreatedAt: event.CreatedAt, Data: event.Data})
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+
+	var attempts int64
+	if err := db.Model(&models.WebhookDelivery{}).Where("endpoint_id = ? AND event_id = ?", endpoint.ID, event.ID).Count(&attempts).Error; err != nil {
+		return err
+	}
+	delivery := models.WebhookDelivery{
+		EndpointID: endpoint.ID,
+		EventID:    event.ID,
+		EventType:  event.Type,
+		Attempt:    int(attempts) + 1,
+	}
+
+	started := time.Now()
+	deliveryErr := d.post(ctx, endpoint, event, body, &delivery)
+	delivery.DurationMs = time.Since(started).Milliseconds()
+	delivery.Succeeded = deliveryErr == nil
+	if deliveryErr != nil {
+		delivery.Error = deliveryErr.Error()
+	}
+
+	if err := d.db.Create(&delivery).Error; err != nil {
+		return err
+	}
+	return deliveryErr
+}
+
+func (d *Deliverer) post(ctx context.Context, endpoint models.WebhookEndpoint, event models.WebhookEvent, body []byte, delivery *models.WebhookDelivery) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Event", event.Type)
+	request.Header.Set("X-Webhook-ID", event.ID.String())
+	request.Header.Set(SignatureHeader, Sign(endpoint.Secret, time.Now(), body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, maxLoggedResponse))
+	delivery.ResponseCode = response.StatusCode
+	delivery.ResponseBody = string(responseBody)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", errEndpointFailed, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// File: webhooks/webhooks.go
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yeboahd24/subscription-stripe/jobs"
+	"github.com/yeboahd24/subscription-stripe/models"
+	"gorm.io/gorm"
+)
+
+// Event types sent to webhook endpoints. Subscription events are named after
+// the subscription event they report, e.g. "subscription.cancelled".
+const (
+	EventUserCreated = "user.created"
+)
+
+// EventTypes lists every event type endpoints can subscribe to.
+var EventTypes = []string{
+	EventUserCreated,
+	SubscriptionEventType(models.SubscriptionEventCreated),
+	SubscriptionEventType(models.SubscriptionEventTrialStarted),
+	SubscriptionEventType(models.SubscriptionEventTrialEnded),
+	SubscriptionEventType(models.SubscriptionEventActivated),
+	SubscriptionEventType(models.SubscriptionEventPlanChanged),
+	SubscriptionEventType(models.SubscriptionEventAddonAdded),
+	SubscriptionEventType(models.SubscriptionEventAddonRemoved),
+	SubscriptionEventType(models.SubscriptionEventPaymentFailed),
+	SubscriptionEventType(models.SubscriptionEventPaymentRecovered),
+	SubscriptionEventType(models.SubscriptionEventPaused),
+	SubscriptionEventType(models.SubscriptionEventResumed),
+	SubscriptionEventType(models.SubscriptionEventCancelled),
+	SubscriptionEventType(models.SubscriptionEventTrialExtended),
+	SubscriptionEventType(models.SubscriptionEventEndDateChanged),
+}
+
+// SubscriptionEventType names the webhook event for a subscription event type.
+func SubscriptionEventType(subscriptionEventType string) string {
+	return "subscription." + subscriptionEventType
+}
+
+// IsEventType reports whether endpoints can subscribe to eventType. "*"
+// subscribes to every event.
+func IsEventType(eventType string) bool {
+	if eventType == "*" {
+		return true
+	}
+	for _, known := range EventTypes {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Emit records an event and queues its delivery to every active endpoint
+// subscribed to it. Pass a transaction as db to emit the event only if it
+// commits.
+func Emit(db *gorm.DB, eventType string, data interface{}) error {
+	var endpoints []models.WebhookEndpoint
+	if err := db.Where("active = ?", true).Find(&endpoints).Error; err != nil {
+		return err
+	}
+
+	var subscribed []models.WebhookEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.Subscribes(eventType) {
+			subscribed = append(subscribed, endpoint)
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encoding %s event: %w", eventType, err)
+	}
+
+	event := models.WebhookEvent{Type: eventType, Data: encoded}
+	if err := db.Create(&event).Error; err != nil {
+		return err
+	}
+
+	for _, endpoint := range subscribed {
+		if err := queueDelivery(db, endpoint.ID, event.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replay queues another delivery of an event to an endpoint. It returns
+// jobs.ErrDuplicateJob if one is already waiting.
+func Replay(db *gorm.DB, endpointID uuid.UUID, eventID uuid.UUID) error {
+	return queueDelivery(db, endpointID, eventID)
+}
+
+const deliveryAttempts = 8
+
+func queueDelivery(db *gorm.DB, endpointID uuid.UUID, eventID uuid.UUID) error {
+	_, err := jobs.Enqueue(db, DeliveryTask{EndpointID: endpointID, EventID: eventID}, jobs.EnqueueOptions{
+		UniqueKey:   fmt.Sprintf("webhook:%s:%s", endpointID, eventID),
+		MaxAttempts: deliveryAttempts,
+	})
+	return err
+}
+
+// SignatureHeader carries the delivery's signature in the form
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+const SignatureHeader = "X-Webhook-Signature"
+
+// Sign computes the signature header value for a delivery body.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+// GenerateSecret returns a random signing secret.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}